@@ -0,0 +1,226 @@
+/*
+ * Copyright 2018 Paul Welch
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License"); you may not use this file except in compliance with the License. You may obtain a copy of the License at
+ *
+ * http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software distributed under the License is distributed on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the License for the specific language governing permissions and limitations under the License.
+ */
+
+package cmd
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	dto "github.com/prometheus/client_model/go"
+	"sigs.k8s.io/yaml"
+)
+
+var runAlertHookFn = runAlertHook
+
+// alertHookTimeout bounds each alert command, so a hung hook cannot stall evaluation.
+var alertHookTimeout = 30 * time.Second
+
+// alertRules is the alerts file read by watch --alerts.
+type alertRules struct {
+	Command []string     `json:"command,omitempty"`
+	Rules   []*alertRule `json:"rules"`
+}
+
+type alertRule struct {
+	Name       string   `json:"name"`
+	Metric     string   `json:"metric"`
+	Matchers   []string `json:"matchers,omitempty"`
+	Comparator string   `json:"comparator"`
+	Threshold  float64  `json:"threshold"`
+	For        string   `json:"for,omitempty"`
+	Command    []string `json:"command,omitempty"`
+
+	cond        *condition
+	forDuration time.Duration
+}
+
+type alertTransition struct {
+	Time   string            `json:"time"`
+	State  string            `json:"state"`
+	Rule   string            `json:"rule"`
+	Series string            `json:"series"`
+	Labels map[string]string `json:"labels,omitempty"`
+	Value  float64           `json:"value"`
+}
+
+type alertInstance struct {
+	since  time.Time
+	firing bool
+	sample *seriesSample
+}
+
+// alertEvaluator tracks pending and firing series per rule across watch ticks.
+type alertEvaluator struct {
+	rules  []*alertRule
+	active map[string]*alertInstance
+}
+
+func loadAlertRules(path string) (*alertRules, error) {
+	data, err := os.ReadFile(expandHome(path))
+	if err != nil {
+		return nil, err
+	}
+
+	rules := &alertRules{}
+	if err := yaml.UnmarshalStrict(data, rules); err != nil {
+		return nil, fmt.Errorf("Error reading alerts file %s: %v", path, err)
+	}
+	if len(rules.Rules) == 0 {
+		return nil, fmt.Errorf("Error reading alerts file %s: no rules defined", path)
+	}
+
+	seen := make(map[string]bool)
+	for i, r := range rules.Rules {
+		if r.Name == "" {
+			return nil, fmt.Errorf("Error in alerts file %s: rule %d has no name", path, i+1)
+		}
+		if seen[r.Name] {
+			return nil, fmt.Errorf("Error in alerts file %s: duplicate rule name %q", path, r.Name)
+		}
+		seen[r.Name] = true
+
+		expr := r.Metric
+		if len(r.Matchers) > 0 {
+			expr += "{" + strings.Join(r.Matchers, ",") + "}"
+		}
+		expr += " " + r.Comparator + " " + strconv.FormatFloat(r.Threshold, 'g', -1, 64)
+
+		r.cond, err = parseCondition(expr)
+		if err != nil {
+			return nil, fmt.Errorf("Error in alerts file %s: rule %q: %v", path, r.Name, err)
+		}
+
+		if r.For != "" {
+			r.forDuration, err = time.ParseDuration(r.For)
+			if err != nil {
+				return nil, fmt.Errorf("Error in alerts file %s: rule %q: invalid for duration %q", path, r.Name, r.For)
+			}
+		}
+
+		if len(r.Command) == 0 {
+			r.Command = rules.Command
+		}
+	}
+
+	return rules, nil
+}
+
+func newAlertEvaluator(rules *alertRules) *alertEvaluator {
+	return &alertEvaluator{rules: rules.Rules, active: make(map[string]*alertInstance)}
+}
+
+// evaluate compares every matching series against its rule and returns firing and resolved transitions.
+// A series fires once it has satisfied the rule for the rule's for-duration.
+func (e *alertEvaluator) evaluate(metricFamilies []*dto.MetricFamily, namespaceFlag string, now time.Time) []*alertTransition {
+	timestamp := now.UTC().Format(time.RFC3339)
+	transitions := make([]*alertTransition, 0)
+	current := make(map[string]bool)
+
+	for _, r := range e.rules {
+		for _, s := range r.cond.series(metricFamilies, namespaceFlag) {
+			if !compare(r.cond.op, s.value, r.cond.threshold) {
+				continue
+			}
+
+			series := seriesID(s.metric, s.labels)
+			key := r.Name + "\x00" + series
+			current[key] = true
+
+			inst := e.active[key]
+			if inst == nil {
+				inst = &alertInstance{since: now}
+				e.active[key] = inst
+			}
+			inst.sample = s
+
+			if !inst.firing && now.Sub(inst.since) >= r.forDuration {
+				inst.firing = true
+				transitions = append(transitions, &alertTransition{Time: timestamp, State: "firing", Rule: r.Name, Series: series, Labels: s.labels, Value: s.value})
+			}
+		}
+	}
+
+	for key, inst := range e.active {
+		if current[key] {
+			continue
+		}
+		if inst.firing {
+			name := strings.SplitN(key, "\x00", 2)[0]
+			transitions = append(transitions, &alertTransition{Time: timestamp, State: "resolved", Rule: name, Series: seriesID(inst.sample.metric, inst.sample.labels), Labels: inst.sample.labels, Value: inst.sample.value})
+		}
+		delete(e.active, key)
+	}
+
+	sort.Slice(transitions, func(i, j int) bool {
+		if transitions[i].Rule != transitions[j].Rule {
+			return transitions[i].Rule < transitions[j].Rule
+		}
+		return transitions[i].Series < transitions[j].Series
+	})
+
+	return transitions
+}
+
+func (e *alertEvaluator) rule(name string) *alertRule {
+	for _, r := range e.rules {
+		if r.Name == name {
+			return r
+		}
+	}
+	return nil
+}
+
+// reportAlertTransitions prints each transition and runs the rule's command hook, if any.
+// Hook failures are reported but do not stop the watch.
+func (e *alertEvaluator) reportAlertTransitions(ctx context.Context, out, errOut io.Writer, transitions []*alertTransition) {
+	for _, t := range transitions {
+		fmt.Fprintf(out, "%s\t%s\t%s\t%s\t%g\n", t.Time, strings.ToUpper(t.State), t.Rule, t.Series, t.Value)
+
+		if r := e.rule(t.Rule); r != nil && len(r.Command) > 0 {
+			if err := runAlertHookFn(ctx, r.Command, t); err != nil {
+				fmt.Fprintf(errOut, "Error running alert command for %s: %v\n", t.Rule, err)
+			}
+		}
+	}
+}
+
+// runAlertHook runs the command with the transition details in KUBESTATE_ALERT_* environment variables.
+// The command is killed when ctx ends or after alertHookTimeout.
+func runAlertHook(ctx context.Context, command []string, t *alertTransition) error {
+	ctx, cancel := context.WithTimeout(ctx, alertHookTimeout)
+	defer cancel()
+
+	hook := exec.CommandContext(ctx, command[0], command[1:]...)
+	hook.Env = append(os.Environ(),
+		"KUBESTATE_ALERT_STATE="+t.State,
+		"KUBESTATE_ALERT_RULE="+t.Rule,
+		"KUBESTATE_ALERT_SERIES="+t.Series,
+		"KUBESTATE_ALERT_VALUE="+strconv.FormatFloat(t.Value, 'g', -1, 64),
+		"KUBESTATE_ALERT_TIME="+t.Time,
+	)
+	hook.Stdout = os.Stderr
+	hook.Stderr = os.Stderr
+	hook.WaitDelay = time.Second
+
+	err := hook.Run()
+	if errors.Is(ctx.Err(), context.DeadlineExceeded) {
+		return fmt.Errorf("timed out after %s", alertHookTimeout)
+	}
+	return err
+}
@@ -0,0 +1,150 @@
+package cmd
+
+import (
+	"bytes"
+	"context"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	dto "github.com/prometheus/client_model/go"
+)
+
+const testAlertRules = `
+command: ["notify", "--channel", "ops"]
+rules:
+  - name: deployment-unavailable
+    metric: kube_deployment_status_replicas_unavailable
+    matchers:
+      - deployment=~"api|worker"
+    comparator: ">"
+    threshold: 0
+    for: 2m
+  - name: job-failed
+    metric: kube_job_status_failed
+    comparator: ">="
+    threshold: 1
+    command: ["page"]
+`
+
+func writeAlertRules(t *testing.T, content string) string {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "rules.yaml")
+	if err := os.WriteFile(path, []byte(content), 0o600); err != nil {
+		t.Fatalf("failed writing rules: %v", err)
+	}
+	return path
+}
+
+func TestLoadAlertRules(t *testing.T) {
+	rules, err := loadAlertRules(writeAlertRules(t, testAlertRules))
+	if err != nil {
+		t.Fatalf("loadAlertRules returned error: %v", err)
+	}
+	if len(rules.Rules) != 2 {
+		t.Fatalf("expected 2 rules, got %d", len(rules.Rules))
+	}
+	if r := rules.Rules[0]; r.forDuration != 2*time.Minute || len(r.cond.matchers) != 1 || strings.Join(r.Command, " ") != "notify --channel ops" {
+		t.Fatalf("unexpected first rule %+v", r)
+	}
+	if r := rules.Rules[1]; r.forDuration != 0 || strings.Join(r.Command, " ") != "page" {
+		t.Fatalf("unexpected second rule %+v", r)
+	}
+
+	invalid := []string{
+		"rules: []",
+		"rules:\n  - metric: kube_pod_info\n    comparator: '>'\n",
+		"rules:\n  - name: a\n    metric: kube_pod_info\n    comparator: '=>'\n",
+		"rules:\n  - name: a\n    metric: kube_pod_info\n    comparator: '>'\n    for: soon\n",
+		"rules:\n  - name: a\n    metric: kube_pod_info\n    comparator: '>'\n    treshold: 1\n",
+	}
+	for _, content := range invalid {
+		if _, err := loadAlertRules(writeAlertRules(t, content)); err == nil {
+			t.Fatalf("expected error for rules %q", content)
+		}
+	}
+}
+
+func TestAlertEvaluatorTransitions(t *testing.T) {
+	rules, err := loadAlertRules(writeAlertRules(t, testAlertRules))
+	if err != nil {
+		t.Fatalf("loadAlertRules returned error: %v", err)
+	}
+	e := newAlertEvaluator(rules)
+
+	families := func(unavailable float64) []*dto.MetricFamily {
+		return []*dto.MetricFamily{
+			newMetricFamily("kube_deployment_status_replicas_unavailable", []*dto.Metric{
+				newGaugeMetric(unavailable, map[string]string{"namespace": "default", "deployment": "api"}),
+				newGaugeMetric(3, map[string]string{"namespace": "default", "deployment": "batch"}),
+			}),
+		}
+	}
+
+	start := time.Date(2018, 9, 20, 17, 0, 0, 0, time.UTC)
+	if got := e.evaluate(families(1), "*", start); len(got) != 0 {
+		t.Fatalf("expected pending alert to wait for its for-duration, got %d transitions", len(got))
+	}
+	if got := e.evaluate(families(1), "*", start.Add(time.Minute)); len(got) != 0 {
+		t.Fatalf("expected alert still pending after 1m, got %d transitions", len(got))
+	}
+
+	got := e.evaluate(families(1), "*", start.Add(2*time.Minute))
+	if len(got) != 1 || got[0].State != "firing" || got[0].Rule != "deployment-unavailable" || got[0].Labels["deployment"] != "api" {
+		t.Fatalf("expected api alert to fire, got %+v", got)
+	}
+	if got := e.evaluate(families(1), "*", start.Add(3*time.Minute)); len(got) != 0 {
+		t.Fatalf("expected no repeat transition while firing, got %d", len(got))
+	}
+
+	got = e.evaluate(families(0), "*", start.Add(4*time.Minute))
+	if len(got) != 1 || got[0].State != "resolved" || got[0].Value != 1 {
+		t.Fatalf("expected api alert to resolve, got %+v", got)
+	}
+
+	var hooks []string
+	original := runAlertHookFn
+	runAlertHookFn = func(_ context.Context, command []string, tr *alertTransition) error {
+		hooks = append(hooks, command[0]+" "+tr.State)
+		return nil
+	}
+	defer func() { runAlertHookFn = original }()
+
+	var out, errOut bytes.Buffer
+	e.reportAlertTransitions(context.Background(), &out, &errOut, got)
+	if !strings.Contains(out.String(), "RESOLVED\tdeployment-unavailable") {
+		t.Fatalf("unexpected transition output %q", out.String())
+	}
+	if len(hooks) != 1 || hooks[0] != "notify resolved" {
+		t.Fatalf("expected notify hook to run once, got %v", hooks)
+	}
+}
+
+func TestRunAlertHookTimesOut(t *testing.T) {
+	original := alertHookTimeout
+	alertHookTimeout = 50 * time.Millisecond
+	defer func() { alertHookTimeout = original }()
+
+	transition := &alertTransition{State: "firing", Rule: "r", Series: "m{}", Value: 1}
+
+	start := time.Now()
+	err := runAlertHook(context.Background(), []string{"sleep", "5"}, transition)
+	if err == nil || !strings.Contains(err.Error(), "timed out") {
+		t.Fatalf("expected a hung hook to time out, got %v", err)
+	}
+	if elapsed := time.Since(start); elapsed > 2*time.Second {
+		t.Fatalf("expected the hook to be killed at the timeout, took %v", elapsed)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if err := runAlertHook(ctx, []string{"sleep", "5"}, transition); err == nil {
+		t.Fatal("expected an interrupted watch to stop the hook")
+	}
+
+	if err := runAlertHook(context.Background(), []string{"true"}, transition); err != nil {
+		t.Fatalf("expected a quick hook to succeed, got %v", err)
+	}
+}
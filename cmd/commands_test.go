@@ -1,19 +1,26 @@
 package cmd
 
 import (
+	"bytes"
+	"context"
+	"encoding/json"
 	"errors"
 	"flag"
 	"io"
 	"os"
+	"path/filepath"
 	"strings"
 	"testing"
+	"time"
 
 	dto "github.com/prometheus/client_model/go"
 	"github.com/urfave/cli/v2"
+
+	"github.com/paulwelch/kubestate/pkg/kubestate"
 )
 
 func TestGetCommandPositionalMetricRaw(t *testing.T) {
-	restore := stubRawMetrics(t, func(string, string, bool) (string, error) {
+	restore := stubRawMetrics(t, func(context.Context, kubestate.Options) (string, error) {
 		return "" +
 			`kube_target_metric{namespace="kube-system",pod="p1"} 1` + "\n" +
 			`kube_other_metric{namespace="kube-system",pod="p2"} 1` + "\n", nil
@@ -47,7 +54,7 @@ func TestGetCommandPositionalMetricRaw(t *testing.T) {
 }
 
 func TestListCommand(t *testing.T) {
-	restore := stubRawMetrics(t, func(string, string, bool) (string, error) {
+	restore := stubRawMetrics(t, func(context.Context, kubestate.Options) (string, error) {
 		return "" +
 			"# HELP kube_second second metric\n" +
 			"# TYPE kube_second counter\n" +
@@ -79,7 +86,7 @@ func TestListCommand(t *testing.T) {
 }
 
 func TestTopCommands(t *testing.T) {
-	restore := stubMetrics(t, func(string, string, bool) ([]*dto.MetricFamily, error) {
+	restore := stubMetrics(t, func(context.Context, kubestate.Options) ([]*dto.MetricFamily, error) {
 		return sampleTopMetricFamilies(), nil
 	})
 	defer restore()
@@ -136,9 +143,135 @@ func TestTopCommands(t *testing.T) {
 	}
 }
 
+func TestSummaryCommand(t *testing.T) {
+	restore := stubMetrics(t, func(context.Context, kubestate.Options) ([]*dto.MetricFamily, error) {
+		families := sampleTopMetricFamilies()
+		families = append(families,
+			newMetricFamily("kube_node_status_condition", []*dto.Metric{
+				newGaugeMetric(1, map[string]string{"node": "node1", "condition": "Ready", "status": "true"}),
+				newGaugeMetric(0, map[string]string{"node": "node1", "condition": "Ready", "status": "false"}),
+			}),
+			newMetricFamily("kube_pod_status_phase", []*dto.Metric{
+				newGaugeMetric(1, map[string]string{"namespace": "kube-system", "pod": "metrics-server-abc", "phase": "Running"}),
+				newGaugeMetric(0, map[string]string{"namespace": "kube-system", "pod": "metrics-server-abc", "phase": "Pending"}),
+				newGaugeMetric(1, map[string]string{"namespace": "default", "pod": "web-xyz", "phase": "Pending"}),
+			}),
+			newMetricFamily("kube_persistentvolumeclaim_status_phase", []*dto.Metric{
+				newGaugeMetric(1, map[string]string{"namespace": "default", "persistentvolumeclaim": "data", "phase": "Pending"}),
+			}),
+			newMetricFamily("kube_job_status_failed", []*dto.Metric{
+				newGaugeMetric(2, map[string]string{"namespace": "default", "job_name": "migrate"}),
+			}),
+		)
+		return families, nil
+	})
+	defer restore()
+
+	ctx := newTestContext(t, testContextOptions{
+		stringFlags: map[string]string{
+			"config":            "",
+			"namespace":         "*",
+			"metrics-namespace": "",
+		},
+		boolFlags: map[string]bool{
+			"insecure-skip-tls-verify": false,
+		},
+	})
+
+	out, err := captureStdout(func() error { return Summary(ctx) })
+	if err != nil {
+		t.Fatalf("Summary returned error: %v", err)
+	}
+	for _, want := range []string{
+		"1 (Ready 1 / NotReady 0)",
+		"(8000m / 7500m / 100m)",
+		"Running 1 / Pending 1",
+		"0 of 1",
+		"default/data",
+		"default/migrate",
+		"node1",
+	} {
+		if !strings.Contains(out, want) {
+			t.Fatalf("expected summary to contain %q, got %q", want, out)
+		}
+	}
+}
+
+func TestReportCommand(t *testing.T) {
+	restore := stubMetrics(t, func(context.Context, kubestate.Options) ([]*dto.MetricFamily, error) {
+		families := sampleTopMetricFamilies()
+		families = append(families, newMetricFamily("kube_job_status_failed", []*dto.Metric{
+			newGaugeMetric(1, map[string]string{"namespace": "default", "job_name": "migrate"}),
+		}))
+		return families, nil
+	})
+	defer restore()
+
+	newReportContext := func(format, output string, charts bool) *cli.Context {
+		return newTestContext(t, testContextOptions{
+			stringFlags: map[string]string{
+				"config":            "",
+				"namespace":         "*",
+				"metrics-namespace": "",
+				"format":            format,
+				"output":            output,
+			},
+			boolFlags: map[string]bool{
+				"insecure-skip-tls-verify": false,
+				"charts":                   charts,
+			},
+			intFlags: map[string]int{"top": 10},
+		})
+	}
+
+	out, err := captureStdout(func() error { return Report(newReportContext("markdown", "", false)) })
+	if err != nil {
+		t.Fatalf("Report returned error: %v", err)
+	}
+	for _, want := range []string{
+		"# kubestate report",
+		"| Nodes | 1 (Ready 0 / NotReady 1) |",
+		"| node1 | 100m / 200m / 8000m | 100Mi / 200Mi / 16384Mi |",
+		"| kube-system | 100m | 100% | 100Mi | 100% |",
+		"| kube-system | metrics-server-abc | metrics-server | node1 |",
+		"| Job | default | migrate | failed pods |",
+	} {
+		if !strings.Contains(out, want) {
+			t.Fatalf("expected markdown report to contain %q, got:\n%s", want, out)
+		}
+	}
+	if strings.Contains(out, "data:image/svg+xml") {
+		t.Fatalf("expected no charts without --charts:\n%s", out)
+	}
+
+	path := filepath.Join(t.TempDir(), "report.html")
+	if err := Report(newReportContext("html", path, true)); err != nil {
+		t.Fatalf("Report returned error: %v", err)
+	}
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatalf("reading report: %v", err)
+	}
+	for _, want := range []string{
+		"<h2>Nodes</h2>\n<svg ",
+		"<text x=\"0\" y=\"44\">node1</text>",
+		"<td>metrics-server-abc</td>",
+		"<td>Job</td><td>default</td><td>migrate</td>",
+	} {
+		if !strings.Contains(string(data), want) {
+			t.Fatalf("expected html report to contain %q, got:\n%s", want, data)
+		}
+	}
+
+	err = Report(newReportContext("pdf", "", false))
+	if exitErr, ok := err.(cli.ExitCoder); !ok || exitErr.ExitCode() != 2 {
+		t.Fatalf("expected exit code 2 for invalid format, got %v", err)
+	}
+}
+
 func TestWatchCommandRunsExecuteGet(t *testing.T) {
 	sentinelErr := errors.New("watch stop")
-	restore := stubExecuteGet(t, func(string, string, string, string, string, bool) error {
+	restore := stubExecuteGet(t, func(context.Context, kubestate.Options, string, string, string) error {
 		return sentinelErr
 	})
 	defer restore()
@@ -165,6 +298,505 @@ func TestWatchCommandRunsExecuteGet(t *testing.T) {
 	}
 }
 
+func TestWatchTopNodesHighlightsChangedRows(t *testing.T) {
+	sentinelErr := errors.New("watch stop")
+	calls := 0
+	restore := stubMetrics(t, func(context.Context, kubestate.Options) ([]*dto.MetricFamily, error) {
+		calls++
+		switch calls {
+		case 1:
+			return sampleTopMetricFamilies(), nil
+		case 2:
+			families := sampleTopMetricFamilies()
+			families[0].Metric[0].Gauge.Value = func(v float64) *float64 { return &v }(1.5)
+			return families, nil
+		}
+		return nil, sentinelErr
+	})
+	defer restore()
+
+	ctx := newTestContext(t, testContextOptions{
+		stringFlags: map[string]string{
+			"config":            "",
+			"output":            "json",
+			"metric":            "*",
+			"namespace":         "*",
+			"metrics-namespace": "",
+		},
+		intFlags: map[string]int{
+			"interval": 1,
+		},
+		boolFlags: map[string]bool{
+			"insecure-skip-tls-verify": false,
+		},
+		commandName: "nodes",
+	})
+
+	out, err := captureStdout(func() error { return Watch(ctx) })
+	if !errors.Is(err, sentinelErr) {
+		t.Fatalf("Watch() error = %v, want %v", err, sentinelErr)
+	}
+	if !strings.Contains(out, "kubestate watch nodes") {
+		t.Fatalf("expected watch title for nodes view, got %q", out)
+	}
+	if strings.Count(out, "\x1b[7m") != 1 || !strings.Contains(out, "\x1b[7mnode1") {
+		t.Fatalf("expected only the changed node1 row to be highlighted, got %q", out)
+	}
+}
+
+func TestWatchChangesStreamsSeriesEvents(t *testing.T) {
+	sentinelErr := errors.New("watch stop")
+	calls := 0
+	restore := stubMetrics(t, func(context.Context, kubestate.Options) ([]*dto.MetricFamily, error) {
+		calls++
+		switch calls {
+		case 1:
+			return sampleTopMetricFamilies(), nil
+		case 2:
+			families := sampleTopMetricFamilies()
+			families[4].Metric[0].Gauge.Value = func(v float64) *float64 { return &v }(3)
+			families[6].Metric = nil
+			return families, nil
+		}
+		return nil, sentinelErr
+	})
+	defer restore()
+
+	ctx := newTestContext(t, testContextOptions{
+		stringFlags: map[string]string{
+			"config":            "",
+			"output":            "json",
+			"metric":            "*",
+			"namespace":         "kube-system",
+			"metrics-namespace": "",
+		},
+		intFlags: map[string]int{
+			"interval": 1,
+		},
+		boolFlags: map[string]bool{
+			"insecure-skip-tls-verify": false,
+			"changes":                  true,
+		},
+	})
+
+	out, err := captureStdout(func() error { return Watch(ctx) })
+	if !errors.Is(err, sentinelErr) {
+		t.Fatalf("Watch() error = %v, want %v", err, sentinelErr)
+	}
+
+	lines := strings.Split(strings.TrimSpace(out), "\n")
+	// 7 initial kube-system series, then one changed and one removed
+	if len(lines) != 9 {
+		t.Fatalf("expected 9 events, got %d: %q", len(lines), out)
+	}
+	counts := map[string]int{}
+	for _, line := range lines {
+		var e seriesEvent
+		if err := json.Unmarshal([]byte(line), &e); err != nil {
+			t.Fatalf("invalid event %q: %v", line, err)
+		}
+		counts[e.Event]++
+		if e.Event == "changed" && (e.Metric != "kube_deployment_spec_replicas" || *e.Value != 3 || *e.Previous != 2) {
+			t.Fatalf("unexpected changed event %q", line)
+		}
+		if e.Event == "removed" && e.Metric != "kube_deployment_status_replicas_unavailable" {
+			t.Fatalf("unexpected removed event %q", line)
+		}
+	}
+	if counts["added"] != 7 || counts["changed"] != 1 || counts["removed"] != 1 {
+		t.Fatalf("unexpected event counts %v", counts)
+	}
+}
+
+func TestTopRestartsCountsRestartsInWindow(t *testing.T) {
+	restartFamilies := func(api, worker, cache float64) []*dto.MetricFamily {
+		mf := newMetricFamily("kube_pod_container_status_restarts_total", []*dto.Metric{
+			newGaugeMetric(api, map[string]string{"namespace": "default", "pod": "api-1", "container": "api"}),
+			newGaugeMetric(worker, map[string]string{"namespace": "default", "pod": "worker-1", "container": "worker"}),
+			newGaugeMetric(cache, map[string]string{"namespace": "default", "pod": "cache-1", "container": "cache"}),
+		})
+		counter := dto.MetricType_COUNTER
+		mf.Type = &counter
+		return []*dto.MetricFamily{mf}
+	}
+
+	calls := 0
+	restore := stubMetrics(t, func(context.Context, kubestate.Options) ([]*dto.MetricFamily, error) {
+		calls++
+		if calls == 1 {
+			return restartFamilies(10, 2, 5), nil
+		}
+		// worker restarted twice; cache's counter was reset, so its current value is the restarts since
+		return restartFamilies(11, 4, 3), nil
+	})
+	defer restore()
+
+	var slept time.Duration
+	originalSleep := sleepFn
+	sleepFn = func(_ context.Context, d time.Duration) error {
+		slept = d
+		return nil
+	}
+	defer func() { sleepFn = originalSleep }()
+
+	ctx := newTestContext(t, testContextOptions{
+		stringFlags: map[string]string{
+			"config":            "",
+			"namespace":         "*",
+			"metrics-namespace": "",
+		},
+		boolFlags: map[string]bool{
+			"insecure-skip-tls-verify": false,
+		},
+		durationFlags: map[string]time.Duration{
+			"window": 5 * time.Minute,
+		},
+	})
+
+	out, err := captureStdout(func() error { return TopRestarts(ctx) })
+	if err != nil {
+		t.Fatalf("TopRestarts returned error: %v", err)
+	}
+	if slept != 5*time.Minute {
+		t.Fatalf("expected to sample over 5m window, slept %v", slept)
+	}
+
+	lines := strings.Split(strings.TrimSpace(out), "\n")
+	if len(lines) != 4 || !strings.Contains(lines[0], "Restarts (5m0s)") {
+		t.Fatalf("unexpected output %q", out)
+	}
+	if f := strings.Fields(lines[1]); f[1] != "cache-1" || f[3] != "3" || f[4] != "3" {
+		t.Fatalf("expected reset cache-1 with 3 restarts first, got %q", lines[1])
+	}
+	if f := strings.Fields(lines[2]); f[1] != "worker-1" || f[3] != "2" || f[4] != "4" {
+		t.Fatalf("expected worker-1 with 2 restarts second, got %q", lines[2])
+	}
+	if f := strings.Fields(lines[3]); f[1] != "api-1" || f[3] != "1" || f[4] != "11" {
+		t.Fatalf("expected api-1 with 1 restart third, got %q", lines[3])
+	}
+}
+
+func TestSleepContextEndsWithContext(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+
+	start := time.Now()
+	if err := sleepContext(ctx, time.Hour); !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("expected the context error, got %v", err)
+	}
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Fatalf("expected the sleep to end with the context, took %v", elapsed)
+	}
+	if err := sleepContext(context.Background(), time.Millisecond); err != nil {
+		t.Fatalf("expected a completed sleep, got %v", err)
+	}
+}
+
+func TestSeriesRatesHandlesCounterResets(t *testing.T) {
+	previous := seriesSnapshot{
+		"a": {metric: "a", value: 10, counter: true},
+		"b": {metric: "b", value: 5, counter: true},
+		"g": {metric: "g", value: 7},
+	}
+	current := seriesSnapshot{
+		"a": {metric: "a", value: 40, counter: true},
+		"b": {metric: "b", value: 2, counter: true},
+		"g": {metric: "g", value: 3},
+		"n": {metric: "n", value: 1, counter: true},
+	}
+
+	rates := seriesRates(previous, current, true)
+	if len(rates) != 2 || rates[0].id != "a" || rates[0].delta != 30 || rates[1].id != "b" || rates[1].delta != 2 {
+		t.Fatalf("unexpected counter rates %+v %+v", rates[0], rates[1])
+	}
+
+	var buf strings.Builder
+	renderSeriesRates(&buf, rates, 10*time.Second)
+	if !strings.Contains(buf.String(), "3.000") {
+		t.Fatalf("expected 3/s rate for a, got %q", buf.String())
+	}
+
+	if rates := seriesRates(previous, current, false); len(rates) != 3 || rates[2].id != "g" || rates[2].delta != -4 {
+		t.Fatalf("expected gauge delta when not limited to counters, got %d rates", len(rates))
+	}
+}
+
+func TestWaitCommand(t *testing.T) {
+	restore := stubMetrics(t, func(context.Context, kubestate.Options) ([]*dto.MetricFamily, error) {
+		return sampleTopMetricFamilies(), nil
+	})
+	defer restore()
+
+	newWaitContext := func(expr string, timeout time.Duration) *cli.Context {
+		return newTestContext(t, testContextOptions{
+			stringFlags: map[string]string{
+				"config":            "",
+				"for":               expr,
+				"namespace":         "*",
+				"metrics-namespace": "",
+			},
+			intFlags: map[string]int{
+				"interval": 1,
+			},
+			boolFlags: map[string]bool{
+				"insecure-skip-tls-verify": false,
+			},
+			durationFlags: map[string]time.Duration{
+				"timeout": timeout,
+			},
+		})
+	}
+
+	out, err := captureStdout(func() error {
+		return Wait(newWaitContext(`kube_deployment_status_replicas_unavailable{deployment="metrics-server"} == 0`, time.Minute))
+	})
+	if err != nil {
+		t.Fatalf("Wait returned error: %v", err)
+	}
+	if !strings.Contains(out, "condition met") {
+		t.Fatalf("expected condition met output, got %q", out)
+	}
+
+	err = Wait(newWaitContext(`kube_deployment_status_replicas_unavailable{deployment="metrics-server"} > 0`, 10*time.Millisecond))
+	exitErr, ok := err.(cli.ExitCoder)
+	if !ok || exitErr.ExitCode() != 1 || !strings.Contains(err.Error(), "timed out") {
+		t.Fatalf("expected timeout exit code 1, got %v", err)
+	}
+
+	err = Wait(newWaitContext(`kube_deployment_status_replicas_unavailable ==`, time.Minute))
+	if exitErr, ok := err.(cli.ExitCoder); !ok || exitErr.ExitCode() != 2 {
+		t.Fatalf("expected invalid expression exit code 2, got %v", err)
+	}
+}
+
+func TestWaitRetriesFailedFetches(t *testing.T) {
+	fetches := 0
+	restore := stubMetrics(t, func(context.Context, kubestate.Options) ([]*dto.MetricFamily, error) {
+		fetches++
+		if fetches == 1 {
+			return nil, errors.New("kube-state-metrics is restarting")
+		}
+		return sampleTopMetricFamilies(), nil
+	})
+	defer restore()
+
+	newWaitContext := func(timeout time.Duration) *cli.Context {
+		return newTestContext(t, testContextOptions{
+			stringFlags:   map[string]string{"config": "", "for": `kube_deployment_status_replicas_unavailable{deployment="metrics-server"} == 0`, "namespace": "*", "metrics-namespace": ""},
+			intFlags:      map[string]int{"interval": 1},
+			boolFlags:     map[string]bool{"insecure-skip-tls-verify": false},
+			durationFlags: map[string]time.Duration{"timeout": timeout},
+		})
+	}
+
+	out, err := captureStdout(func() error { return Wait(newWaitContext(time.Minute)) })
+	if err != nil {
+		t.Fatalf("expected the wait to survive a failed fetch, got %v", err)
+	}
+	if fetches != 2 || !strings.Contains(out, "condition met") {
+		t.Fatalf("expected the condition to be met on the second fetch, got %d fetches and %q", fetches, out)
+	}
+
+	fetches = 0
+	restore = stubMetrics(t, func(context.Context, kubestate.Options) ([]*dto.MetricFamily, error) {
+		fetches++
+		return nil, errors.New("kube-state-metrics is restarting")
+	})
+	defer restore()
+
+	err = Wait(newWaitContext(10 * time.Millisecond))
+	if exitErr, ok := err.(cli.ExitCoder); !ok || exitErr.ExitCode() != 1 || !strings.Contains(err.Error(), "timed out") || !strings.Contains(err.Error(), "restarting") {
+		t.Fatalf("expected a timeout reporting the last error, got %v", err)
+	}
+}
+
+func TestWaitAbortsInFlightFetchOnTimeout(t *testing.T) {
+	restore := stubMetrics(t, func(ctx context.Context, _ kubestate.Options) ([]*dto.MetricFamily, error) {
+		// a hung API server: only the context ends the request
+		<-ctx.Done()
+		return nil, ctx.Err()
+	})
+	defer restore()
+
+	ctx := newTestContext(t, testContextOptions{
+		stringFlags:   map[string]string{"config": "", "for": "kube_pod_info == 1", "namespace": "*", "metrics-namespace": ""},
+		intFlags:      map[string]int{"interval": 1},
+		boolFlags:     map[string]bool{"insecure-skip-tls-verify": false},
+		durationFlags: map[string]time.Duration{"timeout": 20 * time.Millisecond},
+	})
+
+	start := time.Now()
+	err := Wait(ctx)
+	if exitErr, ok := err.(cli.ExitCoder); !ok || exitErr.ExitCode() != 1 || !strings.Contains(err.Error(), "timed out") {
+		t.Fatalf("expected timeout exit code 1, got %v", err)
+	}
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Fatalf("expected the hung fetch to be aborted at the timeout, took %v", elapsed)
+	}
+}
+
+func TestWatchRejectsConflictingModes(t *testing.T) {
+	restore := stubMetrics(t, func(context.Context, kubestate.Options) ([]*dto.MetricFamily, error) {
+		t.Fatal("expected no scrape for conflicting flags")
+		return nil, nil
+	})
+	defer restore()
+
+	rules := writeAlertRules(t, testAlertRules)
+	for _, tc := range []struct {
+		alerts        string
+		changes, rate bool
+		command, want string
+	}{
+		{alerts: rules, changes: true, want: "--alerts and --changes cannot be combined"},
+		{alerts: rules, rate: true, want: "--alerts and --rate cannot be combined"},
+		{changes: true, rate: true, want: "--changes and --rate cannot be combined"},
+		{rate: true, command: "nodes", want: "--rate cannot be combined with watching nodes"},
+		{changes: true, command: "summary", want: "--changes cannot be combined with watching summary"},
+	} {
+		ctx := newTestContext(t, testContextOptions{
+			stringFlags: map[string]string{"config": "", "namespace": "*", "metrics-namespace": "", "output": "json", "metric": "*", "alerts": tc.alerts},
+			intFlags:    map[string]int{"interval": 1},
+			boolFlags:   map[string]bool{"insecure-skip-tls-verify": false, "changes": tc.changes, "rate": tc.rate},
+			commandName: tc.command,
+		})
+
+		err := Watch(ctx)
+		if exitErr, ok := err.(cli.ExitCoder); !ok || exitErr.ExitCode() != 2 || err.Error() != tc.want {
+			t.Fatalf("expected exit code 2 with %q, got %v", tc.want, err)
+		}
+	}
+}
+
+func TestWatchStopsCleanlyWhenInterruptedMidFetch(t *testing.T) {
+	started := make(chan struct{})
+	restore := stubMetrics(t, func(ctx context.Context, _ kubestate.Options) ([]*dto.MetricFamily, error) {
+		close(started)
+		<-ctx.Done()
+		return nil, ctx.Err()
+	})
+	defer restore()
+
+	parent, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	ctx := newTestContext(t, testContextOptions{
+		stringFlags: map[string]string{"config": "", "namespace": "*", "metrics-namespace": "", "output": "json", "metric": "*"},
+		intFlags:    map[string]int{"interval": 1},
+		boolFlags:   map[string]bool{"insecure-skip-tls-verify": false},
+		commandName: "nodes",
+		context:     parent,
+	})
+
+	go func() {
+		<-started
+		cancel()
+	}()
+
+	if _, err := captureStdout(func() error { return Watch(ctx) }); err != nil {
+		t.Fatalf("expected interrupt to stop watch without error, got %v", err)
+	}
+}
+
+func TestWatchAlertsSurvivesFailedFetches(t *testing.T) {
+	parent, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	fetches := 0
+	restore := stubMetrics(t, func(context.Context, kubestate.Options) ([]*dto.MetricFamily, error) {
+		fetches++
+		if fetches == 1 {
+			return nil, errors.New("the API server is unavailable")
+		}
+		cancel()
+		return sampleTopMetricFamilies(), nil
+	})
+	defer restore()
+
+	ctx := newTestContext(t, testContextOptions{
+		stringFlags: map[string]string{
+			"config":            "",
+			"namespace":         "*",
+			"metrics-namespace": "",
+			"output":            "json",
+			"metric":            "*",
+			"alerts":            writeAlertRules(t, testAlertRules),
+		},
+		intFlags:  map[string]int{"interval": 1},
+		boolFlags: map[string]bool{"insecure-skip-tls-verify": false},
+		context:   parent,
+	})
+
+	if _, err := captureStdout(func() error { return Watch(ctx) }); err != nil {
+		t.Fatalf("expected the alert watch to survive a failed fetch, got %v", err)
+	}
+	if fetches != 2 {
+		t.Fatalf("expected the watch to retry after the failed fetch, got %d fetches", fetches)
+	}
+}
+
+func TestDoctorCommand(t *testing.T) {
+	diagnosis := &kubestate.Diagnosis{Checks: []kubestate.Check{
+		{Name: "config", Status: kubestate.CheckOK, Detail: "API server https://10.0.0.1"},
+		{Name: "permissions", Status: kubestate.CheckFail, Detail: "not allowed to list services in all namespaces"},
+		{Name: "service", Status: kubestate.CheckSkipped},
+	}}
+	original := diagnoseFn
+	diagnoseFn = func(_ context.Context, opts kubestate.Options) *kubestate.Diagnosis {
+		if opts.MetricsNamespace != "monitoring" {
+			t.Fatalf("expected connection flags to be passed through, got %+v", opts)
+		}
+		return diagnosis
+	}
+	defer func() { diagnoseFn = original }()
+
+	ctx := newTestContext(t, testContextOptions{
+		stringFlags: map[string]string{"config": "", "metrics-namespace": "monitoring"},
+	})
+	out, err := captureStdout(func() error { return Doctor(ctx) })
+	if exitErr, ok := err.(cli.ExitCoder); !ok || exitErr.ExitCode() != 1 {
+		t.Fatalf("expected exit code 1 for a failed check, got %v", err)
+	}
+	for _, want := range []string{"Check", "permissions fail    not allowed to list services in all namespaces", "service     skipped"} {
+		if !strings.Contains(out, want) {
+			t.Fatalf("expected doctor output to contain %q, got:\n%s", want, out)
+		}
+	}
+
+	diagnosis.Checks = diagnosis.Checks[:1]
+	if _, err := captureStdout(func() error { return Doctor(ctx) }); err != nil {
+		t.Fatalf("expected a passing diagnosis to succeed, got %v", err)
+	}
+}
+
+func TestPrintStats(t *testing.T) {
+	var buf bytes.Buffer
+	printStats(&buf, kubestate.TransferStats{Scrapes: 2, Cached: 1, Transferred: 2048, Decoded: 16384, Encoding: kubestate.EncodingGzip, DecodeTime: 12 * time.Millisecond, Series: 40})
+
+	want := "Scrapes Cached Transferred Encoding Decoded Decode Time Series\n" +
+		"2       1      2048        gzip     16384   12ms        40\n"
+	if got := buf.String(); got != want {
+		t.Fatalf("printStats =\n%s\nwant\n%s", got, want)
+	}
+
+	ctx := newTestContext(t, testContextOptions{boolFlags: map[string]bool{"stats": false}})
+	if err := PrintStats(ctx); err != nil {
+		t.Fatalf("PrintStats returned error: %v", err)
+	}
+}
+
+func TestClientOptionsReadsConnectionFlags(t *testing.T) {
+	ctx := newTestContext(t, testContextOptions{
+		stringFlags:   map[string]string{"config": "/tmp/kubeconfig", "metrics-namespace": "monitoring", "metrics-service": "prometheus-kube-state-metrics", "metrics-port": "http-metrics", "metrics-scheme": "https", "metrics-url": "", "prometheus-url": "https://thanos.example.com", "prometheus-mode": "federate", "prometheus-selector": `cluster="prod"`},
+		boolFlags:     map[string]bool{"insecure-skip-tls-verify": true, "sharded": true},
+		durationFlags: map[string]time.Duration{"request-timeout": 15 * time.Second, "cache-ttl": 30 * time.Second},
+	})
+
+	want := kubestate.Options{Kubeconfig: "/tmp/kubeconfig", MetricsNamespace: "monitoring", MetricsService: "prometheus-kube-state-metrics", MetricsPort: "http-metrics", InsecureSkipTLSVerify: true, RequestTimeout: 15 * time.Second, Sharded: true, MetricsScheme: "https", PrometheusURL: "https://thanos.example.com", PrometheusMode: "federate", PrometheusSelector: `cluster="prod"`, CacheTTL: 30 * time.Second}
+	if got := clientOptions(ctx); got != want {
+		t.Fatalf("clientOptions = %+v, want %+v", got, want)
+	}
+}
+
 func newTestContext(t *testing.T, opts testContextOptions) *cli.Context {
 	t.Helper()
 
@@ -178,11 +810,17 @@ func newTestContext(t *testing.T, opts testContextOptions) *cli.Context {
 	for name, value := range opts.intFlags {
 		fs.Int(name, value, "")
 	}
+	for name, value := range opts.durationFlags {
+		fs.Duration(name, value, "")
+	}
 	if err := fs.Parse(opts.args); err != nil {
 		t.Fatalf("failed parsing args: %v", err)
 	}
 
 	ctx := cli.NewContext(nil, fs, nil)
+	if opts.context != nil {
+		ctx.Context = opts.context
+	}
 	if opts.commandName != "" {
 		ctx.Command = &cli.Command{Name: opts.commandName}
 	}
@@ -191,11 +829,13 @@ func newTestContext(t *testing.T, opts testContextOptions) *cli.Context {
 }
 
 type testContextOptions struct {
-	stringFlags map[string]string
-	boolFlags   map[string]bool
-	intFlags    map[string]int
-	args        []string
-	commandName string
+	stringFlags   map[string]string
+	boolFlags     map[string]bool
+	intFlags      map[string]int
+	durationFlags map[string]time.Duration
+	args          []string
+	commandName   string
+	context       context.Context
 }
 
 func captureStdout(fn func() error) (string, error) {
@@ -219,7 +859,7 @@ func captureStdout(fn func() error) (string, error) {
 	return string(data), runErr
 }
 
-func stubRawMetrics(t *testing.T, fn func(string, string, bool) (string, error)) func() {
+func stubRawMetrics(t *testing.T, fn func(context.Context, kubestate.Options) (string, error)) func() {
 	t.Helper()
 	original := getRawMetricsFn
 	getRawMetricsFn = fn
@@ -228,16 +868,23 @@ func stubRawMetrics(t *testing.T, fn func(string, string, bool) (string, error))
 	}
 }
 
-func stubMetrics(t *testing.T, fn func(string, string, bool) ([]*dto.MetricFamily, error)) func() {
+func stubMetrics(t *testing.T, fn func(context.Context, kubestate.Options) ([]*dto.MetricFamily, error)) func() {
 	t.Helper()
-	original := getMetricsFn
+	original, originalFiltered := getMetricsFn, getFilteredMetricsFn
 	getMetricsFn = fn
+	getFilteredMetricsFn = func(ctx context.Context, opts kubestate.Options, filter kubestate.Filter) ([]*dto.MetricFamily, error) {
+		metricFamilies, err := fn(ctx, opts)
+		if err != nil {
+			return nil, err
+		}
+		return filter.Apply(metricFamilies), nil
+	}
 	return func() {
-		getMetricsFn = original
+		getMetricsFn, getFilteredMetricsFn = original, originalFiltered
 	}
 }
 
-func stubExecuteGet(t *testing.T, fn func(string, string, string, string, string, bool) error) func() {
+func stubExecuteGet(t *testing.T, fn func(context.Context, kubestate.Options, string, string, string) error) func() {
 	t.Helper()
 	original := executeGetFn
 	executeGetFn = fn
@@ -0,0 +1,55 @@
+/*
+ * Copyright 2018 Paul Welch
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License"); you may not use this file except in compliance with the License. You may obtain a copy of the License at
+ *
+ * http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software distributed under the License is distributed on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the License for the specific language governing permissions and limitations under the License.
+ */
+
+package cmd
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"text/tabwriter"
+
+	"github.com/urfave/cli/v2"
+
+	"github.com/paulwelch/kubestate/pkg/kubestate"
+)
+
+var diagnoseFn = diagnose
+
+func diagnose(ctx context.Context, opts kubestate.Options) *kubestate.Diagnosis {
+	return session(opts).Diagnose(ctx)
+}
+
+func Doctor(c *cli.Context) error {
+	d := diagnoseFn(c.Context, clientOptions(c))
+	if c.Context != nil && c.Context.Err() != nil {
+		return cli.Exit("interrupted", 130)
+	}
+
+	printDiagnosis(os.Stdout, d)
+
+	if !d.OK() {
+		return cli.Exit("doctor found problems reaching kube-state-metrics", 1)
+	}
+	return nil
+}
+
+func printDiagnosis(out io.Writer, d *kubestate.Diagnosis) {
+	w := new(tabwriter.Writer)
+	w.Init(out, 4, 1, 1, ' ', 0)
+
+	fmt.Fprintf(w, "%s\t%s\t%s\n", "Check", "Status", "Detail")
+	for _, check := range d.Checks {
+		fmt.Fprintf(w, "%s\t%s\t%s\n", check.Name, check.Status, check.Detail)
+	}
+
+	w.Flush()
+}
@@ -12,18 +12,22 @@ package cmd
 
 import (
 	"bufio"
+	"context"
 	"fmt"
 	"strings"
 
 	"github.com/json-iterator/go"
 	dto "github.com/prometheus/client_model/go"
 	"github.com/urfave/cli/v2"
+
+	"github.com/paulwelch/kubestate/pkg/kubestate"
 )
 
 var (
-	getRawMetricsFn = getRawMetrics
-	getMetricsFn    = getMetrics
-	executeGetFn    = executeGet
+	getRawMetricsFn      = getRawMetrics
+	getMetricsFn         = getMetrics
+	getFilteredMetricsFn = getFilteredMetrics
+	executeGetFn         = executeGet
 )
 
 func Get(c *cli.Context) error {
@@ -33,18 +37,17 @@ func Get(c *cli.Context) error {
 	}
 
 	return executeGet(
-		c.String("config"),
+		c.Context,
+		clientOptions(c),
 		c.String("output"),
 		metricFilter,
 		c.String("namespace"),
-		c.String("metrics-namespace"),
-		c.Bool("insecure-skip-tls-verify"),
 	)
 }
 
-func executeGet(config, outputFormat, metricFilterFlag, namespaceFlag, metricsNamespace string, insecureSkipTLSVerify bool) error {
+func executeGet(ctx context.Context, opts kubestate.Options, outputFormat, metricFilterFlag, namespaceFlag string) error {
 	if outputFormat == "raw" {
-		resp, err := getRawMetricsFn(config, metricsNamespace, insecureSkipTLSVerify)
+		resp, err := getRawMetricsFn(ctx, opts)
 		if err != nil {
 			return err
 		}
@@ -62,7 +65,11 @@ func executeGet(config, outputFormat, metricFilterFlag, namespaceFlag, metricsNa
 	}
 
 	if outputFormat == "json" {
-		metricFamilies, err := getMetricsFn(config, metricsNamespace, insecureSkipTLSVerify)
+		var filter kubestate.Filter
+		if metricFilterFlag != "*" {
+			filter.Names = []string{metricFilterFlag}
+		}
+		metricFamilies, err := getFilteredMetricsFn(ctx, opts, filter)
 		if err != nil {
 			return err
 		}
@@ -1,9 +1,12 @@
 package cmd
 
 import (
+	"context"
 	"testing"
 
 	"github.com/urfave/cli/v2"
+
+	"github.com/paulwelch/kubestate/pkg/kubestate"
 )
 
 func TestShouldIncludeRawMetricLine(t *testing.T) {
@@ -85,7 +88,7 @@ kube_other{namespace="default"} 3
 }
 
 func TestExecuteGetRejectsInvalidOutput(t *testing.T) {
-	err := executeGet("", "table", "*", "*", "", false)
+	err := executeGet(context.Background(), kubestate.Options{}, "table", "*", "*")
 	if err == nil {
 		t.Fatal("expected error for invalid output")
 	}
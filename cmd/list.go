@@ -19,7 +19,7 @@ import (
 )
 
 func List(c *cli.Context) error {
-	raw, err := getRawMetricsFn(c.String("config"), c.String("metrics-namespace"), c.Bool("insecure-skip-tls-verify"))
+	raw, err := getRawMetricsFn(c.Context, clientOptions(c))
 	if err != nil {
 		return err
 	}
@@ -0,0 +1,288 @@
+/*
+ * Copyright 2018 Paul Welch
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License"); you may not use this file except in compliance with the License. You may obtain a copy of the License at
+ *
+ * http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software distributed under the License is distributed on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the License for the specific language governing permissions and limitations under the License.
+ */
+
+package cmd
+
+import (
+	"encoding/base64"
+	"fmt"
+	"html"
+	"html/template"
+	"io"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/urfave/cli/v2"
+
+	"github.com/paulwelch/kubestate/pkg/kubestate"
+)
+
+// reportData is a one-shot capacity and health report built from a single scrape.
+type reportData struct {
+	*dashboardData
+	Cluster             []reportRow
+	Pods                []*kubestate.PodResources
+	NodeLoadChart       string
+	NamespaceShareChart string
+}
+
+type reportRow struct {
+	Label, Value string
+}
+
+type chartBar struct {
+	label string
+	value float64
+}
+
+var levelColors = map[string]string{"ok": "#4caf50", "warn": "#ff9800", "high": "#f44336"}
+
+func Report(c *cli.Context) error {
+	format := c.String("format")
+	if format != "html" && format != "markdown" {
+		return cli.Exit("invalid report format; valid formats are: html, markdown", 2)
+	}
+	if c.Int("top") < 1 {
+		return cli.Exit("top must be >= 1", 2)
+	}
+
+	metricFamilies, err := getFilteredMetricsFn(c.Context, clientOptions(c), kubestate.ClusterFilter())
+	if err != nil {
+		return err
+	}
+
+	report := newReportData(kubestate.NewCluster(metricFamilies), c.String("namespace"), c.Int("top"), c.Bool("charts"), time.Now())
+
+	out := io.Writer(os.Stdout)
+	if path := c.String("output"); path != "" && path != "-" {
+		f, err := os.Create(expandHome(path))
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		out = f
+	}
+
+	if format == "html" {
+		return writeHTMLReport(out, report)
+	}
+	return writeMarkdownReport(out, report)
+}
+
+func newReportData(cluster *kubestate.Cluster, namespaceFlag string, topPods int, charts bool, now time.Time) *reportData {
+	report := &reportData{
+		dashboardData: newDashboardData(cluster, namespaceFlag, now),
+		Pods:          cluster.TopPods(namespaceFlag),
+	}
+	if len(report.Pods) > topPods {
+		report.Pods = report.Pods[:topPods]
+	}
+
+	sum := summarize(cluster, namespaceFlag)
+	phases := make([]string, 0, len(podPhases))
+	for _, phase := range podPhases {
+		phases = append(phases, fmt.Sprintf("%s %d", phase, sum.podPhases[phase]))
+	}
+	report.Cluster = []reportRow{
+		{"Nodes", fmt.Sprintf("%d (Ready %d / NotReady %d)", sum.nodes, sum.readyNodes, sum.nodes-sum.readyNodes)},
+		{"CPU (Cap / Alloc / Req)", fmt.Sprintf("%.0fm / %.0fm / %.0fm", sum.cpuCapacity*1000, sum.cpuAllocatable*1000, sum.cpuRequest*1000)},
+		{"Memory (Cap / Alloc / Req)", fmt.Sprintf("%.0fMi / %.0fMi / %.0fMi", sum.memoryCapacity/1048576, sum.memoryAllocatable/1048576, sum.memoryRequest/1048576)},
+		{"Pods", strings.Join(phases, " / ")},
+		{"Deployments", fmt.Sprintf("%d (%d unavailable)", sum.deployments, len(sum.unavailableDeployments))},
+	}
+
+	if charts {
+		nodeBars := make([]chartBar, 0, len(report.Nodes))
+		for _, v := range report.Nodes {
+			nodeBars = append(nodeBars, chartBar{v.Node, v.Load})
+		}
+		report.NodeLoadChart = svgBarChart("Node load", nodeBars)
+
+		namespaceBars := make([]chartBar, 0, len(report.Namespaces))
+		for _, v := range report.Namespaces {
+			namespaceBars = append(namespaceBars, chartBar{v.Namespace, v.CPUShare})
+		}
+		report.NamespaceShareChart = svgBarChart("Namespace cpu request share", namespaceBars)
+	}
+
+	return report
+}
+
+var reportFuncs = template.FuncMap{
+	// svgBarChart escapes every label it embeds
+	"svg": func(chart string) template.HTML {
+		return template.HTML(chart)
+	},
+}
+
+var reportTemplate = template.Must(template.New("report").Funcs(dashboardFuncs).Funcs(reportFuncs).Parse(`<!DOCTYPE html>
+<html lang="en">
+<head>
+<meta charset="utf-8">
+<title>kubestate report</title>
+<style>
+body { font-family: -apple-system, "Segoe UI", Helvetica, Arial, sans-serif; margin: 2em; color: #222; }
+h1 { font-size: 1.4em; margin-bottom: 0; }
+h2 { font-size: 1.1em; margin-top: 2em; border-bottom: 1px solid #ddd; }
+.meta { color: #777; font-size: 0.85em; }
+table { border-collapse: collapse; }
+th, td { text-align: left; padding: 0.25em 1em 0.25em 0; font-size: 0.9em; }
+td.num { text-align: right; white-space: nowrap; }
+</style>
+</head>
+<body>
+<h1>kubestate report</h1>
+<p class="meta">Namespace {{.Namespace}} &middot; generated {{.Generated}}</p>
+
+<h2>Cluster</h2>
+<table>
+{{- range .Cluster}}
+<tr><td>{{.Label}}</td><td>{{.Value}}</td></tr>
+{{- end}}
+</table>
+
+<h2>Nodes</h2>
+{{- if .NodeLoadChart}}
+{{svg .NodeLoadChart}}
+{{- end}}
+<table>
+<tr><th>Node</th><th>CPU Req / Lim / Cap</th><th>Memory Req / Lim / Cap</th><th>Load</th></tr>
+{{- range .Nodes}}
+<tr><td>{{.Node}}</td><td class="num">{{millicores .CPURequest}} / {{millicores .CPULimit}} / {{millicores .CPUCapacity}}</td><td class="num">{{mebibytes .MemoryRequest}} / {{mebibytes .MemoryLimit}} / {{mebibytes .MemoryCapacity}}</td><td class="num">{{percent .Load}}</td></tr>
+{{- end}}
+</table>
+
+<h2>Namespaces</h2>
+{{- if .NamespaceShareChart}}
+{{svg .NamespaceShareChart}}
+{{- end}}
+<table>
+<tr><th>Namespace</th><th>CPU Req</th><th>CPU Share</th><th>Memory Req</th><th>Memory Share</th></tr>
+{{- range .Namespaces}}
+<tr><td>{{.Namespace}}</td><td class="num">{{millicores .CPURequest}}</td><td class="num">{{percent .CPUShare}}</td><td class="num">{{mebibytes .MemoryRequest}}</td><td class="num">{{percent .MemoryShare}}</td></tr>
+{{- end}}
+</table>
+
+<h2>Top pods</h2>
+<table>
+<tr><th>Namespace</th><th>Pod</th><th>Container</th><th>Node</th><th>CPU Req / Lim</th><th>Memory Req / Lim</th><th>Load</th></tr>
+{{- range .Pods}}
+<tr><td>{{.Namespace}}</td><td>{{.Pod}}</td><td>{{.Container}}</td><td>{{.Node}}</td><td class="num">{{millicores .CPURequest}} / {{millicores .CPULimit}}</td><td class="num">{{mebibytes .MemoryRequest}} / {{mebibytes .MemoryLimit}}</td><td class="num">{{percent .Load}}</td></tr>
+{{- end}}
+</table>
+
+<h2>Unhealthy workloads</h2>
+{{- if .Unhealthy}}
+<table>
+<tr><th>Kind</th><th>Namespace</th><th>Name</th><th>Reason</th></tr>
+{{- range .Unhealthy}}
+<tr><td>{{.Kind}}</td><td>{{.Namespace}}</td><td>{{.Name}}</td><td>{{.Reason}}</td></tr>
+{{- end}}
+</table>
+{{- else}}
+<p>All workloads healthy</p>
+{{- end}}
+</body>
+</html>
+`))
+
+func writeHTMLReport(out io.Writer, r *reportData) error {
+	return reportTemplate.Execute(out, r)
+}
+
+func writeMarkdownReport(out io.Writer, r *reportData) error {
+	var b strings.Builder
+
+	fmt.Fprintf(&b, "# kubestate report\n\nNamespace %s, generated %s\n\n", r.Namespace, r.Generated)
+
+	b.WriteString("## Cluster\n\n| | |\n| --- | --- |\n")
+	for _, v := range r.Cluster {
+		fmt.Fprintf(&b, "| %s | %s |\n", v.Label, v.Value)
+	}
+	b.WriteString("\n## Nodes\n\n")
+	if r.NodeLoadChart != "" {
+		fmt.Fprintf(&b, "![Node load](%s)\n\n", svgDataURI(r.NodeLoadChart))
+	}
+	b.WriteString("| Node | CPU Req / Lim / Cap | Memory Req / Lim / Cap | Load |\n| --- | ---: | ---: | ---: |\n")
+	for _, v := range r.Nodes {
+		fmt.Fprintf(&b, "| %s | %.0fm / %.0fm / %.0fm | %.0fMi / %.0fMi / %.0fMi | %.0f%% |\n", markdownCell(v.Node),
+			v.CPURequest*1000, v.CPULimit*1000, v.CPUCapacity*1000,
+			v.MemoryRequest/1048576, v.MemoryLimit/1048576, v.MemoryCapacity/1048576, v.Load*100)
+	}
+
+	b.WriteString("\n## Namespaces\n\n")
+	if r.NamespaceShareChart != "" {
+		fmt.Fprintf(&b, "![Namespace cpu request share](%s)\n\n", svgDataURI(r.NamespaceShareChart))
+	}
+	b.WriteString("| Namespace | CPU Req | CPU Share | Memory Req | Memory Share |\n| --- | ---: | ---: | ---: | ---: |\n")
+	for _, v := range r.Namespaces {
+		fmt.Fprintf(&b, "| %s | %.0fm | %.0f%% | %.0fMi | %.0f%% |\n", markdownCell(v.Namespace),
+			v.CPURequest*1000, v.CPUShare*100, v.MemoryRequest/1048576, v.MemoryShare*100)
+	}
+
+	b.WriteString("\n## Top pods\n\n")
+	b.WriteString("| Namespace | Pod | Container | Node | CPU Req / Lim | Memory Req / Lim | Load |\n| --- | --- | --- | --- | ---: | ---: | ---: |\n")
+	for _, v := range r.Pods {
+		fmt.Fprintf(&b, "| %s | %s | %s | %s | %.0fm / %.0fm | %.0fMi / %.0fMi | %.0f%% |\n",
+			markdownCell(v.Namespace), markdownCell(v.Pod), markdownCell(v.Container), markdownCell(v.Node),
+			v.CPURequest*1000, v.CPULimit*1000, v.MemoryRequest/1048576, v.MemoryLimit/1048576, v.Load*100)
+	}
+
+	b.WriteString("\n## Unhealthy workloads\n\n")
+	if len(r.Unhealthy) == 0 {
+		b.WriteString("All workloads healthy\n")
+	} else {
+		b.WriteString("| Kind | Namespace | Name | Reason |\n| --- | --- | --- | --- |\n")
+		for _, v := range r.Unhealthy {
+			fmt.Fprintf(&b, "| %s | %s | %s | %s |\n", v.Kind, markdownCell(v.Namespace), markdownCell(v.Name), v.Reason)
+		}
+	}
+
+	_, err := io.WriteString(out, b.String())
+	return err
+}
+
+func markdownCell(s string) string {
+	return strings.ReplaceAll(s, "|", "\\|")
+}
+
+func svgDataURI(svg string) string {
+	return "data:image/svg+xml;base64," + base64.StdEncoding.EncodeToString([]byte(svg))
+}
+
+// svgBarChart renders a horizontal bar chart of ratios, clamped to 100%.
+func svgBarChart(title string, bars []chartBar) string {
+	const (
+		labelWidth = 220
+		barWidth   = 360
+		rowHeight  = 22
+		top        = 30
+	)
+	height := top + len(bars)*rowHeight + 10
+
+	var b strings.Builder
+	fmt.Fprintf(&b, `<svg xmlns="http://www.w3.org/2000/svg" width="%d" height="%d" font-family="sans-serif" font-size="12">`, labelWidth+barWidth+60, height)
+	fmt.Fprintf(&b, `<text x="0" y="16" font-weight="bold">%s</text>`, html.EscapeString(title))
+	for i, bar := range bars {
+		y := top + i*rowHeight
+		width := bar.value
+		if width > 1 {
+			width = 1
+		}
+		fmt.Fprintf(&b, `<text x="0" y="%d">%s</text>`, y+14, html.EscapeString(bar.label))
+		fmt.Fprintf(&b, `<rect x="%d" y="%d" width="%d" height="16" fill="#eee"/>`, labelWidth, y+2, barWidth)
+		fmt.Fprintf(&b, `<rect x="%d" y="%d" width="%.1f" height="16" fill="%s"/>`, labelWidth, y+2, width*barWidth, levelColors[loadLevel(bar.value)])
+		fmt.Fprintf(&b, `<text x="%d" y="%d">%.0f%%</text>`, labelWidth+barWidth+6, y+14, bar.value*100)
+	}
+	b.WriteString(`</svg>`)
+
+	return b.String()
+}
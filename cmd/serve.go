@@ -0,0 +1,234 @@
+/*
+ * Copyright 2018 Paul Welch
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License"); you may not use this file except in compliance with the License. You may obtain a copy of the License at
+ *
+ * http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software distributed under the License is distributed on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the License for the specific language governing permissions and limitations under the License.
+ */
+
+package cmd
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"sort"
+	"sync"
+	"time"
+
+	dto "github.com/prometheus/client_model/go"
+	"github.com/prometheus/common/expfmt"
+	"github.com/urfave/cli/v2"
+
+	"github.com/paulwelch/kubestate/pkg/kubestate"
+)
+
+// serveShutdownTimeout bounds how long in-flight requests may finish after an interrupt.
+const serveShutdownTimeout = 5 * time.Second
+
+// scrapeCache shares one kube-state-metrics scrape across requests for up to ttl.
+// A zero ttl scrapes on every request.
+type scrapeCache struct {
+	mu       sync.Mutex
+	ttl      time.Duration
+	fetch    func(ctx context.Context) ([]*dto.MetricFamily, error)
+	families []*dto.MetricFamily
+	at       time.Time
+}
+
+func (sc *scrapeCache) get(ctx context.Context) ([]*dto.MetricFamily, error) {
+	sc.mu.Lock()
+	defer sc.mu.Unlock()
+
+	if sc.families != nil && sc.ttl > 0 && time.Since(sc.at) < sc.ttl {
+		return sc.families, nil
+	}
+
+	families, err := sc.fetch(ctx)
+	if err != nil {
+		return nil, err
+	}
+	sc.families, sc.at = families, time.Now()
+
+	return families, nil
+}
+
+func Serve(c *cli.Context) error {
+	opts := clientOptions(c)
+
+	cache := &scrapeCache{
+		ttl: c.Duration("cache-interval"),
+		fetch: func(ctx context.Context) ([]*dto.MetricFamily, error) {
+			return getMetricsFn(ctx, opts)
+		},
+	}
+
+	serveOpts := serveOptions{
+		namespace: c.String("namespace"),
+		api:       c.Bool("api"),
+		dashboard: c.Bool("dashboard"),
+		refresh:   c.Duration("dashboard-refresh"),
+	}
+
+	server := &http.Server{Addr: c.String("listen"), Handler: newServeMux(cache, serveOpts)}
+	go func() {
+		<-c.Context.Done()
+		ctx, cancel := context.WithTimeout(context.Background(), serveShutdownTimeout)
+		defer cancel()
+		server.Shutdown(ctx)
+	}()
+
+	log.Printf("kubestate serving on %s", server.Addr)
+
+	if err := server.ListenAndServe(); !errors.Is(err, http.ErrServerClosed) {
+		return err
+	}
+	return nil
+}
+
+// serveOptions selects the optional routes served alongside /metrics.
+type serveOptions struct {
+	namespace string
+	api       bool
+	dashboard bool
+	refresh   time.Duration
+}
+
+func newServeMux(cache *scrapeCache, opts serveOptions) *http.ServeMux {
+	namespaceFlag := opts.namespace
+	mux := http.NewServeMux()
+
+	mux.HandleFunc("/metrics", func(w http.ResponseWriter, r *http.Request) {
+		families, err := cache.get(r.Context())
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadGateway)
+			return
+		}
+
+		format := expfmt.Negotiate(r.Header)
+		w.Header().Set("Content-Type", string(format))
+		enc := expfmt.NewEncoder(w, format)
+		for _, mf := range derivedMetricFamilies(kubestate.NewCluster(families), namespaceFlag) {
+			if err := enc.Encode(mf); err != nil {
+				log.Printf("Error encoding %s: %v", mf.GetName(), err)
+				return
+			}
+		}
+	})
+
+	if opts.api {
+		registerAPIRoutes(mux, cache, namespaceFlag)
+	}
+	if opts.dashboard {
+		registerDashboardRoute(mux, cache, namespaceFlag, opts.refresh)
+	}
+
+	return mux
+}
+
+// derivedMetricFamilies republishes the top rollups as gauges.
+func derivedMetricFamilies(cluster *kubestate.Cluster, namespaceFlag string) []*dto.MetricFamily {
+	nodeLoad := newGaugeFamily("kubestate_node_load_ratio", "Equally weighted average of cpu and memory requested as a ratio of node allocatable.")
+	nodeCPU := newGaugeFamily("kubestate_node_cpu_request_ratio", "Cpu requested as a ratio of node allocatable.")
+	nodeMemory := newGaugeFamily("kubestate_node_memory_request_ratio", "Memory requested as a ratio of node allocatable.")
+
+	for _, v := range cluster.TopNodes(namespaceFlag) {
+		addGauge(nodeLoad, v.Load, "node", v.Node)
+		addGauge(nodeCPU, v.CPURequest/v.CPUAllocatable, "node", v.Node)
+		addGauge(nodeMemory, v.MemoryRequest/v.MemoryAllocatable, "node", v.Node)
+	}
+
+	nsCPU := newGaugeFamily("kubestate_namespace_cpu_request_share", "Namespace share of all cpu requested in the cluster.")
+	nsMemory := newGaugeFamily("kubestate_namespace_memory_request_share", "Namespace share of all memory requested in the cluster.")
+
+	for _, v := range namespaceRequestShares(cluster, namespaceFlag) {
+		addGauge(nsCPU, v.CPUShare, "namespace", v.Namespace)
+		addGauge(nsMemory, v.MemoryShare, "namespace", v.Namespace)
+	}
+
+	deployUnavailable := newGaugeFamily("kubestate_deployment_unavailable_ratio", "Unavailable replicas as a ratio of requested replicas.")
+
+	deployments := cluster.TopDeployments(namespaceFlag)
+	sort.Slice(deployments, func(i, j int) bool {
+		if deployments[i].Namespace != deployments[j].Namespace {
+			return deployments[i].Namespace < deployments[j].Namespace
+		}
+		return deployments[i].Deployment < deployments[j].Deployment
+	})
+	for _, d := range deployments {
+		ratio := 0.0
+		if d.Requested > 0 {
+			ratio = d.Unavailable / d.Requested
+		}
+		addGauge(deployUnavailable, ratio, "namespace", d.Namespace, "deployment", d.Deployment)
+	}
+
+	return []*dto.MetricFamily{nodeLoad, nodeCPU, nodeMemory, nsCPU, nsMemory, deployUnavailable}
+}
+
+type namespaceShare struct {
+	Namespace     string  `json:"namespace"`
+	CPURequest    float64 `json:"cpuRequest"`
+	MemoryRequest float64 `json:"memoryRequest"`
+	CPUShare      float64 `json:"cpuShare"`
+	MemoryShare   float64 `json:"memoryShare"`
+}
+
+// namespaceRequestShares sums container requests per namespace along with each namespace's
+// share of everything requested, sorted by namespace.
+func namespaceRequestShares(cluster *kubestate.Cluster, namespaceFlag string) []*namespaceShare {
+	cpuByNamespace := make(map[string]float64)
+	memoryByNamespace := make(map[string]float64)
+	var cpuTotal, memoryTotal float64
+	for _, v := range cluster.PodResources(namespaceFlag) {
+		cpuByNamespace[v.Namespace] += v.CPURequest
+		memoryByNamespace[v.Namespace] += v.MemoryRequest
+		cpuTotal += v.CPURequest
+		memoryTotal += v.MemoryRequest
+	}
+
+	shares := make([]*namespaceShare, 0, len(cpuByNamespace))
+	for _, ns := range sortedKeys(cpuByNamespace) {
+		share := &namespaceShare{Namespace: ns, CPURequest: cpuByNamespace[ns], MemoryRequest: memoryByNamespace[ns]}
+		if cpuTotal > 0 {
+			share.CPUShare = share.CPURequest / cpuTotal
+		}
+		if memoryTotal > 0 {
+			share.MemoryShare = share.MemoryRequest / memoryTotal
+		}
+		shares = append(shares, share)
+	}
+
+	return shares
+}
+
+func newGaugeFamily(name, help string) *dto.MetricFamily {
+	t := dto.MetricType_GAUGE
+	return &dto.MetricFamily{Name: &name, Help: &help, Type: &t}
+}
+
+// addGauge appends a sample to mf; labels are name, value pairs.
+func addGauge(mf *dto.MetricFamily, value float64, labels ...string) {
+	if len(labels)%2 != 0 {
+		panic(fmt.Sprintf("odd number of label arguments for %s", mf.GetName()))
+	}
+	m := &dto.Metric{Gauge: &dto.Gauge{Value: &value}}
+	for i := 0; i < len(labels); i += 2 {
+		name, v := labels[i], labels[i+1]
+		m.Label = append(m.Label, &dto.LabelPair{Name: &name, Value: &v})
+	}
+	mf.Metric = append(mf.Metric, m)
+}
+
+func sortedKeys(m map[string]float64) []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
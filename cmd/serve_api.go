@@ -0,0 +1,114 @@
+/*
+ * Copyright 2018 Paul Welch
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License"); you may not use this file except in compliance with the License. You may obtain a copy of the License at
+ *
+ * http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software distributed under the License is distributed on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the License for the specific language governing permissions and limitations under the License.
+ */
+
+package cmd
+
+import (
+	"log"
+	"net/http"
+	"sort"
+
+	"github.com/json-iterator/go"
+	dto "github.com/prometheus/client_model/go"
+
+	"github.com/paulwelch/kubestate/pkg/kubestate"
+)
+
+func registerAPIRoutes(mux *http.ServeMux, cache *scrapeCache, namespaceFlag string) {
+	view := func(render func(r *http.Request, families []*dto.MetricFamily, namespace string) (interface{}, bool)) http.HandlerFunc {
+		return func(w http.ResponseWriter, r *http.Request) {
+			families, err := cache.get(r.Context())
+			if err != nil {
+				writeAPIError(w, http.StatusBadGateway, err.Error())
+				return
+			}
+
+			namespace := r.URL.Query().Get("namespace")
+			if namespace == "" {
+				namespace = namespaceFlag
+			}
+
+			body, found := render(r, families, namespace)
+			if !found {
+				writeAPIError(w, http.StatusNotFound, "not found")
+				return
+			}
+			writeAPIJSON(w, http.StatusOK, body)
+		}
+	}
+
+	mux.HandleFunc("GET /api/v1/top/pods", view(func(_ *http.Request, families []*dto.MetricFamily, namespace string) (interface{}, bool) {
+		return kubestate.TopPods(families, namespace), true
+	}))
+	mux.HandleFunc("GET /api/v1/top/nodes", view(func(_ *http.Request, families []*dto.MetricFamily, namespace string) (interface{}, bool) {
+		return kubestate.TopNodes(families, namespace), true
+	}))
+	mux.HandleFunc("GET /api/v1/top/deployments", view(func(_ *http.Request, families []*dto.MetricFamily, namespace string) (interface{}, bool) {
+		return kubestate.TopDeployments(families, namespace), true
+	}))
+	mux.HandleFunc("GET /api/v1/metrics", view(func(_ *http.Request, families []*dto.MetricFamily, namespace string) (interface{}, bool) {
+		names := make([]string, 0, len(families))
+		for _, mf := range families {
+			names = append(names, mf.GetName())
+		}
+		sort.Strings(names)
+		return names, true
+	}))
+	mux.HandleFunc("GET /api/v1/metrics/{name}", view(func(r *http.Request, families []*dto.MetricFamily, namespace string) (interface{}, bool) {
+		return filterMetricFamily(families, r.PathValue("name"), namespace)
+	}))
+}
+
+// filterMetricFamily returns the named family with only the series in namespace, as get --metric does.
+func filterMetricFamily(metricFamilies []*dto.MetricFamily, name, namespaceFlag string) (*dto.MetricFamily, bool) {
+	for _, mf := range metricFamilies {
+		if mf.GetName() != name {
+			continue
+		}
+		if namespaceFlag == "*" {
+			return mf, true
+		}
+
+		filtered := &dto.MetricFamily{Name: mf.Name, Help: mf.Help, Type: mf.Type}
+		for _, m := range mf.Metric {
+			for _, l := range m.Label {
+				if l.GetName() == "namespace" && l.GetValue() == namespaceFlag {
+					filtered.Metric = append(filtered.Metric, m)
+					break
+				}
+			}
+		}
+		return filtered, true
+	}
+
+	return nil, false
+}
+
+func writeAPIJSON(w http.ResponseWriter, status int, body interface{}) {
+	data, err := jsoniter.Marshal(body)
+	if err != nil {
+		writeAPIError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	if _, err := w.Write(data); err != nil {
+		log.Printf("Error writing response: %v", err)
+	}
+}
+
+func writeAPIError(w http.ResponseWriter, status int, message string) {
+	data, _ := jsoniter.Marshal(map[string]string{"error": message})
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	if _, err := w.Write(data); err != nil {
+		log.Printf("Error writing response: %v", err)
+	}
+}
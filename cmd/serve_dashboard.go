@@ -0,0 +1,204 @@
+/*
+ * Copyright 2018 Paul Welch
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License"); you may not use this file except in compliance with the License. You may obtain a copy of the License at
+ *
+ * http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software distributed under the License is distributed on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the License for the specific language governing permissions and limitations under the License.
+ */
+
+package cmd
+
+import (
+	"bytes"
+	"fmt"
+	"html/template"
+	"log"
+	"net/http"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/paulwelch/kubestate/pkg/kubestate"
+)
+
+type unhealthyWorkload struct {
+	Kind      string
+	Namespace string
+	Name      string
+	Reason    string
+}
+
+// dashboardData is everything rendered by the dashboard page.
+type dashboardData struct {
+	Generated  string
+	Refresh    int
+	Namespace  string
+	Nodes      []*kubestate.NodeResources
+	Namespaces []*namespaceShare
+	Unhealthy  []*unhealthyWorkload
+}
+
+var dashboardFuncs = template.FuncMap{
+	"percent": func(v float64) string {
+		return fmt.Sprintf("%.0f%%", v*100)
+	},
+	// width clamps a ratio to a bar width, since nodes can be overcommitted.
+	"width": func(v float64) string {
+		if v > 1 {
+			v = 1
+		}
+		return fmt.Sprintf("%.1f%%", v*100)
+	},
+	"level": loadLevel,
+	"millicores": func(v float64) string {
+		return fmt.Sprintf("%.0fm", v*1000)
+	},
+	"mebibytes": func(v float64) string {
+		return fmt.Sprintf("%.0fMi", v/1048576)
+	},
+}
+
+var dashboardTemplate = template.Must(template.New("dashboard").Funcs(dashboardFuncs).Parse(`<!DOCTYPE html>
+<html lang="en">
+<head>
+<meta charset="utf-8">
+{{- if .Refresh}}
+<meta http-equiv="refresh" content="{{.Refresh}}">
+{{- end}}
+<title>kubestate</title>
+<style>
+body { font-family: -apple-system, "Segoe UI", Helvetica, Arial, sans-serif; margin: 2em; color: #222; }
+h1 { font-size: 1.4em; margin-bottom: 0; }
+h2 { font-size: 1.1em; margin-top: 2em; border-bottom: 1px solid #ddd; }
+.meta { color: #777; font-size: 0.85em; }
+table { border-collapse: collapse; width: 100%; max-width: 60em; }
+th, td { text-align: left; padding: 0.25em 0.75em 0.25em 0; font-size: 0.9em; }
+td.num { text-align: right; white-space: nowrap; }
+.bar { background: #eee; height: 0.9em; width: 20em; }
+.bar div { height: 100%; }
+.ok { background: #4caf50; }
+.warn { background: #ff9800; }
+.high { background: #f44336; }
+.none { color: #4caf50; }
+</style>
+</head>
+<body>
+<h1>kubestate</h1>
+<p class="meta">Namespace {{.Namespace}} &middot; generated {{.Generated}}{{if .Refresh}} &middot; refreshes every {{.Refresh}}s{{end}}</p>
+
+<h2>Node load</h2>
+<table>
+<tr><th>Node</th><th>Load</th><th></th><th>CPU Req / Cap</th><th>Memory Req / Cap</th></tr>
+{{- range .Nodes}}
+<tr><td>{{.Node}}</td><td><div class="bar"><div class="{{level .Load}}" style="width: {{width .Load}}"></div></div></td><td class="num">{{percent .Load}}</td><td class="num">{{millicores .CPURequest}} / {{millicores .CPUCapacity}}</td><td class="num">{{mebibytes .MemoryRequest}} / {{mebibytes .MemoryCapacity}}</td></tr>
+{{- else}}
+<tr><td colspan="5">No nodes</td></tr>
+{{- end}}
+</table>
+
+<h2>Namespace requests</h2>
+<table>
+<tr><th>Namespace</th><th>CPU share</th><th></th><th>Memory share</th><th></th></tr>
+{{- range .Namespaces}}
+<tr><td>{{.Namespace}}</td><td><div class="bar"><div class="ok" style="width: {{width .CPUShare}}"></div></div></td><td class="num">{{percent .CPUShare}} ({{millicores .CPURequest}})</td><td><div class="bar"><div class="ok" style="width: {{width .MemoryShare}}"></div></div></td><td class="num">{{percent .MemoryShare}} ({{mebibytes .MemoryRequest}})</td></tr>
+{{- else}}
+<tr><td colspan="5">No requests</td></tr>
+{{- end}}
+</table>
+
+<h2>Unhealthy workloads</h2>
+{{- if .Unhealthy}}
+<table>
+<tr><th>Kind</th><th>Namespace</th><th>Name</th><th>Reason</th></tr>
+{{- range .Unhealthy}}
+<tr><td>{{.Kind}}</td><td>{{.Namespace}}</td><td>{{.Name}}</td><td>{{.Reason}}</td></tr>
+{{- end}}
+</table>
+{{- else}}
+<p class="none">All workloads healthy</p>
+{{- end}}
+</body>
+</html>
+`))
+
+// loadLevel buckets a load ratio for coloring.
+func loadLevel(v float64) string {
+	switch {
+	case v >= 0.9:
+		return "high"
+	case v >= 0.7:
+		return "warn"
+	}
+	return "ok"
+}
+
+func registerDashboardRoute(mux *http.ServeMux, cache *scrapeCache, namespaceFlag string, refresh time.Duration) {
+	mux.HandleFunc("GET /{$}", func(w http.ResponseWriter, r *http.Request) {
+		families, err := cache.get(r.Context())
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadGateway)
+			return
+		}
+
+		data := newDashboardData(kubestate.NewCluster(families), namespaceFlag, time.Now())
+		data.Refresh = int(refresh.Seconds())
+
+		// render to a buffer so template errors still produce a clean 500
+		var buf bytes.Buffer
+		if err := dashboardTemplate.Execute(&buf, data); err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		w.Header().Set("Content-Type", "text/html; charset=utf-8")
+		if _, err := buf.WriteTo(w); err != nil {
+			log.Printf("Error writing response: %v", err)
+		}
+	})
+}
+
+func newDashboardData(cluster *kubestate.Cluster, namespaceFlag string, now time.Time) *dashboardData {
+	return &dashboardData{
+		Generated:  now.UTC().Format(time.RFC3339),
+		Namespace:  namespaceFlag,
+		Nodes:      cluster.TopNodes(namespaceFlag),
+		Namespaces: namespaceRequestShares(cluster, namespaceFlag),
+		Unhealthy:  unhealthyWorkloads(cluster, namespaceFlag),
+	}
+}
+
+// unhealthyWorkloads lists deployments with unavailable replicas and the pending claims and
+// failing jobs reported by summary.
+func unhealthyWorkloads(cluster *kubestate.Cluster, namespaceFlag string) []*unhealthyWorkload {
+	workloads := make([]*unhealthyWorkload, 0)
+
+	for _, d := range cluster.TopDeployments(namespaceFlag) {
+		if d.Unavailable > 0 {
+			workloads = append(workloads, &unhealthyWorkload{"Deployment", d.Namespace, d.Deployment,
+				fmt.Sprintf("%.0f of %.0f replicas unavailable", d.Unavailable, d.Requested)})
+		}
+	}
+
+	sum := summarize(cluster, namespaceFlag)
+	for _, v := range sum.failingJobs {
+		ns, name, _ := strings.Cut(v, "/")
+		workloads = append(workloads, &unhealthyWorkload{"Job", ns, name, "failed pods"})
+	}
+	for _, v := range sum.pendingPVCs {
+		ns, name, _ := strings.Cut(v, "/")
+		workloads = append(workloads, &unhealthyWorkload{"PersistentVolumeClaim", ns, name, "pending"})
+	}
+
+	sort.SliceStable(workloads, func(i, j int) bool {
+		if workloads[i].Kind != workloads[j].Kind {
+			return workloads[i].Kind < workloads[j].Kind
+		}
+		if workloads[i].Namespace != workloads[j].Namespace {
+			return workloads[i].Namespace < workloads[j].Namespace
+		}
+		return workloads[i].Name < workloads[j].Name
+	})
+
+	return workloads
+}
@@ -0,0 +1,243 @@
+package cmd
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	dto "github.com/prometheus/client_model/go"
+
+	"github.com/paulwelch/kubestate/pkg/kubestate"
+)
+
+func TestServeMetricsPublishesDerivedSeries(t *testing.T) {
+	cache := &scrapeCache{fetch: func(context.Context) ([]*dto.MetricFamily, error) {
+		families := sampleTopMetricFamilies()
+		families = append(families, newMetricFamily("kube_deployment_status_replicas_unavailable", []*dto.Metric{
+			newGaugeMetric(1, map[string]string{"namespace": "default", "deployment": "web"}),
+		}), newMetricFamily("kube_deployment_spec_replicas", []*dto.Metric{
+			newGaugeMetric(4, map[string]string{"namespace": "default", "deployment": "web"}),
+		}))
+		return families, nil
+	}}
+	server := httptest.NewServer(newServeMux(cache, serveOptions{namespace: "*"}))
+	defer server.Close()
+
+	resp, err := http.Get(server.URL + "/metrics")
+	if err != nil {
+		t.Fatalf("GET /metrics: %v", err)
+	}
+	defer resp.Body.Close()
+	body, _ := io.ReadAll(resp.Body)
+
+	if resp.StatusCode != http.StatusOK || !strings.HasPrefix(resp.Header.Get("Content-Type"), "text/plain") {
+		t.Fatalf("unexpected response %d %q", resp.StatusCode, resp.Header.Get("Content-Type"))
+	}
+
+	families, err := kubestate.ParseMetrics(body)
+	if err != nil {
+		t.Fatalf("failed parsing /metrics output: %v", err)
+	}
+	values := map[string]float64{}
+	for _, mf := range families {
+		for _, m := range mf.Metric {
+			values[seriesID(mf.GetName(), labelMap(m))] = m.GetGauge().GetValue()
+		}
+	}
+
+	// 0.1 of 7.5 cpu and 100Mi of 15Gi memory allocatable
+	wantLoad := (0.1/7.5 + 104857600.0/16106127360.0) / 2
+	for id, want := range map[string]float64{
+		`kubestate_node_load_ratio{node="node1"}`:                                                     wantLoad,
+		`kubestate_namespace_cpu_request_share{namespace="kube-system"}`:                              1,
+		`kubestate_deployment_unavailable_ratio{deployment="web",namespace="default"}`:                0.25,
+		`kubestate_deployment_unavailable_ratio{deployment="metrics-server",namespace="kube-system"}`: 0,
+	} {
+		got, ok := values[id]
+		if !ok || got-want > 1e-9 || want-got > 1e-9 {
+			t.Fatalf("%s = %v (present %v), want %v\n%s", id, got, ok, want, body)
+		}
+	}
+}
+
+func TestServeMetricsReportsScrapeErrors(t *testing.T) {
+	cache := &scrapeCache{fetch: func(context.Context) ([]*dto.MetricFamily, error) {
+		return nil, errors.New("kube-state-metrics unavailable")
+	}}
+	server := httptest.NewServer(newServeMux(cache, serveOptions{namespace: "*"}))
+	defer server.Close()
+
+	resp, err := http.Get(server.URL + "/metrics")
+	if err != nil {
+		t.Fatalf("GET /metrics: %v", err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusBadGateway {
+		t.Fatalf("expected 502, got %d", resp.StatusCode)
+	}
+}
+
+func TestScrapeCacheReusesScrapeWithinInterval(t *testing.T) {
+	fetches := 0
+	cache := &scrapeCache{ttl: time.Hour, fetch: func(context.Context) ([]*dto.MetricFamily, error) {
+		fetches++
+		return sampleTopMetricFamilies(), nil
+	}}
+
+	for i := 0; i < 3; i++ {
+		if _, err := cache.get(context.Background()); err != nil {
+			t.Fatalf("get returned error: %v", err)
+		}
+	}
+	if fetches != 1 {
+		t.Fatalf("expected 1 fetch within cache interval, got %d", fetches)
+	}
+
+	cache.ttl = 0
+	cache.get(context.Background())
+	if fetches != 2 {
+		t.Fatalf("expected zero interval to scrape on every request, got %d fetches", fetches)
+	}
+}
+
+func TestServeAPIViews(t *testing.T) {
+	cache := &scrapeCache{fetch: func(context.Context) ([]*dto.MetricFamily, error) {
+		return sampleTopMetricFamilies(), nil
+	}}
+	server := httptest.NewServer(newServeMux(cache, serveOptions{namespace: "*", api: true}))
+	defer server.Close()
+
+	get := func(path string, v interface{}) int {
+		t.Helper()
+		resp, err := http.Get(server.URL + path)
+		if err != nil {
+			t.Fatalf("GET %s: %v", path, err)
+		}
+		defer resp.Body.Close()
+		if ct := resp.Header.Get("Content-Type"); ct != "application/json" {
+			t.Fatalf("GET %s: unexpected content type %q", path, ct)
+		}
+		if err := json.NewDecoder(resp.Body).Decode(v); err != nil {
+			t.Fatalf("GET %s: invalid json: %v", path, err)
+		}
+		return resp.StatusCode
+	}
+
+	var nodes []kubestate.NodeResources
+	if status := get("/api/v1/top/nodes", &nodes); status != http.StatusOK || len(nodes) != 1 || nodes[0].Node != "node1" || nodes[0].CPUCapacity != 8 {
+		t.Fatalf("unexpected nodes %d %+v", status, nodes)
+	}
+
+	var pods []kubestate.PodResources
+	if get("/api/v1/top/pods?namespace=kube-system", &pods); len(pods) != 1 || pods[0].Pod != "metrics-server-abc" || pods[0].CPURequest != 0.1 {
+		t.Fatalf("unexpected pods %+v", pods)
+	}
+	if get("/api/v1/top/pods?namespace=default", &pods); len(pods) != 0 {
+		t.Fatalf("expected no pods in default, got %+v", pods)
+	}
+
+	var deployments []kubestate.DeploymentReplicas
+	if get("/api/v1/top/deployments", &deployments); len(deployments) != 1 || deployments[0].Requested != 2 {
+		t.Fatalf("unexpected deployments %+v", deployments)
+	}
+
+	var names []string
+	if get("/api/v1/metrics", &names); len(names) != 7 || names[0] != "kube_deployment_spec_replicas" {
+		t.Fatalf("unexpected metric names %v", names)
+	}
+
+	var family struct {
+		Name   string            `json:"name"`
+		Metric []json.RawMessage `json:"metric"`
+	}
+	if get("/api/v1/metrics/kube_node_status_capacity", &family); family.Name != "kube_node_status_capacity" || len(family.Metric) != 2 {
+		t.Fatalf("unexpected family %+v", family)
+	}
+
+	var apiErr map[string]string
+	if status := get("/api/v1/metrics/kube_missing", &apiErr); status != http.StatusNotFound || apiErr["error"] == "" {
+		t.Fatalf("expected 404 error for missing metric, got %d %v", status, apiErr)
+	}
+}
+
+func TestServeAPIDisabledByDefault(t *testing.T) {
+	cache := &scrapeCache{fetch: func(context.Context) ([]*dto.MetricFamily, error) {
+		return sampleTopMetricFamilies(), nil
+	}}
+	server := httptest.NewServer(newServeMux(cache, serveOptions{namespace: "*"}))
+	defer server.Close()
+
+	resp, err := http.Get(server.URL + "/api/v1/top/nodes")
+	if err != nil {
+		t.Fatalf("GET: %v", err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusNotFound {
+		t.Fatalf("expected 404 without --api, got %d", resp.StatusCode)
+	}
+}
+
+func TestServeDashboardRendersRollups(t *testing.T) {
+	cache := &scrapeCache{fetch: func(context.Context) ([]*dto.MetricFamily, error) {
+		families := sampleTopMetricFamilies()
+		families = append(families, newMetricFamily("kube_deployment_status_replicas_unavailable", []*dto.Metric{
+			newGaugeMetric(1, map[string]string{"namespace": "default", "deployment": "web"}),
+		}), newMetricFamily("kube_deployment_spec_replicas", []*dto.Metric{
+			newGaugeMetric(4, map[string]string{"namespace": "default", "deployment": "web"}),
+		}), newMetricFamily("kube_job_status_failed", []*dto.Metric{
+			newGaugeMetric(2, map[string]string{"namespace": "batch", "job_name": "nightly<script>"}),
+		}))
+		return families, nil
+	}}
+	server := httptest.NewServer(newServeMux(cache, serveOptions{namespace: "*", dashboard: true, refresh: 15 * time.Second}))
+	defer server.Close()
+
+	resp, err := http.Get(server.URL + "/")
+	if err != nil {
+		t.Fatalf("GET /: %v", err)
+	}
+	defer resp.Body.Close()
+	body, _ := io.ReadAll(resp.Body)
+	page := string(body)
+
+	if resp.StatusCode != http.StatusOK || !strings.HasPrefix(resp.Header.Get("Content-Type"), "text/html") {
+		t.Fatalf("unexpected response %d %q", resp.StatusCode, resp.Header.Get("Content-Type"))
+	}
+	for _, want := range []string{
+		`<meta http-equiv="refresh" content="15">`,
+		`<td>node1</td>`,
+		`<td>kube-system</td>`,
+		`<td>Deployment</td><td>default</td><td>web</td><td>1 of 4 replicas unavailable</td>`,
+		`<td>Job</td><td>batch</td><td>nightly&lt;script&gt;</td>`,
+	} {
+		if !strings.Contains(page, want) {
+			t.Fatalf("dashboard missing %q:\n%s", want, page)
+		}
+	}
+	if strings.Contains(page, "http://") || strings.Contains(page, "https://") {
+		t.Fatalf("dashboard should not reference external resources:\n%s", page)
+	}
+
+	resp, err = http.Get(server.URL + "/missing")
+	if err != nil {
+		t.Fatalf("GET /missing: %v", err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusNotFound {
+		t.Fatalf("expected only / to serve the dashboard, got %d", resp.StatusCode)
+	}
+}
+
+func labelMap(m *dto.Metric) map[string]string {
+	labels := make(map[string]string, len(m.Label))
+	for _, l := range m.Label {
+		labels[l.GetName()] = l.GetValue()
+	}
+	return labels
+}
@@ -0,0 +1,66 @@
+/*
+ * Copyright 2018 Paul Welch
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License"); you may not use this file except in compliance with the License. You may obtain a copy of the License at
+ *
+ * http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software distributed under the License is distributed on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the License for the specific language governing permissions and limitations under the License.
+ */
+
+package cmd
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"text/tabwriter"
+	"time"
+
+	"github.com/urfave/cli/v2"
+
+	"github.com/paulwelch/kubestate/pkg/kubestate"
+)
+
+// PrintStats reports the kube-state-metrics transfers made by the command to stderr when
+// --stats is set, so they stay out of piped output.
+func PrintStats(c *cli.Context) error {
+	if !c.Bool("stats") {
+		return nil
+	}
+
+	sessionsMu.Lock()
+	var total kubestate.TransferStats
+	for _, client := range sessions {
+		stats := client.Stats()
+		total.Scrapes += stats.Scrapes
+		total.Cached += stats.Cached
+		total.Transferred += stats.Transferred
+		total.Decoded += stats.Decoded
+		total.DecodeTime += stats.DecodeTime
+		total.Series += stats.Series
+		if stats.Encoding != "" {
+			total.Encoding = stats.Encoding
+		}
+	}
+	sessionsMu.Unlock()
+
+	printStats(os.Stderr, total)
+	return nil
+}
+
+func printStats(out io.Writer, stats kubestate.TransferStats) {
+	w := new(tabwriter.Writer)
+	w.Init(out, 4, 1, 1, ' ', 0)
+
+	encoding := stats.Encoding
+	if encoding == "" {
+		encoding = "-"
+	}
+
+	fmt.Fprintf(w, "%s\t%s\t%s\t%s\t%s\t%s\t%s\n", "Scrapes", "Cached", "Transferred", "Encoding", "Decoded", "Decode Time", "Series")
+	fmt.Fprintf(w, "%d\t%d\t%d\t%s\t%d\t%s\t%d\n", stats.Scrapes, stats.Cached, stats.Transferred, encoding, stats.Decoded,
+		stats.DecodeTime.Round(time.Millisecond), stats.Series)
+
+	w.Flush()
+}
@@ -0,0 +1,132 @@
+/*
+ * Copyright 2018 Paul Welch
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License"); you may not use this file except in compliance with the License. You may obtain a copy of the License at
+ *
+ * http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software distributed under the License is distributed on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the License for the specific language governing permissions and limitations under the License.
+ */
+
+package cmd
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"strings"
+	"text/tabwriter"
+
+	"github.com/urfave/cli/v2"
+
+	"github.com/paulwelch/kubestate/pkg/kubestate"
+)
+
+const summaryTopNodes = 5
+
+var podPhases = []string{"Running", "Pending", "Succeeded", "Failed", "Unknown"}
+
+type clusterSummary struct {
+	nodes, readyNodes                                int
+	cpuCapacity, cpuAllocatable, cpuRequest          float64
+	memoryCapacity, memoryAllocatable, memoryRequest float64
+	podPhases                                        map[string]int
+	deployments                                      int
+	unavailableDeployments, pendingPVCs, failingJobs []string
+	topNodes                                         []*kubestate.NodeResources
+}
+
+func Summary(c *cli.Context) error {
+	metricFamilies, err := getFilteredMetricsFn(c.Context, clientOptions(c), kubestate.ClusterFilter())
+	if err != nil {
+		return err
+	}
+
+	printSummary(os.Stdout, summarize(kubestate.NewCluster(metricFamilies), c.String("namespace")))
+
+	return nil
+}
+
+func summarize(cluster *kubestate.Cluster, namespaceFlag string) *clusterSummary {
+	sum := &clusterSummary{podPhases: make(map[string]int)}
+
+	nodes := cluster.NodeResources(namespaceFlag)
+	sum.nodes = len(nodes)
+	for _, v := range nodes {
+		sum.cpuCapacity += v.CPUCapacity
+		sum.cpuAllocatable += v.CPUAllocatable
+		sum.memoryCapacity += v.MemoryCapacity
+		sum.memoryAllocatable += v.MemoryAllocatable
+		sum.cpuRequest += v.CPURequest
+		sum.memoryRequest += v.MemoryRequest
+	}
+	for _, n := range cluster.Nodes {
+		if n.Ready {
+			sum.readyNodes++
+		}
+	}
+
+	sum.topNodes = cluster.TopNodes(namespaceFlag)
+	if len(sum.topNodes) > summaryTopNodes {
+		sum.topNodes = sum.topNodes[:summaryTopNodes]
+	}
+
+	deployments := cluster.TopDeployments(namespaceFlag)
+	sum.deployments = len(deployments)
+	for _, v := range deployments {
+		if v.Unavailable > 0 {
+			sum.unavailableDeployments = append(sum.unavailableDeployments, v.Namespace+"/"+v.Deployment)
+		}
+	}
+
+	for _, p := range cluster.Pods {
+		if (namespaceFlag == "*" || namespaceFlag == p.Namespace) && p.Phase != "" {
+			sum.podPhases[p.Phase]++
+		}
+	}
+	for _, pvc := range cluster.Claims {
+		if (namespaceFlag == "*" || namespaceFlag == pvc.Namespace) && pvc.Phase == "Pending" {
+			sum.pendingPVCs = append(sum.pendingPVCs, pvc.Namespace+"/"+pvc.Name)
+		}
+	}
+	for _, job := range cluster.Workloads[kubestate.KindJob] {
+		if (namespaceFlag == "*" || namespaceFlag == job.Namespace) && job.Failed > 0 {
+			sum.failingJobs = append(sum.failingJobs, job.Namespace+"/"+job.Name)
+		}
+	}
+
+	sort.Strings(sum.unavailableDeployments)
+	sort.Strings(sum.pendingPVCs)
+	sort.Strings(sum.failingJobs)
+
+	return sum
+}
+
+func printSummary(out io.Writer, sum *clusterSummary) {
+	w := new(tabwriter.Writer)
+	w.Init(out, 4, 1, 1, ' ', 0)
+
+	phases := make([]string, 0, len(podPhases))
+	for _, phase := range podPhases {
+		phases = append(phases, fmt.Sprintf("%s %d", phase, sum.podPhases[phase]))
+	}
+
+	fmt.Fprintf(w, "%s\t%d (Ready %d / NotReady %d)\n", "Nodes", sum.nodes, sum.readyNodes, sum.nodes-sum.readyNodes)
+	fmt.Fprintf(w, "%s\t(%.0fm / %.0fm / %.0fm)\n", "CPU (Cap / Alloc / Req)", sum.cpuCapacity*1000, sum.cpuAllocatable*1000, sum.cpuRequest*1000)
+	fmt.Fprintf(w, "%s\t(%.0fMi / %.0fMi / %.0fMi)\n", "Memory (Cap / Alloc / Req)", sum.memoryCapacity/1048576, sum.memoryAllocatable/1048576, sum.memoryRequest/1048576)
+	fmt.Fprintf(w, "%s\t%s\n", "Pods", strings.Join(phases, " / "))
+	fmt.Fprintf(w, "%s\t%d of %d\t%s\n", "Deployments Unavailable", len(sum.unavailableDeployments), sum.deployments, strings.Join(sum.unavailableDeployments, " "))
+	fmt.Fprintf(w, "%s\t%d\t%s\n", "PVCs Pending", len(sum.pendingPVCs), strings.Join(sum.pendingPVCs, " "))
+	fmt.Fprintf(w, "%s\t%d\t%s\n", "Jobs Failing", len(sum.failingJobs), strings.Join(sum.failingJobs, " "))
+	w.Flush()
+
+	fmt.Fprintln(out)
+
+	w.Init(out, 4, 1, 1, ' ', 0)
+	fmt.Fprintf(w, "%s\t%s\n", "Node", "Load")
+	for _, v := range sum.topNodes {
+		fmt.Fprintf(w, "%s\t%.0f%%\n", v.Node, v.Load*100)
+	}
+	w.Flush()
+}
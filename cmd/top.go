@@ -10,7 +10,15 @@
 
 package cmd
 
-import "github.com/urfave/cli/v2"
+import (
+	"io"
+	"os"
+
+	dto "github.com/prometheus/client_model/go"
+	"github.com/urfave/cli/v2"
+
+	"github.com/paulwelch/kubestate/pkg/kubestate"
+)
 
 // other top rollup ideas: RC/RS / Service, Job/CronJob, Resource Quotas, HPA (network??), Storage (may not have right metrics for it)
 
@@ -18,30 +26,24 @@ type podKey struct {
 	namespace, pod, container string
 }
 
-type pod struct {
-	node                                             string
-	cpuRequest, cpuLimit, memoryRequest, memoryLimit float64
-}
-
-type node struct {
-	cpuCapacity, cpuAllocatable, memoryCapacity, memoryAllocatable float64
-}
-
 func Top(c *cli.Context) error {
-	metricFamilies, err := getMetricsFn(c.String("config"), c.String("metrics-namespace"), c.Bool("insecure-skip-tls-verify"))
+	metricFamilies, err := getFilteredMetricsFn(c.Context, clientOptions(c), kubestate.ClusterFilter())
 	if err != nil {
 		return err
 	}
 
-	namespaceFlag := c.String("namespace")
-	switch c.Command.Name {
+	renderTop(os.Stdout, c.Command.Name, metricFamilies, c.String("namespace"))
+
+	return nil
+}
+
+func renderTop(out io.Writer, view string, metricFamilies []*dto.MetricFamily, namespaceFlag string) {
+	switch view {
 	case "deployments":
-		topDeployments(metricFamilies, namespaceFlag)
+		topDeployments(out, metricFamilies, namespaceFlag)
 	case "pods":
-		topPods(metricFamilies, namespaceFlag)
+		topPods(out, metricFamilies, namespaceFlag)
 	case "nodes":
-		topNodes(metricFamilies, namespaceFlag)
+		topNodes(out, metricFamilies, namespaceFlag)
 	}
-
-	return nil
 }
@@ -0,0 +1,142 @@
+/*
+ * Copyright 2018 Paul Welch
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License"); you may not use this file except in compliance with the License. You may obtain a copy of the License at
+ *
+ * http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software distributed under the License is distributed on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the License for the specific language governing permissions and limitations under the License.
+ */
+
+package cmd
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"text/tabwriter"
+	"time"
+
+	dto "github.com/prometheus/client_model/go"
+	"github.com/urfave/cli/v2"
+)
+
+// sleepFn waits for d or until ctx is done; tests stub it to skip the wait.
+var sleepFn = sleepContext
+
+func TopRestarts(c *cli.Context) error {
+	window := c.Duration("window")
+	if window <= 0 {
+		return cli.Exit("window must be > 0", 2)
+	}
+
+	ctx, opts := c.Context, clientOptions(c)
+
+	first, err := getMetricsFn(ctx, opts)
+	if err != nil {
+		return err
+	}
+
+	if err := sleepFn(ctx, window); err != nil {
+		return cli.Exit("interrupted", 130)
+	}
+
+	last, err := getMetricsFn(ctx, opts)
+	if err != nil {
+		return err
+	}
+
+	topRestarts(os.Stdout, first, last, c.String("namespace"), window)
+
+	return nil
+}
+
+// sleepContext sleeps for d, returning early with the context error once ctx is done.
+func sleepContext(ctx context.Context, d time.Duration) error {
+	timer := time.NewTimer(d)
+	defer timer.Stop()
+
+	select {
+	case <-timer.C:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+func collectRestarts(metricFamilies []*dto.MetricFamily, namespaceFlag string) map[podKey]float64 {
+	restarts := make(map[podKey]float64)
+
+	for i := 0; i < len(metricFamilies); i++ {
+		if metricFamilies[i].GetName() != "kube_pod_container_status_restarts_total" {
+			continue
+		}
+		for _, f := range metricFamilies[i].Metric {
+			ns, po, co := "", "", ""
+
+			for _, l := range f.Label {
+				switch l.GetName() {
+				case "namespace":
+					ns = l.GetValue()
+				case "pod":
+					po = l.GetValue()
+				case "container":
+					co = l.GetValue()
+				}
+			}
+
+			if namespaceFlag == "*" || namespaceFlag == ns {
+				restarts[podKey{ns, po, co}] += seriesValue(f)
+			}
+		}
+	}
+
+	return restarts
+}
+
+func topRestarts(out io.Writer, first, last []*dto.MetricFamily, namespaceFlag string, window time.Duration) {
+	before := collectRestarts(first, namespaceFlag)
+	after := collectRestarts(last, namespaceFlag)
+
+	type podRestarts struct {
+		key   podKey
+		delta float64
+	}
+	rows := make([]podRestarts, 0, len(after))
+	for k, v := range after {
+		delta := v
+		if prev, ok := before[k]; ok {
+			delta = counterDelta(prev, v)
+		}
+		if delta == 0 && v == 0 {
+			continue
+		}
+		rows = append(rows, podRestarts{k, delta})
+	}
+	sort.Slice(rows, func(i, j int) bool {
+		a, b := rows[i], rows[j]
+		if a.delta != b.delta {
+			return a.delta > b.delta
+		}
+		if a.key.namespace != b.key.namespace {
+			return a.key.namespace < b.key.namespace
+		}
+		if a.key.pod != b.key.pod {
+			return a.key.pod < b.key.pod
+		}
+		return a.key.container < b.key.container
+	})
+
+	w := new(tabwriter.Writer)
+	w.Init(out, 4, 1, 1, ' ', 0)
+
+	fmt.Fprintf(w, "%s\t%s\t%s\t%s\t%s\n", "Namespace", "Pod", "Container", fmt.Sprintf("Restarts (%s)", window), "Total")
+
+	for _, v := range rows {
+		fmt.Fprintf(w, "%s\t%s\t%s\t%.0f\t%.0f\n", v.key.namespace, v.key.pod, v.key.container, v.delta, after[v.key])
+	}
+
+	w.Flush()
+}
@@ -0,0 +1,124 @@
+/*
+ * Copyright 2018 Paul Welch
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License"); you may not use this file except in compliance with the License. You may obtain a copy of the License at
+ *
+ * http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software distributed under the License is distributed on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the License for the specific language governing permissions and limitations under the License.
+ */
+
+package cmd
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"time"
+
+	dto "github.com/prometheus/client_model/go"
+	"github.com/urfave/cli/v2"
+	"golang.org/x/term"
+
+	"github.com/paulwelch/kubestate/pkg/kubestate"
+)
+
+type uiFetchResult struct {
+	families []*dto.MetricFamily
+	err      error
+}
+
+func UI(c *cli.Context) error {
+	interval := c.Int("interval")
+	if interval < 1 {
+		return cli.Exit("interval must be >= 1", 2)
+	}
+
+	stdin, stdout := int(os.Stdin.Fd()), int(os.Stdout.Fd())
+	if !term.IsTerminal(stdin) || !term.IsTerminal(stdout) {
+		return cli.Exit("ui requires an interactive terminal", 2)
+	}
+
+	opts := clientOptions(c)
+
+	// leaving the ui abandons any fetch still in flight
+	ctx, cancel := context.WithCancel(c.Context)
+	defer cancel()
+
+	oldState, err := term.MakeRaw(stdin)
+	if err != nil {
+		return err
+	}
+	defer term.Restore(stdin, oldState)
+
+	// alternate screen and hidden cursor, restored on exit
+	fmt.Print("\x1b[?1049h\x1b[?25l")
+	defer fmt.Print("\x1b[?25h\x1b[?1049l")
+
+	keys := make(chan string)
+	go func() {
+		buf := make([]byte, 16)
+		for {
+			n, err := os.Stdin.Read(buf)
+			if err != nil {
+				close(keys)
+				return
+			}
+			keys <- string(buf[:n])
+		}
+	}()
+
+	results := make(chan uiFetchResult, 1)
+	fetching := false
+	fetch := func() {
+		if fetching {
+			return
+		}
+		fetching = true
+		go func() {
+			families, err := getFilteredMetricsFn(ctx, opts, kubestate.ClusterFilter())
+			results <- uiFetchResult{families, err}
+		}()
+	}
+
+	state := newUIState(c.String("namespace"), interval)
+	draw := func() {
+		width, height, err := term.GetSize(stdout)
+		if err != nil {
+			width, height = 80, 24
+		}
+		fmt.Print("\x1b[H\x1b[2J")
+		fmt.Print(state.render(width, height))
+	}
+
+	ticker := time.NewTicker(time.Duration(interval) * time.Second)
+	defer ticker.Stop()
+
+	fetch()
+	draw()
+
+	for {
+		select {
+		case key, ok := <-keys:
+			if !ok {
+				return nil
+			}
+			_, height, err := term.GetSize(stdout)
+			if err != nil {
+				height = 24
+			}
+			if state.handleKey(key, height) {
+				return nil
+			}
+			draw()
+		case r := <-results:
+			fetching = false
+			state.update(r.families, r.err)
+			draw()
+		case <-ticker.C:
+			fetch()
+		case <-ctx.Done():
+			return nil
+		}
+	}
+}
@@ -0,0 +1,102 @@
+package cmd
+
+import (
+	"errors"
+	"strings"
+	"testing"
+
+	dto "github.com/prometheus/client_model/go"
+)
+
+func TestUIStateDrillDownFromNodeToPods(t *testing.T) {
+	families := append(sampleTopMetricFamilies(),
+		newMetricFamily("kube_pod_container_resource_requests", []*dto.Metric{
+			newGaugeMetric(0.5, map[string]string{
+				"namespace": "default",
+				"pod":       "web-abc",
+				"container": "web",
+				"node":      "node2",
+				"resource":  "cpu",
+			}),
+		}),
+		newMetricFamily("kube_node_status_allocatable", []*dto.Metric{
+			newGaugeMetric(4, map[string]string{"node": "node2", "resource": "cpu"}),
+			newGaugeMetric(8589934592, map[string]string{"node": "node2", "resource": "memory"}),
+		}),
+	)
+
+	state := newUIState("*", 10)
+	state.update(families, nil)
+
+	if got := len(state.table().rows); got != 2 {
+		t.Fatalf("expected 2 pod rows, got %d", got)
+	}
+
+	state.handleKey("2", 24)
+	rows := state.table().rows
+	if state.tab != uiNodes || len(rows) != 2 {
+		t.Fatalf("expected nodes tab with 2 rows, got tab %d with %d rows", state.tab, len(rows))
+	}
+
+	state.handleKey(uiKeyDown, 24)
+	want := rows[1].node
+	state.handleKey(uiKeyEnter, 24)
+	if state.tab != uiPods || state.node != want {
+		t.Fatalf("expected drill-down to pods on %q, got tab %d node %q", want, state.tab, state.node)
+	}
+	for _, r := range state.table().rows {
+		if r.node != want {
+			t.Fatalf("expected only pods on %q, got %q", want, r.node)
+		}
+	}
+
+	state.handleKey(uiKeyEscape, 24)
+	if state.node != "" || len(state.table().rows) != 2 {
+		t.Fatalf("expected node filter to be cleared")
+	}
+}
+
+func TestUIStateNamespaceFilterAndSort(t *testing.T) {
+	state := newUIState("*", 10)
+	state.update(sampleTopMetricFamilies(), nil)
+
+	state.handleKey("3", 24)
+	if got := state.namespaces; len(got) != 2 || got[0] != "*" || got[1] != "kube-system" {
+		t.Fatalf("unexpected namespaces %v", got)
+	}
+
+	state.handleKey("n", 24)
+	if state.namespace != "kube-system" {
+		t.Fatalf("expected namespace kube-system, got %q", state.namespace)
+	}
+	state.handleKey("n", 24)
+	if state.namespace != "*" {
+		t.Fatalf("expected namespace to wrap to *, got %q", state.namespace)
+	}
+
+	state.handleKey(">", 24)
+	state.handleKey("r", 24)
+	out := state.render(120, 10)
+	if !strings.Contains(out, "Available^") {
+		t.Fatalf("expected ascending sort marker on Available, got %q", out)
+	}
+	if !strings.Contains(out, "metrics-server") {
+		t.Fatalf("expected deployment row, got %q", out)
+	}
+}
+
+func TestUIStateRendersBeforeFirstScrape(t *testing.T) {
+	state := newUIState("*", 10)
+
+	for _, key := range []string{"1", uiKeyDown, "2", uiKeyEnter, "3", "s"} {
+		state.handleKey(key, 24)
+		if out := state.render(80, 24); !strings.Contains(out, "Namespace") && !strings.Contains(out, "Node") {
+			t.Fatalf("expected table headers before the first scrape, got %q", out)
+		}
+	}
+
+	state.update(nil, errors.New("connection refused"))
+	if out := state.render(80, 24); !strings.Contains(out, "error: connection") {
+		t.Fatalf("expected the scrape error to be shown, got %q", out)
+	}
+}
@@ -0,0 +1,364 @@
+/*
+ * Copyright 2018 Paul Welch
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License"); you may not use this file except in compliance with the License. You may obtain a copy of the License at
+ *
+ * http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software distributed under the License is distributed on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the License for the specific language governing permissions and limitations under the License.
+ */
+
+package cmd
+
+import (
+	"bytes"
+	"fmt"
+	"sort"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	dto "github.com/prometheus/client_model/go"
+
+	"github.com/paulwelch/kubestate/pkg/kubestate"
+)
+
+const (
+	uiPods = iota
+	uiNodes
+	uiDeployments
+)
+
+var uiTabNames = []string{"pods", "nodes", "deployments"}
+
+const (
+	uiKeyUp       = "\x1b[A"
+	uiKeyDown     = "\x1b[B"
+	uiKeyRight    = "\x1b[C"
+	uiKeyLeft     = "\x1b[D"
+	uiKeyPageUp   = "\x1b[5~"
+	uiKeyPageDown = "\x1b[6~"
+	uiKeyEnter    = "\r"
+	uiKeyEscape   = "\x1b"
+	uiKeyTab      = "\t"
+	uiKeyCtrlC    = "\x03"
+	uiKeyDelete   = "\x7f"
+)
+
+type uiRow struct {
+	cells           []string
+	values          []float64
+	namespace, node string
+}
+
+type uiTable struct {
+	headers []string
+	numeric []bool
+	rows    []*uiRow
+}
+
+type uiState struct {
+	cluster    *kubestate.Cluster
+	err        error
+	updated    time.Time
+	interval   int
+	tab        int
+	namespace  string
+	namespaces []string
+	node       string
+	sortCol    [3]int
+	sortDesc   [3]bool
+	cursor     int
+	offset     int
+}
+
+func newUIState(namespaceFlag string, interval int) *uiState {
+	return &uiState{
+		// an empty cluster until the first scrape succeeds, so the first frame renders empty tables
+		cluster:   kubestate.NewCluster(nil),
+		interval:  interval,
+		namespace: namespaceFlag,
+		sortCol:   [3]int{8, 7, 2},
+		sortDesc:  [3]bool{true, true, true},
+	}
+}
+
+// update replaces the scraped families; all tabs are built from this one fetch, indexed once.
+func (s *uiState) update(metricFamilies []*dto.MetricFamily, err error) {
+	s.err = err
+	if err != nil {
+		return
+	}
+	s.cluster = kubestate.NewCluster(metricFamilies)
+	s.updated = time.Now()
+
+	seen := map[string]bool{}
+	s.namespaces = []string{"*"}
+	for _, v := range s.cluster.PodResources(kubestate.AllNamespaces) {
+		seen[v.Namespace] = true
+	}
+	for _, v := range s.cluster.TopDeployments(kubestate.AllNamespaces) {
+		seen[v.Namespace] = true
+	}
+	names := make([]string, 0, len(seen))
+	for ns := range seen {
+		names = append(names, ns)
+	}
+	sort.Strings(names)
+	s.namespaces = append(s.namespaces, names...)
+}
+
+func (s *uiState) table() *uiTable {
+	var t *uiTable
+	switch s.tab {
+	case uiPods:
+		t = s.podsTable()
+	case uiNodes:
+		t = s.nodesTable()
+	default:
+		t = s.deploymentsTable()
+	}
+
+	col, desc := s.sortCol[s.tab], s.sortDesc[s.tab]
+	sort.Slice(t.rows, func(i, j int) bool {
+		a, b := t.rows[i], t.rows[j]
+		if t.numeric[col] && a.values[col] != b.values[col] {
+			return (a.values[col] < b.values[col]) != desc
+		}
+		if !t.numeric[col] && a.cells[col] != b.cells[col] {
+			return (a.cells[col] < b.cells[col]) != desc
+		}
+		//rows come from map iteration, so break ties on the whole row to keep refreshes stable
+		return strings.Join(a.cells, "\t") < strings.Join(b.cells, "\t")
+	})
+
+	return t
+}
+
+func (s *uiState) podsTable() *uiTable {
+	t := &uiTable{
+		headers: []string{"Namespace", "Pod", "Container", "CPU Req", "CPU Lim", "Mem Req", "Mem Lim", "Node", "Load"},
+		numeric: []bool{false, false, false, true, true, true, true, false, true},
+	}
+
+	for _, p := range s.cluster.PodResources(s.namespace) {
+		if s.node != "" && p.Node != s.node {
+			continue
+		}
+		t.rows = append(t.rows, &uiRow{
+			cells: []string{
+				p.Namespace, p.Pod, p.Container,
+				fmt.Sprintf("%.0fm", p.CPURequest*1000), fmt.Sprintf("%.0fm", p.CPULimit*1000),
+				fmt.Sprintf("%.0fMi", p.MemoryRequest/1048576), fmt.Sprintf("%.0fMi", p.MemoryLimit/1048576),
+				p.Node, fmt.Sprintf("%.0f%%", p.Load*100),
+			},
+			values:    []float64{0, 0, 0, p.CPURequest, p.CPULimit, p.MemoryRequest, p.MemoryLimit, 0, p.Load},
+			namespace: p.Namespace,
+			node:      p.Node,
+		})
+	}
+
+	return t
+}
+
+func (s *uiState) nodesTable() *uiTable {
+	t := &uiTable{
+		headers: []string{"Node", "CPU Req", "CPU Lim", "CPU Cap", "Mem Req", "Mem Lim", "Mem Cap", "Load"},
+		numeric: []bool{false, true, true, true, true, true, true, true},
+	}
+
+	for _, v := range s.cluster.NodeResources(s.namespace) {
+		t.rows = append(t.rows, &uiRow{
+			cells: []string{
+				v.Node,
+				fmt.Sprintf("%.0fm", v.CPURequest*1000), fmt.Sprintf("%.0fm", v.CPULimit*1000), fmt.Sprintf("%.0fm", v.CPUCapacity*1000),
+				fmt.Sprintf("%.0fMi", v.MemoryRequest/1048576), fmt.Sprintf("%.0fMi", v.MemoryLimit/1048576), fmt.Sprintf("%.0fMi", v.MemoryCapacity/1048576),
+				fmt.Sprintf("%.0f%%", v.Load*100),
+			},
+			values: []float64{0, v.CPURequest, v.CPULimit, v.CPUCapacity, v.MemoryRequest, v.MemoryLimit, v.MemoryCapacity, v.Load},
+			node:   v.Node,
+		})
+	}
+
+	return t
+}
+
+func (s *uiState) deploymentsTable() *uiTable {
+	t := &uiTable{
+		headers: []string{"Namespace", "Deployment", "Requested", "Available", "Unavailable"},
+		numeric: []bool{false, false, true, true, true},
+	}
+
+	for _, v := range s.cluster.TopDeployments(s.namespace) {
+		t.rows = append(t.rows, &uiRow{
+			cells: []string{
+				v.Namespace, v.Deployment,
+				fmt.Sprintf("%.0f", v.Requested), fmt.Sprintf("%.0f", v.Available), fmt.Sprintf("%.0f", v.Unavailable),
+			},
+			values:    []float64{0, 0, v.Requested, v.Available, v.Unavailable},
+			namespace: v.Namespace,
+		})
+	}
+
+	return t
+}
+
+// handleKey applies one keypress and reports whether the ui should exit.
+func (s *uiState) handleKey(key string, height int) bool {
+	t := s.table()
+	page := s.pageSize(height)
+
+	switch key {
+	case "q", uiKeyCtrlC:
+		return true
+	case uiKeyTab:
+		s.setTab((s.tab + 1) % len(uiTabNames))
+	case "1", "2", "3":
+		s.setTab(int(key[0] - '1'))
+	case uiKeyRight, ">":
+		s.sortCol[s.tab] = (s.sortCol[s.tab] + 1) % len(t.headers)
+	case uiKeyLeft, "<":
+		s.sortCol[s.tab] = (s.sortCol[s.tab] + len(t.headers) - 1) % len(t.headers)
+	case "r":
+		s.sortDesc[s.tab] = !s.sortDesc[s.tab]
+	case "n":
+		next := "*"
+		for i, ns := range s.namespaces {
+			if ns == s.namespace {
+				next = s.namespaces[(i+1)%len(s.namespaces)]
+				break
+			}
+		}
+		s.namespace = next
+		s.cursor, s.offset = 0, 0
+	case uiKeyDown, "j":
+		s.cursor++
+	case uiKeyUp, "k":
+		s.cursor--
+	case uiKeyPageDown, " ":
+		s.cursor += page
+	case uiKeyPageUp:
+		s.cursor -= page
+	case uiKeyEnter:
+		if s.tab == uiNodes && s.cursor < len(t.rows) {
+			s.node = t.rows[s.cursor].node
+			s.setTab(uiPods)
+		}
+	case uiKeyEscape, uiKeyDelete:
+		s.node = ""
+		s.cursor, s.offset = 0, 0
+	}
+
+	s.clampCursor(len(s.table().rows), page)
+
+	return false
+}
+
+func (s *uiState) setTab(tab int) {
+	s.tab = tab
+	s.cursor, s.offset = 0, 0
+}
+
+func (s *uiState) pageSize(height int) int {
+	// title, table header and help lines
+	if height-3 < 1 {
+		return 1
+	}
+	return height - 3
+}
+
+func (s *uiState) clampCursor(rows, page int) {
+	if s.cursor >= rows {
+		s.cursor = rows - 1
+	}
+	if s.cursor < 0 {
+		s.cursor = 0
+	}
+	if s.cursor < s.offset {
+		s.offset = s.cursor
+	}
+	if s.cursor >= s.offset+page {
+		s.offset = s.cursor - page + 1
+	}
+}
+
+// render draws the current tab as a full screen frame of at most height lines.
+func (s *uiState) render(width, height int) string {
+	t := s.table()
+	page := s.pageSize(height)
+	s.clampCursor(len(t.rows), page)
+
+	var title strings.Builder
+	title.WriteString("kubestate ui ")
+	for i, name := range uiTabNames {
+		if i == s.tab {
+			fmt.Fprintf(&title, " [%d:%s]", i+1, name)
+		} else {
+			fmt.Fprintf(&title, "  %d:%s ", i+1, name)
+		}
+	}
+	fmt.Fprintf(&title, "  namespace=%s", s.namespace)
+	if s.node != "" {
+		fmt.Fprintf(&title, " node=%s", s.node)
+	}
+	if s.err != nil {
+		fmt.Fprintf(&title, "  error: %v", s.err)
+	} else if !s.updated.IsZero() {
+		fmt.Fprintf(&title, "  updated %s (interval=%ds)", s.updated.Format("15:04:05"), s.interval)
+	}
+
+	headers := make([]string, len(t.headers))
+	copy(headers, t.headers)
+	arrow := "^"
+	if s.sortDesc[s.tab] {
+		arrow = "v"
+	}
+	headers[s.sortCol[s.tab]] += arrow
+
+	var buf bytes.Buffer
+	w := new(tabwriter.Writer)
+	w.Init(&buf, 4, 1, 1, ' ', 0)
+	fmt.Fprintln(w, strings.Join(headers, "\t"))
+	for _, r := range t.rows {
+		fmt.Fprintln(w, strings.Join(r.cells, "\t"))
+	}
+	w.Flush()
+	lines := strings.Split(strings.TrimRight(buf.String(), "\n"), "\n")
+
+	var b strings.Builder
+	b.WriteString(uiClip(title.String(), width))
+	b.WriteString("\r\n")
+	b.WriteString(uiClip(lines[0], width))
+	b.WriteString("\r\n")
+
+	rows := lines[1:]
+	for i := s.offset; i < len(rows) && i < s.offset+page; i++ {
+		line := uiClip(rows[i], width)
+		if i == s.cursor {
+			line = "\x1b[7m" + line + "\x1b[0m"
+		}
+		b.WriteString(line)
+		b.WriteString("\r\n")
+	}
+	for i := len(rows) - s.offset; i < page; i++ {
+		b.WriteString("\r\n")
+	}
+
+	help := "q quit  tab/1-3 view  </> sort column  r reverse  n namespace  j/k scroll"
+	if s.tab == uiNodes {
+		help += "  enter node pods"
+	}
+	if s.node != "" {
+		help += "  esc clear node"
+	}
+	b.WriteString(uiClip(help, width))
+
+	return b.String()
+}
+
+func uiClip(line string, width int) string {
+	if width > 0 && len(line) > width {
+		return line[:width]
+	}
+	return line
+}
@@ -0,0 +1,279 @@
+/*
+ * Copyright 2018 Paul Welch
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License"); you may not use this file except in compliance with the License. You may obtain a copy of the License at
+ *
+ * http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software distributed under the License is distributed on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the License for the specific language governing permissions and limitations under the License.
+ */
+
+package cmd
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	dto "github.com/prometheus/client_model/go"
+	"github.com/urfave/cli/v2"
+)
+
+type labelMatcher struct {
+	name, op, value string
+	re              *regexp.Regexp
+}
+
+// condition is a single series selector compared against a threshold, e.g. `metric{label="v"} == 0`.
+type condition struct {
+	metric    string
+	matchers  []labelMatcher
+	op        string
+	threshold float64
+}
+
+var comparators = []string{"==", "!=", ">=", "<=", ">", "<"}
+
+func Wait(c *cli.Context) error {
+	interval := c.Int("interval")
+	if interval < 1 {
+		return cli.Exit("interval must be >= 1", 2)
+	}
+
+	expr := c.String("for")
+	cond, err := parseCondition(expr)
+	if err != nil {
+		return cli.Exit(fmt.Sprintf("invalid --for expression: %v", err), 2)
+	}
+
+	opts := clientOptions(c)
+	namespace := c.String("namespace")
+
+	// scrapes fail transiently during the rollouts being waited on, so errors are reported and
+	// polling continues; only invalid flags end the wait early
+	var lastErr error
+	err = pollLoop(c.Context, time.Duration(interval)*time.Second, c.Duration("timeout"), func(ctx context.Context) (bool, error) {
+		metricFamilies, err := getMetricsFn(ctx, opts)
+		if err != nil {
+			if exitErr, ok := err.(cli.ExitCoder); ok && exitErr.ExitCode() == 2 {
+				return false, err
+			}
+			if ctx.Err() == nil {
+				fmt.Fprintln(os.Stderr, err)
+				lastErr = err
+			}
+			return false, nil
+		}
+		lastErr = nil
+		return cond.holds(metricFamilies, namespace), nil
+	})
+
+	switch {
+	case errors.Is(err, errPollTimeout) && lastErr != nil:
+		return cli.Exit(fmt.Sprintf("timed out waiting for %s: %v", expr, lastErr), 1)
+	case errors.Is(err, errPollTimeout):
+		return cli.Exit(fmt.Sprintf("timed out waiting for %s", expr), 1)
+	case errors.Is(err, errPollInterrupted):
+		return cli.Exit(fmt.Sprintf("interrupted waiting for %s", expr), 1)
+	case err != nil:
+		return err
+	}
+
+	fmt.Printf("condition met: %s\n", expr)
+	return nil
+}
+
+// holds reports whether at least one series matches and every matching series satisfies the comparison.
+func (cond *condition) holds(metricFamilies []*dto.MetricFamily, namespaceFlag string) bool {
+	matched := cond.series(metricFamilies, namespaceFlag)
+	for _, s := range matched {
+		if !compare(cond.op, s.value, cond.threshold) {
+			return false
+		}
+	}
+	return len(matched) > 0
+}
+
+// series returns every sample matching the selector, regardless of the comparison.
+func (cond *condition) series(metricFamilies []*dto.MetricFamily, namespaceFlag string) []*seriesSample {
+	matched := make([]*seriesSample, 0)
+	for _, mf := range metricFamilies {
+		if mf.GetName() != cond.metric {
+			continue
+		}
+		for _, m := range mf.Metric {
+			labels, ok := matchLabels(m, cond.matchers, namespaceFlag)
+			if !ok {
+				continue
+			}
+			matched = append(matched, &seriesSample{
+				metric:  mf.GetName(),
+				labels:  labels,
+				value:   seriesValue(m),
+				counter: mf.GetType() == dto.MetricType_COUNTER,
+			})
+		}
+	}
+	return matched
+}
+
+func matchLabels(m *dto.Metric, matchers []labelMatcher, namespaceFlag string) (map[string]string, bool) {
+	labels := make(map[string]string, len(m.Label))
+	for _, l := range m.Label {
+		labels[l.GetName()] = l.GetValue()
+	}
+
+	if namespaceFlag != "*" && labels["namespace"] != namespaceFlag {
+		return nil, false
+	}
+
+	for _, lm := range matchers {
+		v := labels[lm.name]
+		switch lm.op {
+		case "=":
+			if v != lm.value {
+				return nil, false
+			}
+		case "!=":
+			if v == lm.value {
+				return nil, false
+			}
+		case "=~":
+			if !lm.re.MatchString(v) {
+				return nil, false
+			}
+		case "!~":
+			if lm.re.MatchString(v) {
+				return nil, false
+			}
+		}
+	}
+
+	return labels, true
+}
+
+func compare(op string, value, threshold float64) bool {
+	switch op {
+	case "==":
+		return value == threshold
+	case "!=":
+		return value != threshold
+	case ">":
+		return value > threshold
+	case ">=":
+		return value >= threshold
+	case "<":
+		return value < threshold
+	case "<=":
+		return value <= threshold
+	}
+	return false
+}
+
+func parseCondition(expr string) (*condition, error) {
+	cond := &condition{}
+
+	rest := strings.TrimSpace(expr)
+	name, rest := scanMetricName(rest)
+	if name == "" {
+		return nil, fmt.Errorf("expected metric name in %q", expr)
+	}
+	cond.metric = name
+
+	if strings.HasPrefix(rest, "{") {
+		matchers, remaining, err := parseMatchers(rest[1:])
+		if err != nil {
+			return nil, err
+		}
+		cond.matchers = matchers
+		rest = remaining
+	}
+
+	rest = strings.TrimSpace(rest)
+	for _, op := range comparators {
+		if strings.HasPrefix(rest, op) {
+			cond.op = op
+			rest = rest[len(op):]
+			break
+		}
+	}
+	if cond.op == "" {
+		return nil, fmt.Errorf("expected one of %s after selector", strings.Join(comparators, ", "))
+	}
+
+	threshold, err := strconv.ParseFloat(strings.TrimSpace(rest), 64)
+	if err != nil {
+		return nil, fmt.Errorf("invalid threshold %q", strings.TrimSpace(rest))
+	}
+	cond.threshold = threshold
+
+	return cond, nil
+}
+
+func scanMetricName(s string) (string, string) {
+	i := 0
+	for i < len(s) {
+		ch := s[i]
+		if ch == '_' || ch == ':' || (ch >= 'a' && ch <= 'z') || (ch >= 'A' && ch <= 'Z') || (i > 0 && ch >= '0' && ch <= '9') {
+			i++
+			continue
+		}
+		break
+	}
+	return s[:i], s[i:]
+}
+
+// parseMatchers parses label matchers up to and including the closing brace, returning the remaining input.
+func parseMatchers(s string) ([]labelMatcher, string, error) {
+	matchers := make([]labelMatcher, 0)
+
+	for {
+		s = strings.TrimLeft(s, " ,")
+		if strings.HasPrefix(s, "}") {
+			return matchers, s[1:], nil
+		}
+		if s == "" {
+			return nil, "", fmt.Errorf("missing closing brace in label matchers")
+		}
+
+		name, rest := scanMetricName(s)
+		if name == "" {
+			return nil, "", fmt.Errorf("expected label name at %q", s)
+		}
+		rest = strings.TrimSpace(rest)
+
+		lm := labelMatcher{name: name}
+		for _, op := range []string{"=~", "!~", "!=", "="} {
+			if strings.HasPrefix(rest, op) {
+				lm.op = op
+				rest = strings.TrimSpace(rest[len(op):])
+				break
+			}
+		}
+		if lm.op == "" {
+			return nil, "", fmt.Errorf("expected =, !=, =~ or !~ after label %q", name)
+		}
+
+		quoted, err := strconv.QuotedPrefix(rest)
+		if err != nil {
+			return nil, "", fmt.Errorf("expected quoted value for label %q", name)
+		}
+		lm.value, _ = strconv.Unquote(quoted)
+		rest = rest[len(quoted):]
+
+		if lm.op == "=~" || lm.op == "!~" {
+			lm.re, err = regexp.Compile("^(?:" + lm.value + ")$")
+			if err != nil {
+				return nil, "", fmt.Errorf("invalid regular expression for label %q: %v", name, err)
+			}
+		}
+
+		matchers = append(matchers, lm)
+		s = rest
+	}
+}
@@ -0,0 +1,113 @@
+package cmd
+
+import (
+	"testing"
+
+	dto "github.com/prometheus/client_model/go"
+)
+
+func TestParseCondition(t *testing.T) {
+	tests := []struct {
+		name      string
+		expr      string
+		wantErr   bool
+		metric    string
+		matchers  int
+		op        string
+		threshold float64
+	}{
+		{
+			name:      "selector with label",
+			expr:      `kube_deployment_status_replicas_unavailable{deployment="api"} == 0`,
+			metric:    "kube_deployment_status_replicas_unavailable",
+			matchers:  1,
+			op:        "==",
+			threshold: 0,
+		},
+		{
+			name:      "bare metric",
+			expr:      `kube_node_status_condition>=1`,
+			metric:    "kube_node_status_condition",
+			op:        ">=",
+			threshold: 1,
+		},
+		{
+			name:      "multiple matchers with regex and escaped quote",
+			expr:      `kube_pod_info{namespace=~"kube-.*", pod!="a\"b"} < 2.5`,
+			metric:    "kube_pod_info",
+			matchers:  2,
+			op:        "<",
+			threshold: 2.5,
+		},
+		{
+			name:    "missing comparator",
+			expr:    `kube_pod_info{pod="x"}`,
+			wantErr: true,
+		},
+		{
+			name:    "unterminated matchers",
+			expr:    `kube_pod_info{pod="x" == 1`,
+			wantErr: true,
+		},
+		{
+			name:    "unquoted label value",
+			expr:    `kube_pod_info{pod=x} == 1`,
+			wantErr: true,
+		},
+		{
+			name:    "bad threshold",
+			expr:    `kube_pod_info == one`,
+			wantErr: true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := parseCondition(tt.expr)
+			if tt.wantErr {
+				if err == nil {
+					t.Fatalf("expected error for %q", tt.expr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if got.metric != tt.metric || len(got.matchers) != tt.matchers || got.op != tt.op || got.threshold != tt.threshold {
+				t.Fatalf("got %+v", got)
+			}
+		})
+	}
+}
+
+func TestConditionHolds(t *testing.T) {
+	families := []*dto.MetricFamily{
+		newMetricFamily("kube_deployment_status_replicas_unavailable", []*dto.Metric{
+			newGaugeMetric(0, map[string]string{"namespace": "default", "deployment": "api"}),
+			newGaugeMetric(1, map[string]string{"namespace": "default", "deployment": "worker"}),
+			newGaugeMetric(2, map[string]string{"namespace": "staging", "deployment": "api"}),
+		}),
+	}
+
+	tests := []struct {
+		expr      string
+		namespace string
+		want      bool
+	}{
+		{`kube_deployment_status_replicas_unavailable{deployment="api"} == 0`, "default", true},
+		{`kube_deployment_status_replicas_unavailable{deployment="api"} == 0`, "*", false},
+		{`kube_deployment_status_replicas_unavailable{deployment=~"api|worker"} <= 1`, "default", true},
+		{`kube_deployment_status_replicas_unavailable{deployment!="api"} > 0`, "*", true},
+		{`kube_deployment_status_replicas_unavailable{deployment="missing"} == 0`, "*", false},
+	}
+
+	for _, tt := range tests {
+		cond, err := parseCondition(tt.expr)
+		if err != nil {
+			t.Fatalf("parseCondition(%q): %v", tt.expr, err)
+		}
+		if got := cond.holds(families, tt.namespace); got != tt.want {
+			t.Fatalf("%q in namespace %q: got %v want %v", tt.expr, tt.namespace, got, tt.want)
+		}
+	}
+}
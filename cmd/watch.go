@@ -11,12 +11,23 @@
 package cmd
 
 import (
+	"bytes"
+	"context"
+	"errors"
 	"fmt"
+	"io"
 	"os"
-	"os/signal"
+	"strings"
 	"time"
 
 	"github.com/urfave/cli/v2"
+
+	"github.com/paulwelch/kubestate/pkg/kubestate"
+)
+
+var (
+	errPollInterrupted = errors.New("interrupted")
+	errPollTimeout     = errors.New("timed out")
 )
 
 func Watch(c *cli.Context) error {
@@ -25,38 +36,229 @@ func Watch(c *cli.Context) error {
 		return cli.Exit("interval must be >= 1", 2)
 	}
 
-	config := c.String("config")
+	opts := clientOptions(c)
 	output := c.String("output")
 	metric := c.String("metric")
 	namespace := c.String("namespace")
-	metricsNamespace := c.String("metrics-namespace")
-	insecureSkipTLSVerify := c.Bool("insecure-skip-tls-verify")
 
-	interrupt := make(chan os.Signal, 1)
-	signal.Notify(interrupt, os.Interrupt)
-	defer signal.Stop(interrupt)
+	changes := c.Bool("changes")
+	rate := c.Bool("rate")
+	view := watchView(c)
 
-	ticker := time.NewTicker(time.Duration(interval) * time.Second)
-	defer ticker.Stop()
+	// each mode owns stdout, so only one may be chosen
+	var modes []string
+	for _, mode := range []struct {
+		flag string
+		set  bool
+	}{{"--alerts", c.String("alerts") != ""}, {"--changes", changes}, {"--rate", rate}} {
+		if mode.set {
+			modes = append(modes, mode.flag)
+		}
+	}
+	if len(modes) > 1 {
+		return cli.Exit(fmt.Sprintf("%s cannot be combined", strings.Join(modes, " and ")), 2)
+	}
+	if len(modes) == 1 && view != "" {
+		return cli.Exit(fmt.Sprintf("%s cannot be combined with watching %s", modes[0], view), 2)
+	}
+
+	var evaluator *alertEvaluator
+	if path := c.String("alerts"); path != "" {
+		rules, err := loadAlertRules(path)
+		if err != nil {
+			return cli.Exit(err.Error(), 2)
+		}
+		evaluator = newAlertEvaluator(rules)
+	}
+
+	var notifier *webhookNotifier
+	if url := c.String("webhook"); url != "" {
+		if evaluator == nil && !changes {
+			return cli.Exit("--webhook requires --alerts or --changes", 2)
+		}
+		var err error
+		notifier, err = newWebhookNotifier(url, c.String("webhook-format"), c.Duration("webhook-dedup"))
+		if err != nil {
+			return cli.Exit(err.Error(), 2)
+		}
+	}
+
+	var previous map[string]bool
+	var previousSeries seriesSnapshot
+	var previousAt time.Time
+
+	run := func(ctx context.Context) error {
+		if evaluator != nil {
+			metricFamilies, err := getMetricsFn(ctx, opts)
+			if err != nil {
+				return err
+			}
+			now := time.Now()
+			transitions := evaluator.evaluate(metricFamilies, namespace, now)
+			evaluator.reportAlertTransitions(ctx, os.Stdout, os.Stderr, transitions)
+			notifyWebhook(ctx, notifier, transitions, nil, now)
+			return nil
+		}
+
+		if rate {
+			metricFamilies, err := getMetricsFn(ctx, opts)
+			if err != nil {
+				return err
+			}
+			now := time.Now()
+			current := snapshotSeries(metricFamilies, metric, namespace)
+
+			fmt.Print("\x1bc")
+			fmt.Printf("kubestate watch --rate (interval=%ds)\n\n", interval)
+			if previousSeries == nil {
+				fmt.Println("waiting for a second sample")
+			} else {
+				renderSeriesRates(os.Stdout, seriesRates(previousSeries, current, metric == "*"), now.Sub(previousAt))
+			}
+			previousSeries, previousAt = current, now
+			return nil
+		}
+
+		if changes {
+			metricFamilies, err := getMetricsFn(ctx, opts)
+			if err != nil {
+				return err
+			}
+			now := time.Now()
+			current := snapshotSeries(metricFamilies, metric, namespace)
+			events := diffSeries(previousSeries, current, now)
+			// the first scrape reports every series as added; only notify on real changes
+			if previousSeries != nil {
+				notifyWebhook(ctx, notifier, nil, events, now)
+			}
+			previousSeries = current
+			return writeSeriesEvents(os.Stdout, events)
+		}
+
+		if view == "" {
+			fmt.Print("\x1bc")
+			fmt.Printf("kubestate watch (interval=%ds)\n\n", interval)
+			return executeGetFn(ctx, opts, output, metric, namespace)
+		}
+
+		metricFamilies, err := getMetricsFn(ctx, opts)
+		if err != nil {
+			return err
+		}
+
+		var buf bytes.Buffer
+		if view == "summary" {
+			printSummary(&buf, summarize(kubestate.NewCluster(metricFamilies), namespace))
+		} else {
+			renderTop(&buf, view, metricFamilies, namespace)
+		}
 
-	run := func() error {
 		fmt.Print("\x1bc")
-		fmt.Printf("kubestate watch (interval=%ds)\n\n", interval)
-		return executeGetFn(config, output, metric, namespace, metricsNamespace, insecureSkipTLSVerify)
+		fmt.Printf("kubestate watch %s (interval=%ds)\n\n", view, interval)
+		previous = highlightChanges(os.Stdout, buf.String(), previous)
+		return nil
 	}
 
-	if err := run(); err != nil {
-		return err
+	// with --alerts the watch runs unattended as a notifier, so failed scrapes are reported and
+	// retried on the next refresh; only invalid flags end it
+	err := pollLoop(c.Context, time.Duration(interval)*time.Second, 0, func(ctx context.Context) (bool, error) {
+		err := run(ctx)
+		if err != nil && evaluator != nil && ctx.Err() == nil {
+			if exitErr, ok := err.(cli.ExitCoder); !ok || exitErr.ExitCode() != 2 {
+				fmt.Fprintln(os.Stderr, err)
+				return false, nil
+			}
+		}
+		return false, err
+	})
+	if errors.Is(err, errPollInterrupted) {
+		return nil
 	}
+	return err
+}
+
+// pollLoop calls run immediately and then every interval until it reports done or returns an error.
+// A timeout of zero polls until ctx is cancelled. The context passed to run is cancelled on
+// interrupt or timeout, so an in-flight fetch is aborted rather than waited for.
+func pollLoop(ctx context.Context, interval, timeout time.Duration, run func(context.Context) (bool, error)) error {
+	if timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, timeout)
+		defer cancel()
+	}
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
 
 	for {
-		select {
-		case <-interrupt:
+		done, err := run(ctx)
+		if err == nil && done {
 			return nil
+		}
+		// errors from an aborted fetch are reported as the interrupt or timeout that caused them
+		if ctx.Err() != nil {
+			return pollContextErr(ctx)
+		}
+		if err != nil {
+			return err
+		}
+
+		select {
+		case <-ctx.Done():
+			return pollContextErr(ctx)
 		case <-ticker.C:
-			if err := run(); err != nil {
-				return err
-			}
 		}
 	}
 }
+
+func pollContextErr(ctx context.Context) error {
+	if errors.Is(ctx.Err(), context.DeadlineExceeded) {
+		return errPollTimeout
+	}
+	return errPollInterrupted
+}
+
+// notifyWebhook reports delivery failures without stopping the watch.
+func notifyWebhook(ctx context.Context, notifier *webhookNotifier, alerts []*alertTransition, changes []*seriesEvent, now time.Time) {
+	if notifier == nil {
+		return
+	}
+	if err := notifier.notify(ctx, alerts, changes, now); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+	}
+}
+
+// watchView returns the top or summary view being watched, or "" when watching get output.
+func watchView(c *cli.Context) string {
+	if c.Command == nil {
+		return ""
+	}
+	switch c.Command.Name {
+	case "pods", "deployments", "nodes", "summary":
+		return c.Command.Name
+	}
+	return ""
+}
+
+// highlightChanges writes the rendered view, highlighting rows that were not in the previous tick,
+// and returns the rows to compare against on the next tick.
+func highlightChanges(out io.Writer, rendered string, previous map[string]bool) map[string]bool {
+	current := make(map[string]bool)
+
+	for _, line := range strings.SplitAfter(rendered, "\n") {
+		if line == "" {
+			continue
+		}
+		//compare on fields so column width changes don't count as a change
+		key := strings.Join(strings.Fields(line), " ")
+		current[key] = true
+
+		if previous != nil && key != "" && !previous[key] {
+			fmt.Fprintf(out, "\x1b[7m%s\x1b[0m\n", strings.TrimSuffix(line, "\n"))
+		} else {
+			fmt.Fprint(out, line)
+		}
+	}
+
+	return current
+}
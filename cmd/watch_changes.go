@@ -0,0 +1,160 @@
+/*
+ * Copyright 2018 Paul Welch
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License"); you may not use this file except in compliance with the License. You may obtain a copy of the License at
+ *
+ * http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software distributed under the License is distributed on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the License for the specific language governing permissions and limitations under the License.
+ */
+
+package cmd
+
+import (
+	"io"
+	"math"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/json-iterator/go"
+	dto "github.com/prometheus/client_model/go"
+)
+
+type seriesEvent struct {
+	Time     string            `json:"time"`
+	Event    string            `json:"event"`
+	Metric   string            `json:"metric"`
+	Labels   map[string]string `json:"labels,omitempty"`
+	Value    *float64          `json:"value,omitempty"`
+	Previous *float64          `json:"previous,omitempty"`
+}
+
+type seriesSample struct {
+	metric  string
+	labels  map[string]string
+	value   float64
+	counter bool
+}
+
+// seriesSnapshot indexes one scrape by series identity (metric name and sorted labels).
+type seriesSnapshot map[string]*seriesSample
+
+func snapshotSeries(metricFamilies []*dto.MetricFamily, metricFilterFlag, namespaceFlag string) seriesSnapshot {
+	snapshot := make(seriesSnapshot)
+
+	for _, mf := range metricFamilies {
+		if metricFilterFlag != "*" && mf.GetName() != metricFilterFlag {
+			continue
+		}
+		for _, m := range mf.Metric {
+			labels := make(map[string]string, len(m.Label))
+			for _, l := range m.Label {
+				labels[l.GetName()] = l.GetValue()
+			}
+			if namespaceFlag != "*" && labels["namespace"] != namespaceFlag {
+				continue
+			}
+			snapshot[seriesID(mf.GetName(), labels)] = &seriesSample{
+				metric:  mf.GetName(),
+				labels:  labels,
+				value:   seriesValue(m),
+				counter: mf.GetType() == dto.MetricType_COUNTER,
+			}
+		}
+	}
+
+	return snapshot
+}
+
+func seriesID(name string, labels map[string]string) string {
+	keys := make([]string, 0, len(labels))
+	for k := range labels {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	var b strings.Builder
+	b.WriteString(name)
+	b.WriteString("{")
+	for i, k := range keys {
+		if i > 0 {
+			b.WriteString(",")
+		}
+		b.WriteString(k)
+		b.WriteString("=")
+		b.WriteString(strconv.Quote(labels[k]))
+	}
+	b.WriteString("}")
+
+	return b.String()
+}
+
+// seriesValue returns the sample value, using the observation count for summaries and histograms.
+func seriesValue(m *dto.Metric) float64 {
+	switch {
+	case m.Gauge != nil:
+		return m.Gauge.GetValue()
+	case m.Counter != nil:
+		return m.Counter.GetValue()
+	case m.Untyped != nil:
+		return m.Untyped.GetValue()
+	case m.Summary != nil:
+		return float64(m.Summary.GetSampleCount())
+	case m.Histogram != nil:
+		return float64(m.Histogram.GetSampleCount())
+	}
+	return 0
+}
+
+// diffSeries returns added, removed and changed series between two snapshots, ordered by series identity.
+func diffSeries(previous, current seriesSnapshot, now time.Time) []*seriesEvent {
+	ids := make([]string, 0, len(current)+len(previous))
+	for id := range current {
+		ids = append(ids, id)
+	}
+	for id := range previous {
+		if current[id] == nil {
+			ids = append(ids, id)
+		}
+	}
+	sort.Strings(ids)
+
+	timestamp := now.UTC().Format(time.RFC3339Nano)
+	events := make([]*seriesEvent, 0)
+	for _, id := range ids {
+		prev, cur := previous[id], current[id]
+		switch {
+		case prev == nil:
+			events = append(events, &seriesEvent{Time: timestamp, Event: "added", Metric: cur.metric, Labels: cur.labels, Value: eventValue(cur.value)})
+		case cur == nil:
+			events = append(events, &seriesEvent{Time: timestamp, Event: "removed", Metric: prev.metric, Labels: prev.labels, Previous: eventValue(prev.value)})
+		case prev.value != cur.value && !(math.IsNaN(prev.value) && math.IsNaN(cur.value)):
+			events = append(events, &seriesEvent{Time: timestamp, Event: "changed", Metric: cur.metric, Labels: cur.labels, Value: eventValue(cur.value), Previous: eventValue(prev.value)})
+		}
+	}
+
+	return events
+}
+
+// eventValue drops values JSON cannot represent.
+func eventValue(v float64) *float64 {
+	if math.IsNaN(v) || math.IsInf(v, 0) {
+		return nil
+	}
+	return &v
+}
+
+func writeSeriesEvents(out io.Writer, events []*seriesEvent) error {
+	for _, e := range events {
+		s, err := jsoniter.MarshalToString(e)
+		if err != nil {
+			return err
+		}
+		if _, err := io.WriteString(out, s+"\n"); err != nil {
+			return err
+		}
+	}
+	return nil
+}
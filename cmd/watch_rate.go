@@ -0,0 +1,71 @@
+/*
+ * Copyright 2018 Paul Welch
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License"); you may not use this file except in compliance with the License. You may obtain a copy of the License at
+ *
+ * http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software distributed under the License is distributed on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the License for the specific language governing permissions and limitations under the License.
+ */
+
+package cmd
+
+import (
+	"fmt"
+	"io"
+	"sort"
+	"text/tabwriter"
+	"time"
+)
+
+type seriesRate struct {
+	id           string
+	delta, value float64
+}
+
+// counterDelta is the increase between two samples, treating a decrease as a counter reset.
+func counterDelta(previous, current float64) float64 {
+	if current < previous {
+		return current
+	}
+	return current - previous
+}
+
+// seriesRates computes the delta of each series present in both snapshots, highest first.
+// Only counters are included unless countersOnly is false.
+func seriesRates(previous, current seriesSnapshot, countersOnly bool) []*seriesRate {
+	rates := make([]*seriesRate, 0, len(current))
+	for id, cur := range current {
+		prev := previous[id]
+		if prev == nil || (countersOnly && !cur.counter) {
+			continue
+		}
+		delta := cur.value - prev.value
+		if cur.counter {
+			delta = counterDelta(prev.value, cur.value)
+		}
+		rates = append(rates, &seriesRate{id, delta, cur.value})
+	}
+
+	sort.Slice(rates, func(i, j int) bool {
+		if rates[i].delta != rates[j].delta {
+			return rates[i].delta > rates[j].delta
+		}
+		return rates[i].id < rates[j].id
+	})
+
+	return rates
+}
+
+func renderSeriesRates(out io.Writer, rates []*seriesRate, elapsed time.Duration) {
+	w := new(tabwriter.Writer)
+	w.Init(out, 4, 1, 1, ' ', 0)
+
+	fmt.Fprintf(w, "%s\t%s\t%s\t%s\n", "Series", "Delta", "Rate (/s)", "Value")
+
+	for _, v := range rates {
+		fmt.Fprintf(w, "%s\t%g\t%.3f\t%g\n", v.id, v.delta, v.delta/elapsed.Seconds(), v.value)
+	}
+
+	w.Flush()
+}
@@ -0,0 +1,213 @@
+/*
+ * Copyright 2018 Paul Welch
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License"); you may not use this file except in compliance with the License. You may obtain a copy of the License at
+ *
+ * http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software distributed under the License is distributed on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the License for the specific language governing permissions and limitations under the License.
+ */
+
+package cmd
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/json-iterator/go"
+)
+
+const (
+	webhookAttempts = 3
+	webhookTimeout  = 10 * time.Second
+)
+
+// webhookPayload is the generic webhook schema.
+type webhookPayload struct {
+	Source  string             `json:"source"`
+	Time    string             `json:"time"`
+	Alerts  []*alertTransition `json:"alerts,omitempty"`
+	Changes []*seriesEvent     `json:"changes,omitempty"`
+}
+
+// slackPayload is accepted by Slack incoming webhooks and compatible chat services.
+type slackPayload struct {
+	Text string `json:"text"`
+}
+
+// errWebhookRejected is returned when the webhook refuses a payload it would refuse again.
+var errWebhookRejected = errors.New("webhook rejected the notifications")
+
+// webhookMaxPending bounds the notifications kept for retry while the webhook is failing.
+const webhookMaxPending = 1000
+
+// webhookNotifier posts alert transitions and series changes. Undelivered notifications stay
+// pending and are sent again with the next tick's, and a notification is only suppressed when
+// it repeats the state last delivered for the same rule and series within the dedup window.
+type webhookNotifier struct {
+	url    string
+	format string
+	dedup  time.Duration
+	client *http.Client
+
+	pending   []*webhookNotification
+	delivered map[string]deliveredState
+}
+
+// webhookNotification is one alert transition or series change awaiting delivery. key names
+// the rule and series, and state what was reported for it.
+type webhookNotification struct {
+	key, state string
+	alert      *alertTransition
+	change     *seriesEvent
+}
+
+type deliveredState struct {
+	state string
+	at    time.Time
+}
+
+func newWebhookNotifier(url, format string, dedup time.Duration) (*webhookNotifier, error) {
+	if format != "generic" && format != "slack" {
+		return nil, fmt.Errorf("invalid webhook format %q; valid formats are: generic, slack", format)
+	}
+	return &webhookNotifier{
+		url:       url,
+		format:    format,
+		dedup:     dedup,
+		client:    &http.Client{Timeout: webhookTimeout},
+		delivered: make(map[string]deliveredState),
+	}, nil
+}
+
+func (n *webhookNotifier) notify(ctx context.Context, alerts []*alertTransition, changes []*seriesEvent, now time.Time) error {
+	for key, d := range n.delivered {
+		if now.Sub(d.at) >= n.dedup {
+			delete(n.delivered, key)
+		}
+	}
+
+	for _, t := range alerts {
+		n.enqueue(&webhookNotification{key: "alert|" + t.Rule + "|" + t.Series, state: t.State, alert: t})
+	}
+	for _, e := range changes {
+		n.enqueue(&webhookNotification{key: "change|" + seriesID(e.Metric, e.Labels), state: e.Event + "|" + formatEventValue(e.Value), change: e})
+	}
+
+	if len(n.pending) == 0 {
+		return nil
+	}
+
+	payload := &webhookPayload{Source: "kubestate", Time: now.UTC().Format(time.RFC3339)}
+	lines := make([]string, 0, len(n.pending))
+	for _, p := range n.pending {
+		if t := p.alert; t != nil {
+			payload.Alerts = append(payload.Alerts, t)
+			lines = append(lines, fmt.Sprintf("%s %s %s = %g", strings.ToUpper(t.State), t.Rule, t.Series, t.Value))
+			continue
+		}
+		e := p.change
+		payload.Changes = append(payload.Changes, e)
+		line := fmt.Sprintf("%s %s", e.Event, seriesID(e.Metric, e.Labels))
+		if e.Value != nil {
+			line += " = " + formatEventValue(e.Value)
+		}
+		if e.Previous != nil {
+			line += " (was " + formatEventValue(e.Previous) + ")"
+		}
+		lines = append(lines, line)
+	}
+
+	var body interface{} = payload
+	if n.format == "slack" {
+		body = &slackPayload{Text: "kubestate\n" + strings.Join(lines, "\n")}
+	}
+	data, err := jsoniter.Marshal(body)
+	if err != nil {
+		return err
+	}
+
+	// on failure everything stays pending for the next tick, unless resending it is pointless
+	if err := n.post(ctx, data); err != nil {
+		if errors.Is(err, errWebhookRejected) {
+			n.pending = nil
+		}
+		return err
+	}
+
+	for _, p := range n.pending {
+		n.delivered[p.key] = deliveredState{p.state, now}
+	}
+	n.pending = nil
+
+	return nil
+}
+
+// enqueue adds p unless it repeats the latest state pending or delivered for its key.
+func (n *webhookNotifier) enqueue(p *webhookNotification) {
+	latest, ok := n.delivered[p.key]
+	for _, queued := range n.pending {
+		if queued.key == p.key {
+			latest, ok = deliveredState{state: queued.state}, true
+		}
+	}
+	if ok && latest.state == p.state {
+		return
+	}
+
+	if len(n.pending) >= webhookMaxPending {
+		n.pending = n.pending[1:]
+	}
+	n.pending = append(n.pending, p)
+}
+
+// post retries network errors, 429 and 5xx responses with a linear backoff, until ctx is done.
+// Other responses are reported as errWebhookRejected.
+func (n *webhookNotifier) post(ctx context.Context, data []byte) error {
+	var lastErr error
+	for attempt := 1; attempt <= webhookAttempts; attempt++ {
+		if attempt > 1 {
+			if err := sleepFn(ctx, time.Duration(attempt-1)*time.Second); err != nil {
+				return fmt.Errorf("Error sending webhook: %v", lastErr)
+			}
+		}
+
+		req, err := http.NewRequestWithContext(ctx, http.MethodPost, n.url, bytes.NewReader(data))
+		if err != nil {
+			return fmt.Errorf("Error sending webhook: %v", err)
+		}
+		req.Header.Set("Content-Type", "application/json")
+
+		resp, err := n.client.Do(req)
+		if err != nil {
+			lastErr = err
+			if ctx.Err() != nil {
+				break
+			}
+			continue
+		}
+		resp.Body.Close()
+
+		if resp.StatusCode >= 200 && resp.StatusCode < 300 {
+			return nil
+		}
+		lastErr = fmt.Errorf("webhook returned %s", resp.Status)
+		if resp.StatusCode != http.StatusTooManyRequests && resp.StatusCode < 500 {
+			return fmt.Errorf("Error sending webhook: %w (%s); dropping them", errWebhookRejected, resp.Status)
+		}
+	}
+
+	return fmt.Errorf("Error sending webhook: %v", lastErr)
+}
+
+func formatEventValue(v *float64) string {
+	if v == nil {
+		return ""
+	}
+	return fmt.Sprintf("%g", *v)
+}
@@ -0,0 +1,192 @@
+package cmd
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+type webhookReceiver struct {
+	server   *httptest.Server
+	bodies   []string
+	statuses []int
+}
+
+func newWebhookReceiver(t *testing.T, statuses ...int) *webhookReceiver {
+	t.Helper()
+	r := &webhookReceiver{statuses: statuses}
+	r.server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		body, _ := io.ReadAll(req.Body)
+		r.bodies = append(r.bodies, string(body))
+		status := http.StatusOK
+		if len(r.statuses) > 0 {
+			status, r.statuses = r.statuses[0], r.statuses[1:]
+		}
+		w.WriteHeader(status)
+	}))
+	t.Cleanup(r.server.Close)
+	return r
+}
+
+func stubSleep(t *testing.T) *[]time.Duration {
+	t.Helper()
+	var slept []time.Duration
+	original := sleepFn
+	sleepFn = func(_ context.Context, d time.Duration) error {
+		slept = append(slept, d)
+		return nil
+	}
+	t.Cleanup(func() { sleepFn = original })
+	return &slept
+}
+
+func TestWebhookNotifierGenericPayloadAndDedup(t *testing.T) {
+	receiver := newWebhookReceiver(t)
+	n, err := newWebhookNotifier(receiver.server.URL, "generic", 5*time.Minute)
+	if err != nil {
+		t.Fatalf("newWebhookNotifier returned error: %v", err)
+	}
+
+	firing := &alertTransition{Time: "2018-09-20T17:00:00Z", State: "firing", Rule: "deployment-unavailable", Series: `kube_deployment_status_replicas_unavailable{deployment="api"}`, Value: 1}
+	now := time.Date(2018, 9, 20, 17, 0, 0, 0, time.UTC)
+
+	if err := n.notify(context.Background(), []*alertTransition{firing}, nil, now); err != nil {
+		t.Fatalf("notify returned error: %v", err)
+	}
+	if err := n.notify(context.Background(), []*alertTransition{firing}, nil, now.Add(time.Minute)); err != nil {
+		t.Fatalf("notify returned error: %v", err)
+	}
+	if len(receiver.bodies) != 1 {
+		t.Fatalf("expected duplicate notification to be suppressed, got %d posts", len(receiver.bodies))
+	}
+
+	var payload webhookPayload
+	if err := json.Unmarshal([]byte(receiver.bodies[0]), &payload); err != nil {
+		t.Fatalf("invalid payload %q: %v", receiver.bodies[0], err)
+	}
+	if payload.Source != "kubestate" || len(payload.Alerts) != 1 || payload.Alerts[0].Rule != "deployment-unavailable" {
+		t.Fatalf("unexpected payload %+v", payload)
+	}
+
+	if err := n.notify(context.Background(), []*alertTransition{firing}, nil, now.Add(6*time.Minute)); err != nil {
+		t.Fatalf("notify returned error: %v", err)
+	}
+	if len(receiver.bodies) != 2 {
+		t.Fatalf("expected notification to be resent after dedup window, got %d posts", len(receiver.bodies))
+	}
+}
+
+func TestWebhookNotifierSlackPayloadWithRetries(t *testing.T) {
+	slept := stubSleep(t)
+	receiver := newWebhookReceiver(t, http.StatusServiceUnavailable, http.StatusTooManyRequests, http.StatusOK)
+	n, err := newWebhookNotifier(receiver.server.URL, "slack", time.Minute)
+	if err != nil {
+		t.Fatalf("newWebhookNotifier returned error: %v", err)
+	}
+
+	value, previous := 0.0, 1.0
+	change := &seriesEvent{Event: "changed", Metric: "kube_deployment_status_replicas_available", Labels: map[string]string{"deployment": "api"}, Value: &value, Previous: &previous}
+	if err := n.notify(context.Background(), nil, []*seriesEvent{change}, time.Now()); err != nil {
+		t.Fatalf("notify returned error: %v", err)
+	}
+
+	if len(receiver.bodies) != 3 || len(*slept) != 2 {
+		t.Fatalf("expected 3 attempts with 2 backoffs, got %d attempts and %v", len(receiver.bodies), *slept)
+	}
+	var payload slackPayload
+	if err := json.Unmarshal([]byte(receiver.bodies[2]), &payload); err != nil {
+		t.Fatalf("invalid payload %q: %v", receiver.bodies[2], err)
+	}
+	if !strings.Contains(payload.Text, `changed kube_deployment_status_replicas_available{deployment="api"} = 0 (was 1)`) {
+		t.Fatalf("unexpected slack text %q", payload.Text)
+	}
+}
+
+func TestWebhookNotifierGivesUpOnClientErrors(t *testing.T) {
+	stubSleep(t)
+	unavailable := http.StatusServiceUnavailable
+	receiver := newWebhookReceiver(t, http.StatusBadRequest, unavailable, unavailable, unavailable)
+	n, _ := newWebhookNotifier(receiver.server.URL, "generic", time.Minute)
+
+	firing := &alertTransition{State: "firing", Rule: "r", Series: "m{}", Value: 1}
+	err := n.notify(context.Background(), []*alertTransition{firing}, nil, time.Now())
+	if err == nil || !strings.Contains(err.Error(), "400") {
+		t.Fatalf("expected 400 error, got %v", err)
+	}
+	if len(receiver.bodies) != 1 {
+		t.Fatalf("expected no retry on 400, got %d attempts", len(receiver.bodies))
+	}
+	// the webhook would reject the same payload again, so it is dropped rather than resent
+	if err := n.notify(context.Background(), nil, nil, time.Now()); err != nil || len(receiver.bodies) != 1 {
+		t.Fatalf("expected the rejected notification to be dropped, got %d posts, %v", len(receiver.bodies), err)
+	}
+
+	resolved := &alertTransition{State: "resolved", Rule: "r", Series: "m{}", Value: 0}
+	if err := n.notify(context.Background(), []*alertTransition{resolved}, nil, time.Now()); err == nil {
+		t.Fatal("expected the delivery to fail while the webhook is unavailable")
+	}
+	if len(receiver.bodies) != 4 {
+		t.Fatalf("expected 3 attempts while unavailable, got %d posts", len(receiver.bodies)-1)
+	}
+
+	// the evaluator reports a transition once; the notifier must offer it again by itself
+	if err := n.notify(context.Background(), nil, nil, time.Now()); err != nil {
+		t.Fatalf("expected the retry to be delivered, got %v", err)
+	}
+	if len(receiver.bodies) != 5 || !strings.Contains(receiver.bodies[4], `"state":"resolved"`) {
+		t.Fatalf("expected the failed transition to be posted again, got %q", receiver.bodies)
+	}
+	if err := n.notify(context.Background(), nil, nil, time.Now()); err != nil || len(receiver.bodies) != 5 {
+		t.Fatalf("expected nothing left to send after delivery, got %d posts, %v", len(receiver.bodies), err)
+	}
+
+	if _, err := newWebhookNotifier(receiver.server.URL, "xml", time.Minute); err == nil {
+		t.Fatal("expected invalid format error")
+	}
+}
+
+func TestWebhookNotifierStopsRetryingWhenCancelled(t *testing.T) {
+	unavailable := http.StatusServiceUnavailable
+	receiver := newWebhookReceiver(t, unavailable, unavailable, unavailable)
+	n, _ := newWebhookNotifier(receiver.server.URL, "generic", time.Minute)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+
+	firing := &alertTransition{State: "firing", Rule: "r", Series: "m{}", Value: 1}
+	start := time.Now()
+	if err := n.notify(ctx, []*alertTransition{firing}, nil, time.Now()); err == nil {
+		t.Fatal("expected the interrupted delivery to fail")
+	}
+	if elapsed := time.Since(start); elapsed > 500*time.Millisecond {
+		t.Fatalf("expected the backoff to end with the context, took %v", elapsed)
+	}
+	if len(receiver.bodies) != 1 || len(n.pending) != 1 {
+		t.Fatalf("expected one attempt with the notification kept pending, got %d posts and %d pending", len(receiver.bodies), len(n.pending))
+	}
+}
+
+func TestWebhookNotifierDeliversFlappingAlerts(t *testing.T) {
+	receiver := newWebhookReceiver(t)
+	n, _ := newWebhookNotifier(receiver.server.URL, "generic", 5*time.Minute)
+
+	now := time.Date(2018, 9, 20, 17, 0, 0, 0, time.UTC)
+	for i, state := range []string{"firing", "resolved", "firing", "firing"} {
+		transition := &alertTransition{State: state, Rule: "r", Series: "m{}", Value: 1}
+		if err := n.notify(context.Background(), []*alertTransition{transition}, nil, now.Add(time.Duration(i)*time.Minute)); err != nil {
+			t.Fatalf("notify returned error: %v", err)
+		}
+	}
+
+	if len(receiver.bodies) != 3 {
+		t.Fatalf("expected firing, resolved and firing again with only the repeat suppressed, got %d posts", len(receiver.bodies))
+	}
+	if !strings.Contains(receiver.bodies[2], `"state":"firing"`) {
+		t.Fatalf("expected the alert to fire again, got %s", receiver.bodies[2])
+	}
+}
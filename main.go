@@ -11,10 +11,12 @@
 package main
 
 import (
+	"context"
 	"github.com/paulwelch/kubestate/cmd"
 	"github.com/urfave/cli/v2"
 	"log"
 	"os"
+	"os/signal"
 	"time"
 )
 
@@ -31,7 +33,18 @@ func newApp() *cli.App {
 		&cli.StringFlag{Name: "config, c", Value: "~/.kube/config", Usage: "path to config"},
 		&cli.StringFlag{Name: "namespace, n", Value: "*", Usage: "namespace to show (default is all namespaces)"},
 		&cli.StringFlag{Name: "metrics-namespace", Usage: "namespace where kube-state-metrics service is running (auto-discovered if unset)"},
+		&cli.StringFlag{Name: "metrics-service", Usage: "name of the kube-state-metrics service (auto-discovered by label or name if unset)"},
+		&cli.StringFlag{Name: "metrics-port", Usage: "name or number of the kube-state-metrics service port (prefers http-metrics if unset)"},
 		&cli.BoolFlag{Name: "insecure-skip-tls-verify", Usage: "skip TLS certificate verification when connecting to Kubernetes API"},
+		&cli.StringFlag{Name: "metrics-scheme", Usage: "scheme of the kube-state-metrics service port: http or https (detected from the port if unset)"},
+		&cli.StringFlag{Name: "metrics-url", Usage: "scrape kube-state-metrics directly at this URL with the kubeconfig bearer token instead of through the API server proxy"},
+		&cli.StringFlag{Name: "prometheus-url", Usage: "read kube-state-metrics series from this Prometheus, Thanos or Mimir HTTP API instead of the cluster"},
+		&cli.StringFlag{Name: "prometheus-mode", Value: "query", Usage: "Prometheus API to read from: query (/api/v1/query) or federate (/federate)"},
+		&cli.StringFlag{Name: "prometheus-selector", Usage: "extra label matchers for the Prometheus series, e.g. 'cluster=\"prod\"'"},
+		&cli.BoolFlag{Name: "sharded", Usage: "scrape every kube-state-metrics shard pod and merge the results"},
+		&cli.DurationFlag{Name: "request-timeout", Value: 30 * time.Second, Usage: "timeout for each Kubernetes API request, and for scrapes to start responding (0 disables)"},
+		&cli.DurationFlag{Name: "cache-ttl", Usage: "reuse the last kube-state-metrics scrape of this cluster context and service, cached on disk, for this long (0 disables)"},
+		&cli.BoolFlag{Name: "stats", Usage: "report bytes transferred, decode time and series count of kube-state-metrics scrapes to stderr"},
 	}
 
 	app.Commands = []*cli.Command{
@@ -51,6 +64,14 @@ func newApp() *cli.App {
 				{Name: "pods", Aliases: []string{"po"}, Usage: "Get top resource usage for pods", Action: cmd.Top},
 				{Name: "deployments", Aliases: []string{"deploy"}, Usage: "Get top resource usage for deployments", Action: cmd.Top},
 				{Name: "nodes", Usage: "Get top resource usage for nodes", Action: cmd.Top},
+				{
+					Name:  "restarts",
+					Usage: "Get top container restarts over a sampling window",
+					Flags: []cli.Flag{
+						&cli.DurationFlag{Name: "window, w", Value: time.Minute, Usage: "Sampling window for counting restarts"},
+					},
+					Action: cmd.TopRestarts,
+				},
 			},
 		},
 		{
@@ -60,19 +81,95 @@ func newApp() *cli.App {
 				&cli.StringFlag{Name: "output, o", Value: "json", Usage: "Output format. Valid formats: json, raw"},
 				&cli.StringFlag{Name: "metric, m", Value: "*", Usage: "Metric name to show"},
 				&cli.IntFlag{Name: "interval, i", Value: 10, Usage: "Refresh interval in seconds"},
+				&cli.BoolFlag{Name: "changes", Usage: "Stream added, removed and changed series as NDJSON events instead of redrawing"},
+				&cli.BoolFlag{Name: "rate", Usage: "Show per-second rate and delta of counters since the previous refresh"},
+				&cli.StringFlag{Name: "alerts", Usage: "Evaluate alert rules from this YAML file and print firing and resolved transitions"},
+				&cli.StringFlag{Name: "webhook", Usage: "POST alert transitions or series changes to this URL"},
+				&cli.StringFlag{Name: "webhook-format", Value: "generic", Usage: "Webhook payload format. Valid formats: generic, slack"},
+				&cli.DurationFlag{Name: "webhook-dedup", Value: 5 * time.Minute, Usage: "Suppress repeats of the same notification within this window"},
 			},
 			Action: cmd.Watch,
+			Subcommands: []*cli.Command{
+				{
+					Name:  "top",
+					Usage: "Watch top resource consumption",
+					Subcommands: []*cli.Command{
+						{Name: "pods", Aliases: []string{"po"}, Usage: "Watch top resource usage for pods", Flags: watchIntervalFlags(), Action: cmd.Watch},
+						{Name: "deployments", Aliases: []string{"deploy"}, Usage: "Watch top resource usage for deployments", Flags: watchIntervalFlags(), Action: cmd.Watch},
+						{Name: "nodes", Usage: "Watch top resource usage for nodes", Flags: watchIntervalFlags(), Action: cmd.Watch},
+					},
+				},
+				{Name: "summary", Usage: "Watch cluster health summary", Flags: watchIntervalFlags(), Action: cmd.Watch},
+			},
+		},
+		{
+			Name:  "ui",
+			Usage: "Interactive view of pods, nodes and deployments",
+			Flags: []cli.Flag{
+				&cli.IntFlag{Name: "interval, i", Value: 10, Usage: "Refresh interval in seconds"},
+			},
+			Action: cmd.UI,
+		},
+		{
+			Name:  "wait",
+			Usage: "Wait until a metric condition holds",
+			Flags: []cli.Flag{
+				&cli.StringFlag{Name: "for", Required: true, Usage: "Condition to wait for, e.g. 'kube_deployment_status_replicas_unavailable{deployment=\"api\"} == 0'"},
+				&cli.DurationFlag{Name: "timeout", Value: 5 * time.Minute, Usage: "Give up and exit non-zero after this long"},
+				&cli.IntFlag{Name: "interval, i", Value: 5, Usage: "Poll interval in seconds"},
+			},
+			Action: cmd.Wait,
+		},
+		{
+			Name:  "serve",
+			Usage: "Serve derived rollups as Prometheus metrics",
+			Flags: []cli.Flag{
+				&cli.StringFlag{Name: "listen", Value: ":9200", Usage: "Address to listen on"},
+				&cli.DurationFlag{Name: "cache-interval", Value: 15 * time.Second, Usage: "Reuse a kube-state-metrics scrape across requests for this long (0 scrapes on every request)"},
+				&cli.BoolFlag{Name: "api", Usage: "Also serve the top and get views as JSON under /api/v1"},
+				&cli.BoolFlag{Name: "dashboard", Usage: "Also serve a read-only HTML status page at /"},
+				&cli.DurationFlag{Name: "dashboard-refresh", Value: 30 * time.Second, Usage: "Dashboard auto-refresh interval (0 disables)"},
+			},
+			Action: cmd.Serve,
+		},
+		{
+			Name:  "report",
+			Usage: "Write a capacity and health report from a single scrape",
+			Flags: []cli.Flag{
+				&cli.StringFlag{Name: "format, f", Value: "html", Usage: "Report format: html or markdown"},
+				&cli.StringFlag{Name: "output, o", Usage: "Write the report to this file (default is stdout)"},
+				&cli.BoolFlag{Name: "charts", Usage: "Embed SVG bar charts of node load and namespace requests"},
+				&cli.IntFlag{Name: "top", Value: 10, Usage: "Number of pods in the top pods table"},
+			},
+			Action: cmd.Report,
 		},
+		{Name: "doctor", Usage: "Diagnose kube-state-metrics discovery, permissions and scraping", Action: cmd.Doctor},
 		{Name: "list", Usage: "List metrics", Action: cmd.List},
+		{Name: "summary", Usage: "Show cluster health summary", Action: cmd.Summary},
 	}
 
+	app.After = cmd.PrintStats
+
 	return app
 }
 
+func watchIntervalFlags() []cli.Flag {
+	return []cli.Flag{
+		&cli.IntFlag{Name: "interval, i", Value: 10, Usage: "Refresh interval in seconds"},
+	}
+}
+
 func main() {
 	app := newApp()
 
-	err := app.Run(os.Args)
+	// the first interrupt cancels in-flight requests; stopping afterwards lets a second one exit immediately
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt)
+	go func() {
+		<-ctx.Done()
+		stop()
+	}()
+
+	err := app.RunContext(ctx, os.Args)
 	if err != nil {
 		log.Fatal(err)
 	}
@@ -1,15 +1,21 @@
 package main
 
-import "testing"
+import (
+	"testing"
+
+	"github.com/urfave/cli/v2"
+)
 
 func TestNewAppRegistersCoreCommands(t *testing.T) {
 	app := newApp()
 
 	want := map[string]bool{
-		"get":   false,
-		"list":  false,
-		"top":   false,
-		"watch": false,
+		"doctor":  false,
+		"get":     false,
+		"list":    false,
+		"summary": false,
+		"top":     false,
+		"watch":   false,
 	}
 	for _, c := range app.Commands {
 		if _, ok := want[c.Name]; ok {
@@ -51,3 +57,20 @@ func TestTopSubcommandsHaveUniqueNamesAndAliases(t *testing.T) {
 		t.Fatal("expected top command to be registered")
 	}
 }
+
+func TestServeCachesScrapesByDefault(t *testing.T) {
+	for _, c := range newApp().Commands {
+		if c.Name != "serve" {
+			continue
+		}
+		for _, f := range c.Flags {
+			if d, ok := f.(*cli.DurationFlag); ok && d.Name == "cache-interval" {
+				if d.Value <= 0 {
+					t.Fatalf("expected serve to cache scrapes by default, got %v", d.Value)
+				}
+				return
+			}
+		}
+	}
+	t.Fatal("expected serve to have a --cache-interval flag")
+}
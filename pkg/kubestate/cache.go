@@ -0,0 +1,218 @@
+/*
+ * Copyright 2018 Paul Welch
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License"); you may not use this file except in compliance with the License. You may obtain a copy of the License at
+ *
+ * http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software distributed under the License is distributed on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the License for the specific language governing permissions and limitations under the License.
+ */
+
+package kubestate
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"k8s.io/client-go/tools/clientcmd"
+)
+
+// cacheDir is the directory of on-disk scrapes, under the user cache directory unless
+// Options.CacheDir is set.
+func (c *Client) cacheDir() (string, error) {
+	if c.opts.CacheDir != "" {
+		return c.opts.CacheDir, nil
+	}
+	dir, err := os.UserCacheDir()
+	if err != nil {
+		return "", err
+	}
+	return filepath.Join(dir, "kubestate", "scrapes"), nil
+}
+
+// cacheKey names the cached scrape of one cluster context and kube-state-metrics service, or
+// of one Prometheus source. It is derived from the kubeconfig and options alone, so a cache hit
+// skips service discovery.
+func (c *Client) cacheKey() (string, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.key != "" {
+		return c.key, nil
+	}
+
+	// a Prometheus source is cached per URL and selector, without reading the kubeconfig
+	source := []string{c.opts.PrometheusURL, c.opts.PrometheusMode, c.opts.PrometheusSelector}
+	if c.opts.PrometheusURL == "" {
+		if err := c.init(); err != nil {
+			return "", err
+		}
+		context := "in-cluster"
+		if c.opts.Kubeconfig != "" {
+			if raw, err := clientcmd.LoadFromFile(c.opts.Kubeconfig); err == nil {
+				context = raw.CurrentContext
+			}
+		}
+		source = []string{
+			c.cfg.Host, context,
+			c.opts.MetricsNamespace, c.opts.MetricsService, c.opts.MetricsPort, c.opts.MetricsScheme, c.opts.MetricsURL,
+			strconv.FormatBool(c.opts.Sharded),
+		}
+	}
+
+	sum := sha256.Sum256([]byte(strings.Join(source, "\n")))
+	c.key = hex.EncodeToString(sum[:16])
+	return c.key, nil
+}
+
+// readCache reads the cached scrape into read when it is younger than CacheTTL. A scrape of
+// several shards is cached as one file per shard.
+func (c *Client) readCache(key string, read scrapeReader) ([]*scrapeResult, bool) {
+	dir, err := c.cacheDir()
+	if err != nil {
+		return nil, false
+	}
+	entry := filepath.Join(dir, key)
+	info, err := os.Stat(entry)
+	if err != nil || !info.IsDir() || time.Since(info.ModTime()) > c.opts.CacheTTL {
+		return nil, false
+	}
+	files, err := filepath.Glob(filepath.Join(entry, "*.prom"))
+	if err != nil || len(files) == 0 {
+		return nil, false
+	}
+	sort.Strings(files)
+
+	results := make([]*scrapeResult, 0, len(files))
+	for _, name := range files {
+		result, err := c.readCacheFile(name, read)
+		if err != nil {
+			return nil, false
+		}
+		results = append(results, result)
+	}
+	for _, result := range results {
+		c.record(result)
+	}
+	return results, true
+}
+
+func (c *Client) readCacheFile(name string, read scrapeReader) (*scrapeResult, error) {
+	start := time.Now()
+	f, err := os.Open(name)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	body := &countingReader{r: f}
+	result, err := read(body)
+	if err != nil {
+		return nil, err
+	}
+	result.decoded = body.n
+	result.decodeTime = time.Since(start)
+	result.cached = true
+	return result, nil
+}
+
+// cacheWriter saves the decoded bodies of a live scrape as they stream past, and replaces
+// the cached scrape with them once every body was read.
+type cacheWriter struct {
+	entry string
+	tmp   string
+
+	mu    sync.Mutex
+	next  int
+	files map[*scrapeResult]string
+}
+
+func (c *Client) newCacheWriter(key string) (*cacheWriter, error) {
+	dir, err := c.cacheDir()
+	if err != nil {
+		return nil, err
+	}
+	if err := os.MkdirAll(dir, 0o700); err != nil {
+		return nil, err
+	}
+	tmp, err := os.MkdirTemp(dir, key+".tmp-")
+	if err != nil {
+		return nil, err
+	}
+	return &cacheWriter{entry: filepath.Join(dir, key), tmp: tmp, files: make(map[*scrapeResult]string)}, nil
+}
+
+// tee wraps read so the body it consumes is also written to the cache. The rest of the body
+// is drained after read returns, since a filtered read may stop early.
+func (cw *cacheWriter) tee(read scrapeReader) scrapeReader {
+	return func(body io.Reader) (*scrapeResult, error) {
+		cw.mu.Lock()
+		name := filepath.Join(cw.tmp, fmt.Sprintf("%04d.prom", cw.next))
+		cw.next++
+		cw.mu.Unlock()
+
+		f, err := os.OpenFile(name, os.O_CREATE|os.O_EXCL|os.O_WRONLY, 0o600)
+		if err != nil {
+			return nil, err
+		}
+		defer f.Close()
+
+		tee := io.TeeReader(body, f)
+		result, err := read(tee)
+		if err != nil {
+			return nil, err
+		}
+		if _, err := io.Copy(io.Discard, tee); err != nil {
+			return nil, err
+		}
+		if err := f.Close(); err != nil {
+			return nil, err
+		}
+
+		cw.mu.Lock()
+		cw.files[result] = name
+		cw.mu.Unlock()
+		return result, nil
+	}
+}
+
+// commit replaces the cached scrape with the bodies of results. Bodies left over from an
+// attempt that failed and was retried are dropped.
+func (cw *cacheWriter) commit(results []*scrapeResult) error {
+	keep := make(map[string]bool, len(results))
+	for _, result := range results {
+		keep[cw.files[result]] = true
+	}
+	written, err := filepath.Glob(filepath.Join(cw.tmp, "*.prom"))
+	if err != nil {
+		return err
+	}
+	for _, name := range written {
+		if !keep[name] {
+			os.Remove(name)
+		}
+	}
+
+	// the entry's modification time is when it was scraped
+	now := time.Now()
+	if err := os.Chtimes(cw.tmp, now, now); err != nil {
+		return err
+	}
+	if err := os.RemoveAll(cw.entry); err != nil {
+		return err
+	}
+	return os.Rename(cw.tmp, cw.entry)
+}
+
+func (cw *cacheWriter) abort() {
+	os.RemoveAll(cw.tmp)
+}
@@ -0,0 +1,103 @@
+package kubestate
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestClientReusesCachedScrapeAcrossClients(t *testing.T) {
+	api := newFakeAPIServer(t)
+	opts := Options{Kubeconfig: api.kubeconfig, CacheTTL: time.Minute, CacheDir: t.TempDir()}
+
+	// a filtered scrape still caches the whole response
+	families, err := NewClient(opts).FilteredMetricFamilies(context.Background(), Filter{Names: []string{"kube_node_info"}})
+	if err != nil {
+		t.Fatalf("FilteredMetricFamilies returned error: %v", err)
+	}
+	if len(families) != 0 {
+		t.Fatalf("expected kube_pod_info to be filtered out, got %v", families)
+	}
+
+	client := NewClient(opts)
+	families, err = client.MetricFamilies(context.Background())
+	if err != nil {
+		t.Fatalf("MetricFamilies returned error: %v", err)
+	}
+	if len(families) != 1 || families[0].GetName() != "kube_pod_info" {
+		t.Fatalf("unexpected cached families %v", families)
+	}
+	raw, err := client.RawMetrics(context.Background())
+	if err != nil || !strings.Contains(raw, `kube_pod_info{namespace="default",pod="p1"} 1`) {
+		t.Fatalf("unexpected cached raw metrics %q, %v", raw, err)
+	}
+
+	if got := api.count("metrics"); got != 1 {
+		t.Fatalf("expected 1 scrape, got %d", got)
+	}
+	if got := api.count("list"); got != 1 {
+		t.Fatalf("expected cache hits to skip discovery, got %d service lists", got)
+	}
+	if stats := client.Stats(); stats.Scrapes != 2 || stats.Cached != 2 || stats.Transferred != 0 {
+		t.Fatalf("unexpected stats %+v", stats)
+	}
+}
+
+func TestClientScrapesAgainAfterCacheTTL(t *testing.T) {
+	api := newFakeAPIServer(t)
+	opts := Options{Kubeconfig: api.kubeconfig, CacheTTL: time.Minute, CacheDir: t.TempDir()}
+
+	client := NewClient(opts)
+	if _, err := client.MetricFamilies(context.Background()); err != nil {
+		t.Fatalf("MetricFamilies returned error: %v", err)
+	}
+
+	entries, err := filepath.Glob(filepath.Join(opts.CacheDir, "*"))
+	if err != nil || len(entries) != 1 {
+		t.Fatalf("expected one cache entry, got %v, %v", entries, err)
+	}
+	stale := time.Now().Add(-2 * time.Minute)
+	if err := os.Chtimes(entries[0], stale, stale); err != nil {
+		t.Fatalf("Chtimes: %v", err)
+	}
+
+	if _, err := client.MetricFamilies(context.Background()); err != nil {
+		t.Fatalf("MetricFamilies returned error: %v", err)
+	}
+	if got := api.count("metrics"); got != 2 {
+		t.Fatalf("expected a stale cache to be scraped again, got %d scrapes", got)
+	}
+	if entries, _ := filepath.Glob(filepath.Join(opts.CacheDir, "*")); len(entries) != 1 {
+		t.Fatalf("expected the entry to be replaced, got %v", entries)
+	}
+}
+
+func TestClientCachesEveryShard(t *testing.T) {
+	api := newFakeAPIServer(t)
+	opts := Options{Kubeconfig: api.kubeconfig, Sharded: true, CacheTTL: time.Minute, CacheDir: t.TempDir()}
+
+	if _, err := NewClient(opts).MetricFamilies(context.Background()); err != nil {
+		t.Fatalf("MetricFamilies returned error: %v", err)
+	}
+	families, err := NewClient(opts).MetricFamilies(context.Background())
+	if err != nil {
+		t.Fatalf("MetricFamilies returned error: %v", err)
+	}
+	if len(families) != 1 || len(families[0].Metric) != 2 {
+		t.Fatalf("expected both cached shards to be merged, got %v", families)
+	}
+	if got := api.count("shard"); got != 2 {
+		t.Fatalf("expected each shard to be scraped once, got %d", got)
+	}
+
+	// the same service without --sharded is cached separately
+	if _, err := NewClient(Options{Kubeconfig: api.kubeconfig, CacheTTL: time.Minute, CacheDir: opts.CacheDir}).MetricFamilies(context.Background()); err != nil {
+		t.Fatalf("MetricFamilies returned error: %v", err)
+	}
+	if got := api.count("metrics"); got != 1 {
+		t.Fatalf("expected the unsharded scrape not to hit the sharded cache, got %d scrapes", got)
+	}
+}
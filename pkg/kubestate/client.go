@@ -0,0 +1,686 @@
+/*
+ * Copyright 2018 Paul Welch
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License"); you may not use this file except in compliance with the License. You may obtain a copy of the License at
+ *
+ * http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software distributed under the License is distributed on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the License for the specific language governing permissions and limitations under the License.
+ */
+
+// Package kubestate fetches kube-state-metrics through the Kubernetes API server proxy
+// and rolls the metric families up into per pod, node and deployment views.
+package kubestate
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/matttproud/golang_protobuf_extensions/pbutil"
+	dto "github.com/prometheus/client_model/go"
+	"github.com/prometheus/common/expfmt"
+	"github.com/prometheus/common/model"
+	corev1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes"
+	_ "k8s.io/client-go/plugin/pkg/client/auth"
+	"k8s.io/client-go/rest"
+	"k8s.io/client-go/tools/clientcmd"
+)
+
+var (
+	// ErrServiceNotFound is returned when no kube-state-metrics service can be found.
+	ErrServiceNotFound = errors.New("kube-state-metrics service not found")
+	// ErrServiceUnhealthy is returned when the kube-state-metrics health check fails.
+	ErrServiceUnhealthy = errors.New("kube-state-metrics service is not healthy")
+	// ErrServiceNoPorts is returned when the kube-state-metrics service exposes no ports.
+	ErrServiceNoPorts = errors.New("kube-state-metrics service has no ports")
+	// ErrUnsupportedScheme is returned when the metrics scheme is neither http nor https.
+	ErrUnsupportedScheme = errors.New("unsupported kube-state-metrics scheme")
+	// ErrInvalidPrometheusSource is returned when the Prometheus URL or mode cannot be used.
+	ErrInvalidPrometheusSource = errors.New("invalid Prometheus source")
+	// ErrServicePortNotFound is returned when the requested metrics port is not exposed by the service.
+	ErrServicePortNotFound = errors.New("kube-state-metrics service port not found")
+)
+
+const acceptHeader = `application/vnd.google.protobuf;proto=io.prometheus.client.MetricFamily;encoding=delimited;q=0.7,text/plain;version=0.0.4;q=0.3`
+
+// Options configures how a Client reaches the cluster and kube-state-metrics.
+type Options struct {
+	// Kubeconfig is the path to a kubeconfig file; empty uses in-cluster config.
+	Kubeconfig string
+	// MetricsNamespace is the namespace of the kube-state-metrics service; empty discovers it.
+	MetricsNamespace string
+	// MetricsService is the name of the kube-state-metrics service; empty discovers it by label or name.
+	MetricsService string
+	// MetricsPort is the service port name or number to scrape; empty prefers the http-metrics port.
+	MetricsPort string
+	// InsecureSkipTLSVerify skips verification of the API server certificate.
+	InsecureSkipTLSVerify bool
+	// RequestTimeout bounds each discovery and health check request to the API server, and the
+	// wait for a scrape to start responding; reading a scraped body is not bounded, since large
+	// scrapes can take much longer. Zero means no timeout.
+	RequestTimeout time.Duration
+	// Sharded scrapes every pod behind the service and merges the results, for installs
+	// running kube-state-metrics with --shard/--total-shards or automatic sharding.
+	Sharded bool
+	// MetricsScheme is http or https for the proxied service; empty detects https from the port.
+	MetricsScheme string
+	// MetricsURL scrapes kube-state-metrics directly at this URL instead of through the API
+	// server proxy, authenticating with the kubeconfig or service account bearer token.
+	MetricsURL string
+	// PrometheusURL reads the kube-state-metrics series from this Prometheus, Thanos or Mimir
+	// HTTP API instead of scraping kube-state-metrics, so no access to the cluster is needed.
+	PrometheusURL string
+	// PrometheusMode is PrometheusQuery, the default, or PrometheusFederate.
+	PrometheusMode string
+	// PrometheusSelector adds label matchers to the series selector, such as cluster="prod"
+	// when one Prometheus holds several clusters.
+	PrometheusSelector string
+	// CacheTTL reuses a scrape saved on disk for this long, across Clients and processes;
+	// zero scrapes every time.
+	CacheTTL time.Duration
+	// CacheDir holds cached scrapes; empty uses kubestate/scrapes under the user cache directory.
+	CacheDir string
+}
+
+// Client scrapes kube-state-metrics through the API server service proxy. It is a long-lived
+// session: the clientset and the resolved, health-checked service are reused across scrapes,
+// and the service is only resolved again after a scrape fails. A Client is safe for concurrent use.
+type Client struct {
+	opts Options
+
+	mu        sync.Mutex
+	cfg       *rest.Config
+	clientset *kubernetes.Clientset
+	stream    rest.Interface
+	service   *ServiceRef
+	shards    []ShardRef
+	direct    *http.Client
+	key       string
+
+	statsMu sync.Mutex
+	stats   TransferStats
+}
+
+// ServiceRef identifies the kube-state-metrics service and the proxy name used to reach it.
+type ServiceRef struct {
+	Namespace string
+	Name      string
+	ProxyName string
+	// Port is the name of the scraped service port, empty if it is unnamed.
+	Port string
+	// Scheme is http or https.
+	Scheme string
+	// TelemetryProxyName reaches the kube-state-metrics self-metrics port, empty if the service has none.
+	TelemetryProxyName string
+}
+
+func NewClient(opts Options) *Client {
+	return &Client{opts: opts}
+}
+
+// RawMetrics returns the kube-state-metrics exposition as served, without parsing.
+// Sharded scrapes are merged and re-encoded in the text format.
+func (c *Client) RawMetrics(ctx context.Context) (string, error) {
+	results, err := c.scrape(ctx, "", readRaw)
+	if err != nil {
+		return "", err
+	}
+	// a cached scrape may have been saved in the protobuf format
+	if len(results) == 1 && !isDelimitedProtobuf(bufio.NewReader(bytes.NewReader(results[0].raw))) {
+		return string(results[0].raw), nil
+	}
+
+	sets := make([][]*dto.MetricFamily, 0, len(results))
+	for _, result := range results {
+		families, err := ParseMetrics(result.raw)
+		if err != nil {
+			return "", err
+		}
+		sets = append(sets, families)
+	}
+	var buf bytes.Buffer
+	for _, mf := range MergeFamilies(sets...) {
+		if _, err := expfmt.MetricFamilyToText(&buf, mf); err != nil {
+			return "", err
+		}
+	}
+	return buf.String(), nil
+}
+
+// MetricFamilies returns the parsed kube-state-metrics families, negotiating protobuf when available.
+func (c *Client) MetricFamilies(ctx context.Context) ([]*dto.MetricFamily, error) {
+	return c.FilteredMetricFamilies(ctx, Filter{})
+}
+
+// FilteredMetricFamilies is MetricFamilies keeping only what filter selects. The response is
+// decoded as it streams in, so families and series that are filtered out are never retained.
+func (c *Client) FilteredMetricFamilies(ctx context.Context, filter Filter) ([]*dto.MetricFamily, error) {
+	results, err := c.scrape(ctx, acceptHeader, readFamilies(filter))
+	if err != nil {
+		return nil, err
+	}
+	if len(results) == 1 {
+		return results[0].families, nil
+	}
+
+	sets := make([][]*dto.MetricFamily, 0, len(results))
+	for _, result := range results {
+		sets = append(sets, result.families)
+	}
+	return MergeFamilies(sets...), nil
+}
+
+// scrapeResult is what a reader kept of one scraped response.
+type scrapeResult struct {
+	raw      []byte
+	families []*dto.MetricFamily
+	format   string
+	series   int
+	cached   bool
+
+	transferred, decoded int64
+	encoding             string
+	decodeTime           time.Duration
+}
+
+// scrapeReader consumes one scraped response body.
+type scrapeReader func(body io.Reader) (*scrapeResult, error)
+
+func readRaw(body io.Reader) (*scrapeResult, error) {
+	raw, err := io.ReadAll(body)
+	if err != nil {
+		return nil, err
+	}
+	return &scrapeResult{raw: raw, series: countSamples(raw)}, nil
+}
+
+// countSamples counts the sample lines of a text exposition; protobuf responses, which
+// are only read raw by doctor, count as none.
+func countSamples(raw []byte) int {
+	n := 0
+	for _, line := range bytes.Split(raw, []byte("\n")) {
+		if len(line) > 0 && line[0] != '#' {
+			n++
+		}
+	}
+	return n
+}
+
+func readFamilies(filter Filter) scrapeReader {
+	return func(body io.Reader) (*scrapeResult, error) {
+		families, format, err := ParseMetricsStream(body, filter)
+		if err != nil {
+			return nil, err
+		}
+		series := 0
+		for _, mf := range families {
+			series += len(mf.Metric)
+		}
+		return &scrapeResult{families: families, format: format, series: series}, nil
+	}
+}
+
+// scrape reads the scrape cached on disk when Options.CacheTTL allows, and otherwise scrapes
+// live, saving the responses for the next scrape.
+func (c *Client) scrape(ctx context.Context, accept string, read scrapeReader) ([]*scrapeResult, error) {
+	if c.opts.CacheTTL <= 0 {
+		return c.scrapeLive(ctx, accept, read)
+	}
+
+	key, err := c.cacheKey()
+	if err != nil {
+		return nil, err
+	}
+	if results, ok := c.readCache(key, read); ok {
+		return results, nil
+	}
+
+	cw, err := c.newCacheWriter(key)
+	if err != nil {
+		// an unwritable cache only costs the reuse
+		return c.scrapeLive(ctx, accept, read)
+	}
+	results, err := c.scrapeLive(ctx, accept, cw.tee(read))
+	if err != nil {
+		cw.abort()
+		return nil, err
+	}
+	if err := cw.commit(results); err != nil {
+		cw.abort()
+	}
+	return results, nil
+}
+
+// scrapeLive reads /metrics from the cached service, or from each cached shard. If that fails,
+// the service is resolved again once, since it may have been reinstalled or rescaled since it was cached.
+func (c *Client) scrapeLive(ctx context.Context, accept string, read scrapeReader) ([]*scrapeResult, error) {
+	if c.opts.PrometheusURL != "" {
+		result, err := c.readPrometheus(ctx, accept, read)
+		if err != nil {
+			return nil, err
+		}
+		return []*scrapeResult{result}, nil
+	}
+	if c.opts.MetricsURL != "" {
+		result, err := c.readDirect(ctx, accept, read)
+		if err != nil {
+			return nil, err
+		}
+		return []*scrapeResult{result}, nil
+	}
+
+	service, shards, cached, err := c.connect(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	results, err := c.fetch(ctx, service, shards, accept, read)
+	if err != nil && cached && ctx.Err() == nil {
+		c.forget(service)
+		if service, shards, _, err = c.connect(ctx); err != nil {
+			return nil, err
+		}
+		results, err = c.fetch(ctx, service, shards, accept, read)
+	}
+	if err != nil {
+		c.forget(service)
+		return nil, err
+	}
+
+	return results, nil
+}
+
+// fetch scrapes the service, or every shard concurrently when shards are given.
+func (c *Client) fetch(ctx context.Context, service ServiceRef, shards []ShardRef, accept string, read scrapeReader) ([]*scrapeResult, error) {
+	if len(shards) == 0 {
+		result, err := c.read(ctx, proxyURI(c.cfg, service, "metrics"), accept, read)
+		if err != nil {
+			return nil, err
+		}
+		return []*scrapeResult{result}, nil
+	}
+
+	results := make([]*scrapeResult, len(shards))
+	errs := make([]error, len(shards))
+	var wg sync.WaitGroup
+	for i, shard := range shards {
+		wg.Add(1)
+		go func(i int, shard ShardRef) {
+			defer wg.Done()
+			results[i], errs[i] = c.read(ctx, podProxyURI(c.cfg, shard, "metrics"), accept, read)
+		}(i, shard)
+	}
+	wg.Wait()
+
+	for i, err := range errs {
+		if err != nil {
+			return nil, fmt.Errorf("scraping shard %s: %w", shards[i].Pod, err)
+		}
+	}
+	return results, nil
+}
+
+// read streams the response body at uri into read.
+func (c *Client) read(ctx context.Context, uri, accept string, read scrapeReader) (*scrapeResult, error) {
+	req := c.stream.Get().RequestURI(uri)
+	if accept != "" {
+		req = req.SetHeader("Accept", accept)
+	}
+
+	ctx, responded, cancel := c.headerTimeout(ctx)
+	defer cancel()
+	body, err := req.SetHeader("Accept-Encoding", acceptEncoding).Stream(ctx)
+	if !responded() {
+		if err == nil {
+			body.Close()
+		}
+		return nil, c.errNoResponse(uri)
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer body.Close()
+
+	return c.readBody(body, read)
+}
+
+// headerTimeout bounds ctx by RequestTimeout until a response starts. Call responded once the
+// headers arrive: it lifts the bound, so reading the body takes as long as it needs, and
+// reports false if the timeout expired first.
+func (c *Client) headerTimeout(ctx context.Context) (context.Context, func() bool, context.CancelFunc) {
+	ctx, cancel := context.WithCancel(ctx)
+	if c.opts.RequestTimeout <= 0 {
+		return ctx, func() bool { return true }, cancel
+	}
+	timer := time.AfterFunc(c.opts.RequestTimeout, cancel)
+	return ctx, timer.Stop, cancel
+}
+
+func (c *Client) errNoResponse(target string) error {
+	return fmt.Errorf("no response from %s within %s: %w", target, c.opts.RequestTimeout, context.DeadlineExceeded)
+}
+
+func (c *Client) get(ctx context.Context, uri string) ([]byte, error) {
+	r := c.clientset.RESTClient().Get().RequestURI(uri).Do(ctx)
+	if r.Error() != nil {
+		return nil, r.Error()
+	}
+	resp, _ := r.Raw()
+
+	return resp, nil
+}
+
+// connect returns the cached service and shards, or builds the clientset as needed, resolves
+// the kube-state-metrics service, checks its health and, when sharded, lists its shards.
+// It reports whether the service was cached.
+func (c *Client) connect(ctx context.Context) (ServiceRef, []ShardRef, bool, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.service != nil {
+		return *c.service, c.shards, true, nil
+	}
+
+	if err := c.init(); err != nil {
+		return ServiceRef{}, nil, false, err
+	}
+
+	service, err := ResolveService(ctx, c.clientset, c.opts)
+	if err != nil {
+		return ServiceRef{}, nil, false, err
+	}
+
+	resp, err := c.get(ctx, proxyURI(c.cfg, service, "healthz"))
+	if err != nil {
+		return ServiceRef{}, nil, false, err
+	}
+	if !strings.EqualFold(strings.TrimSpace(string(resp)), "ok") {
+		return ServiceRef{}, nil, false, ErrServiceUnhealthy
+	}
+
+	var shards []ShardRef
+	if c.opts.Sharded {
+		if shards, err = ResolveShards(ctx, c.clientset, service); err != nil {
+			return ServiceRef{}, nil, false, err
+		}
+	}
+
+	c.service, c.shards = &service, shards
+	return service, shards, false, nil
+}
+
+// init builds the rest config and clientset on first use. The caller must hold c.mu.
+func (c *Client) init() error {
+	if c.clientset != nil {
+		return nil
+	}
+
+	cfg, err := clientcmd.BuildConfigFromFlags("", c.opts.Kubeconfig)
+	if err != nil {
+		return err
+	}
+	if c.opts.InsecureSkipTLSVerify {
+		cfg.TLSClientConfig.Insecure = true
+		cfg.TLSClientConfig.CAData = nil
+		cfg.TLSClientConfig.CAFile = ""
+	}
+	cfg.Timeout = c.opts.RequestTimeout
+
+	clientset, err := kubernetes.NewForConfig(cfg)
+	if err != nil {
+		return err
+	}
+	// scrapes bound only the wait for a response, see headerTimeout
+	streamCfg := rest.CopyConfig(cfg)
+	streamCfg.Timeout = 0
+	streaming, err := kubernetes.NewForConfig(streamCfg)
+	if err != nil {
+		return err
+	}
+	c.cfg, c.clientset, c.stream = cfg, clientset, streaming.RESTClient()
+	return nil
+}
+
+// forget drops the cached service so the next scrape resolves it again, unless another
+// scrape has already replaced it.
+func (c *Client) forget(service ServiceRef) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.service != nil && *c.service == service {
+		c.service, c.shards = nil, nil
+	}
+}
+
+func proxyURI(cfg *rest.Config, serviceRef ServiceRef, path string) string {
+	return cfg.Host + "/api/v1/namespaces/" + serviceRef.Namespace + "/services/" + serviceRef.ProxyName + "/proxy/" + path
+}
+
+// ResolveService finds the kube-state-metrics service in opts.MetricsNamespace, or across all
+// namespaces when it is empty, preferring the monitoring and kube-system namespaces. Services
+// are matched by opts.MetricsService when set, otherwise by the app.kubernetes.io/name label
+// or the kube-state-metrics name, so Helm release prefixes are found too.
+func ResolveService(ctx context.Context, k8sclient kubernetes.Interface, opts Options) (ServiceRef, error) {
+	if opts.MetricsNamespace != "" && opts.MetricsService != "" {
+		svc, err := k8sclient.CoreV1().Services(opts.MetricsNamespace).Get(ctx, opts.MetricsService, metav1.GetOptions{})
+		if apierrors.IsNotFound(err) {
+			return ServiceRef{}, fmt.Errorf("%w: service %q in namespace %q", ErrServiceNotFound, opts.MetricsService, opts.MetricsNamespace)
+		}
+		if err != nil {
+			return ServiceRef{}, err
+		}
+		return buildServiceRef(svc, opts.MetricsPort, opts.MetricsScheme)
+	}
+
+	svcs, err := k8sclient.CoreV1().Services(opts.MetricsNamespace).List(ctx, metav1.ListOptions{})
+	if err != nil {
+		return ServiceRef{}, err
+	}
+
+	matches := make([]*corev1.Service, 0)
+	for i := range svcs.Items {
+		if isMetricsService(&svcs.Items[i], opts.MetricsService) {
+			matches = append(matches, &svcs.Items[i])
+		}
+	}
+
+	if len(matches) == 0 {
+		switch {
+		case opts.MetricsService != "":
+			return ServiceRef{}, fmt.Errorf("%w: service %q", ErrServiceNotFound, opts.MetricsService)
+		case opts.MetricsNamespace != "":
+			return ServiceRef{}, fmt.Errorf("%w in namespace %q", ErrServiceNotFound, opts.MetricsNamespace)
+		}
+		return ServiceRef{}, ErrServiceNotFound
+	}
+
+	// Prefer common namespaces if there are multiple installs, then the plain name.
+	rank := func(svc *corev1.Service) int {
+		r := 4
+		switch svc.Namespace {
+		case "monitoring":
+			r = 0
+		case "kube-system":
+			r = 2
+		}
+		if svc.Name != metricsServiceName {
+			r++
+		}
+		return r
+	}
+	sort.SliceStable(matches, func(i, j int) bool {
+		if ri, rj := rank(matches[i]), rank(matches[j]); ri != rj {
+			return ri < rj
+		}
+		if matches[i].Namespace != matches[j].Namespace {
+			return matches[i].Namespace < matches[j].Namespace
+		}
+		return matches[i].Name < matches[j].Name
+	})
+
+	return buildServiceRef(matches[0], opts.MetricsPort, opts.MetricsScheme)
+}
+
+const (
+	metricsServiceName = "kube-state-metrics"
+	metricsNameLabel   = "app.kubernetes.io/name"
+	metricsPortName    = "http-metrics"
+	telemetryPortName  = "telemetry"
+)
+
+func isMetricsService(svc *corev1.Service, name string) bool {
+	if name != "" {
+		return svc.Name == name
+	}
+	return svc.Name == metricsServiceName || svc.Labels[metricsNameLabel] == metricsServiceName
+}
+
+func buildServiceRef(svc *corev1.Service, portFlag, scheme string) (ServiceRef, error) {
+	if svc == nil {
+		return ServiceRef{}, fmt.Errorf("nil service reference")
+	}
+	if len(svc.Spec.Ports) == 0 {
+		return ServiceRef{}, fmt.Errorf("%w: service %q in namespace %q", ErrServiceNoPorts, svc.Name, svc.Namespace)
+	}
+	port, err := metricsPort(svc, portFlag)
+	if err != nil {
+		return ServiceRef{}, err
+	}
+	switch scheme {
+	case "":
+		scheme = portScheme(port)
+	case "http", "https":
+	default:
+		return ServiceRef{}, fmt.Errorf("%w %q: want http or https", ErrUnsupportedScheme, scheme)
+	}
+	proxyName := scheme + ":" + svc.Name + ":" + strconv.Itoa(int(port.Port))
+	ref := ServiceRef{Namespace: svc.Namespace, Name: svc.Name, ProxyName: proxyName, Port: port.Name, Scheme: scheme}
+
+	for _, p := range svc.Spec.Ports {
+		if p.Port != port.Port && isTelemetryPort(p) {
+			ref.TelemetryProxyName = portScheme(p) + ":" + svc.Name + ":" + strconv.Itoa(int(p.Port))
+			break
+		}
+	}
+
+	return ref, nil
+}
+
+// isTelemetryPort matches the telemetry port of the upstream manifests and the https-self
+// port of kube-prometheus.
+func isTelemetryPort(port corev1.ServicePort) bool {
+	return port.Name == telemetryPortName || strings.Contains(port.Name, "self")
+}
+
+// portScheme detects https from the port's appProtocol, its name or the conventional 443 and 8443
+// numbers used by kube-rbac-proxy sidecars, and otherwise assumes http.
+func portScheme(port corev1.ServicePort) string {
+	if port.AppProtocol != nil {
+		if strings.EqualFold(*port.AppProtocol, "https") {
+			return "https"
+		}
+		return "http"
+	}
+	name := strings.ToLower(port.Name)
+	if name == "https" || strings.HasPrefix(name, "https-") || strings.HasSuffix(name, "-https") || port.Port == 443 || port.Port == 8443 {
+		return "https"
+	}
+	return "http"
+}
+
+// metricsPort picks the port named or numbered portFlag, or else the http-metrics port,
+// falling back to the first port that is not the telemetry port.
+func metricsPort(svc *corev1.Service, portFlag string) (corev1.ServicePort, error) {
+	ports := svc.Spec.Ports
+	if portFlag != "" {
+		for _, port := range ports {
+			if port.Name == portFlag || strconv.Itoa(int(port.Port)) == portFlag {
+				return port, nil
+			}
+		}
+		return corev1.ServicePort{}, fmt.Errorf("%w: %q on service %q in namespace %q", ErrServicePortNotFound, portFlag, svc.Name, svc.Namespace)
+	}
+
+	for _, port := range ports {
+		if port.Name == metricsPortName {
+			return port, nil
+		}
+	}
+	for _, port := range ports {
+		if !isTelemetryPort(port) {
+			return port, nil
+		}
+	}
+	return ports[0], nil
+}
+
+// Exposition formats reported by ParseMetricsFormat.
+const (
+	FormatProtobuf = "protobuf"
+	FormatText     = "text"
+)
+
+// ParseMetrics decodes a delimited protobuf scrape, falling back to the text format.
+// Text families are returned sorted by name.
+func ParseMetrics(resp []byte) ([]*dto.MetricFamily, error) {
+	metricFamilies, _, err := ParseMetricsFormat(resp)
+	return metricFamilies, err
+}
+
+// ParseMetricsFormat is ParseMetrics that also reports which format the scrape was in.
+func ParseMetricsFormat(resp []byte) ([]*dto.MetricFamily, string, error) {
+	metricFamilies := make([]*dto.MetricFamily, 0)
+	reader := bytes.NewReader(resp)
+	parseErr := error(nil)
+	for {
+		mf := &dto.MetricFamily{}
+		if _, err := pbutil.ReadDelimited(reader, mf); err != nil {
+			if err == io.EOF {
+				break
+			}
+			parseErr = err
+			metricFamilies = nil
+			break
+		}
+		metricFamilies = append(metricFamilies, mf)
+	}
+
+	if len(metricFamilies) > 0 {
+		return metricFamilies, FormatProtobuf, nil
+	}
+
+	textParser := expfmt.NewTextParser(model.NameValidationScheme)
+	parsed, err := textParser.TextToMetricFamilies(bytes.NewReader(resp))
+	if err != nil {
+		if parseErr != nil {
+			return nil, "", fmt.Errorf("Error reading metric family protobuf: %v; text parse fallback failed: %v", parseErr, err)
+		}
+		return nil, "", fmt.Errorf("Error reading metric family text: %v", err)
+	}
+
+	names := make([]string, 0, len(parsed))
+	for name := range parsed {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	metricFamilies = make([]*dto.MetricFamily, 0, len(names))
+	for _, name := range names {
+		metricFamilies = append(metricFamilies, parsed[name])
+	}
+
+	return metricFamilies, FormatText, nil
+}
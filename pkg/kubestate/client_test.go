@@ -0,0 +1,445 @@
+package kubestate
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/klauspost/compress/zstd"
+	"github.com/matttproud/golang_protobuf_extensions/pbutil"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes/fake"
+)
+
+func TestParseMetricsText(t *testing.T) {
+	text := "# TYPE kube_pod_info gauge\n" +
+		`kube_pod_info{namespace="default",pod="p1"} 1` + "\n" +
+		"# TYPE kube_node_info gauge\n" +
+		`kube_node_info{node="n1"} 1` + "\n"
+
+	families, err := ParseMetrics([]byte(text))
+	if err != nil {
+		t.Fatalf("ParseMetrics returned error: %v", err)
+	}
+	if len(families) != 2 || families[0].GetName() != "kube_node_info" || families[1].GetName() != "kube_pod_info" {
+		t.Fatalf("expected families sorted by name, got %v", families)
+	}
+}
+
+func TestParseMetricsProtobuf(t *testing.T) {
+	var buf bytes.Buffer
+	for _, mf := range sampleFamilies()[:2] {
+		if _, err := pbutil.WriteDelimited(&buf, mf); err != nil {
+			t.Fatalf("WriteDelimited: %v", err)
+		}
+	}
+
+	families, err := ParseMetrics(buf.Bytes())
+	if err != nil {
+		t.Fatalf("ParseMetrics returned error: %v", err)
+	}
+	if len(families) != 2 || families[0].GetName() != "kube_pod_container_resource_requests" || len(families[0].Metric) != 6 {
+		t.Fatalf("unexpected protobuf families %v", families)
+	}
+}
+
+func TestResolveServicePrefersMonitoringNamespace(t *testing.T) {
+	client := fake.NewSimpleClientset(
+		metricsService("apps", 8080),
+		metricsService("monitoring", 8081),
+		metricsService("kube-system", 8082),
+	)
+
+	ref, err := ResolveService(context.Background(), client, Options{})
+	if err != nil {
+		t.Fatalf("ResolveService returned error: %v", err)
+	}
+	if ref.Namespace != "monitoring" || ref.ProxyName != "http:kube-state-metrics:8081" {
+		t.Fatalf("unexpected service ref %+v", ref)
+	}
+
+	ref, err = ResolveService(context.Background(), client, Options{MetricsNamespace: "apps"})
+	if err != nil || ref.Namespace != "apps" {
+		t.Fatalf("expected explicit namespace to win, got %+v, %v", ref, err)
+	}
+}
+
+func TestResolveServiceErrors(t *testing.T) {
+	if _, err := ResolveService(context.Background(), fake.NewSimpleClientset(), Options{}); !errors.Is(err, ErrServiceNotFound) {
+		t.Fatalf("expected ErrServiceNotFound, got %v", err)
+	}
+	if _, err := ResolveService(context.Background(), fake.NewSimpleClientset(), Options{MetricsNamespace: "monitoring"}); !errors.Is(err, ErrServiceNotFound) {
+		t.Fatalf("expected ErrServiceNotFound for explicit namespace, got %v", err)
+	}
+
+	svc := metricsService("monitoring", 0)
+	svc.Spec.Ports = nil
+	if _, err := ResolveService(context.Background(), fake.NewSimpleClientset(svc), Options{}); !errors.Is(err, ErrServiceNoPorts) {
+		t.Fatalf("expected ErrServiceNoPorts, got %v", err)
+	}
+
+	svc = metricsService("monitoring", 8080)
+	if _, err := ResolveService(context.Background(), fake.NewSimpleClientset(svc), Options{MetricsPort: "http-metrics"}); !errors.Is(err, ErrServicePortNotFound) {
+		t.Fatalf("expected ErrServicePortNotFound, got %v", err)
+	}
+	if _, err := ResolveService(context.Background(), fake.NewSimpleClientset(svc), Options{MetricsService: "ksm"}); !errors.Is(err, ErrServiceNotFound) {
+		t.Fatalf("expected ErrServiceNotFound for an explicit service, got %v", err)
+	}
+}
+
+func TestResolveServiceDiscoversHelmInstallByLabel(t *testing.T) {
+	helm := metricsService("monitoring", 8081)
+	helm.Name = "prometheus-kube-state-metrics"
+	helm.Labels = map[string]string{"app.kubernetes.io/name": "kube-state-metrics"}
+	helm.Spec.Ports = []corev1.ServicePort{{Name: "telemetry", Port: 8081}, {Name: "http-metrics", Port: 8080}}
+	other := metricsService("monitoring", 9090)
+	other.Name = "grafana"
+
+	client := fake.NewSimpleClientset(helm, other)
+	ref, err := ResolveService(context.Background(), client, Options{})
+	if err != nil {
+		t.Fatalf("ResolveService returned error: %v", err)
+	}
+	if ref.Name != "prometheus-kube-state-metrics" || ref.ProxyName != "http:prometheus-kube-state-metrics:8080" {
+		t.Fatalf("expected the labelled service on its http-metrics port, got %+v", ref)
+	}
+
+	ref, err = ResolveService(context.Background(), client, Options{MetricsPort: "telemetry"})
+	if err != nil || ref.ProxyName != "http:prometheus-kube-state-metrics:8081" {
+		t.Fatalf("expected --metrics-port to select the telemetry port, got %+v, %v", ref, err)
+	}
+
+	ref, err = ResolveService(context.Background(), client, Options{MetricsNamespace: "monitoring", MetricsService: "grafana", MetricsPort: "9090"})
+	if err != nil || ref.ProxyName != "http:grafana:9090" {
+		t.Fatalf("expected --metrics-service to override discovery, got %+v, %v", ref, err)
+	}
+}
+
+func TestResolveServiceDetectsHTTPS(t *testing.T) {
+	svc := metricsService("monitoring", 0)
+	svc.Spec.Ports = []corev1.ServicePort{{Name: "https-main", Port: 8443}, {Name: "https-self", Port: 9443}}
+	client := fake.NewSimpleClientset(svc)
+
+	ref, err := ResolveService(context.Background(), client, Options{})
+	if err != nil || ref.ProxyName != "https:kube-state-metrics:8443" || ref.Scheme != "https" {
+		t.Fatalf("expected an https proxy name, got %+v, %v", ref, err)
+	}
+
+	ref, err = ResolveService(context.Background(), client, Options{MetricsScheme: "http"})
+	if err != nil || ref.ProxyName != "http:kube-state-metrics:8443" {
+		t.Fatalf("expected --metrics-scheme to override detection, got %+v, %v", ref, err)
+	}
+
+	if _, err := ResolveService(context.Background(), client, Options{MetricsScheme: "tcp"}); !errors.Is(err, ErrUnsupportedScheme) {
+		t.Fatalf("expected ErrUnsupportedScheme, got %v", err)
+	}
+}
+
+func TestResolveServiceSkipsTelemetryPort(t *testing.T) {
+	svc := metricsService("kube-system", 0)
+	svc.Spec.Ports = []corev1.ServicePort{{Name: "telemetry", Port: 8081}, {Name: "metrics", Port: 8080}}
+
+	ref, err := ResolveService(context.Background(), fake.NewSimpleClientset(svc), Options{})
+	if err != nil || ref.ProxyName != "http:kube-state-metrics:8080" {
+		t.Fatalf("expected the first non-telemetry port, got %+v, %v", ref, err)
+	}
+}
+
+func metricsService(namespace string, port int32) *corev1.Service {
+	return &corev1.Service{
+		ObjectMeta: metav1.ObjectMeta{Name: "kube-state-metrics", Namespace: namespace},
+		Spec:       corev1.ServiceSpec{Ports: []corev1.ServicePort{{Port: port}}},
+	}
+}
+
+func TestClientReusesResolvedServiceAcrossScrapes(t *testing.T) {
+	api := newFakeAPIServer(t)
+
+	client := NewClient(Options{Kubeconfig: api.kubeconfig})
+	for i := 0; i < 3; i++ {
+		families, err := client.MetricFamilies(context.Background())
+		if err != nil {
+			t.Fatalf("scrape %d: %v", i, err)
+		}
+		if len(families) != 1 || families[0].GetName() != "kube_pod_info" {
+			t.Fatalf("unexpected families %v", families)
+		}
+	}
+
+	if got := api.count("list"); got != 1 {
+		t.Fatalf("expected 1 service list, got %d", got)
+	}
+	if got := api.count("healthz"); got != 1 {
+		t.Fatalf("expected 1 health check, got %d", got)
+	}
+	if got := api.count("metrics"); got != 3 {
+		t.Fatalf("expected 3 scrapes, got %d", got)
+	}
+}
+
+func TestClientResolvesServiceAgainAfterScrapeFailure(t *testing.T) {
+	api := newFakeAPIServer(t)
+
+	client := NewClient(Options{Kubeconfig: api.kubeconfig})
+	if _, err := client.MetricFamilies(context.Background()); err != nil {
+		t.Fatalf("first scrape: %v", err)
+	}
+
+	// kube-state-metrics was reinstalled in another namespace
+	api.setNamespace("kube-system")
+	if _, err := client.MetricFamilies(context.Background()); err != nil {
+		t.Fatalf("scrape after move: %v", err)
+	}
+	if got := api.count("list"); got != 2 {
+		t.Fatalf("expected the service to be resolved again, got %d lists", got)
+	}
+
+	api.setNamespace("")
+	if _, err := client.MetricFamilies(context.Background()); !errors.Is(err, ErrServiceNotFound) {
+		t.Fatalf("expected ErrServiceNotFound once the service is gone, got %v", err)
+	}
+	api.setNamespace("monitoring")
+	if _, err := client.MetricFamilies(context.Background()); err != nil {
+		t.Fatalf("expected the next scrape to resolve again, got %v", err)
+	}
+}
+
+func TestClientMergesShardScrapes(t *testing.T) {
+	api := newFakeAPIServer(t)
+
+	client := NewClient(Options{Kubeconfig: api.kubeconfig, Sharded: true})
+	families, err := client.MetricFamilies(context.Background())
+	if err != nil {
+		t.Fatalf("MetricFamilies returned error: %v", err)
+	}
+	if len(families) != 1 || len(families[0].Metric) != 2 {
+		t.Fatalf("expected one family with a series per shard, got %v", families)
+	}
+	if got := api.count("shard"); got != 2 {
+		t.Fatalf("expected each shard to be scraped once, got %d", got)
+	}
+	if got := api.count("metrics"); got != 0 {
+		t.Fatalf("expected the service not to be scraped, got %d", got)
+	}
+
+	raw, err := client.RawMetrics(context.Background())
+	if err != nil {
+		t.Fatalf("RawMetrics returned error: %v", err)
+	}
+	if strings.Count(raw, "# TYPE kube_pod_info") != 1 || !strings.Contains(raw, `pod="ksm-0"`) || !strings.Contains(raw, `pod="ksm-1"`) {
+		t.Fatalf("expected merged text exposition, got %q", raw)
+	}
+	if got := api.count("endpoints"); got != 1 {
+		t.Fatalf("expected shards to be resolved once, got %d", got)
+	}
+}
+
+func TestClientDecompressesNegotiatedEncodings(t *testing.T) {
+	plain := int64(len("# TYPE kube_pod_info gauge\nkube_pod_info{namespace=\"default\",pod=\"p1\"} 1\n"))
+
+	for _, encoding := range []string{EncodingGzip, EncodingZstd} {
+		t.Run(encoding, func(t *testing.T) {
+			api := newFakeAPIServer(t)
+			api.encoding = encoding
+
+			client := NewClient(Options{Kubeconfig: api.kubeconfig})
+			families, err := client.MetricFamilies(context.Background())
+			if err != nil {
+				t.Fatalf("MetricFamilies returned error: %v", err)
+			}
+			if len(families) != 1 || families[0].GetName() != "kube_pod_info" {
+				t.Fatalf("unexpected families %v", families)
+			}
+			raw, err := client.RawMetrics(context.Background())
+			if err != nil || !strings.Contains(raw, "kube_pod_info{") {
+				t.Fatalf("unexpected raw metrics %q, %v", raw, err)
+			}
+
+			stats := client.Stats()
+			if stats.Scrapes != 2 || stats.Encoding != encoding || stats.Series != 2 {
+				t.Fatalf("unexpected stats %+v", stats)
+			}
+			if stats.Decoded != 2*plain || stats.Transferred == stats.Decoded {
+				t.Fatalf("expected %d decoded bytes from a compressed transfer, got %+v", 2*plain, stats)
+			}
+		})
+	}
+}
+
+func TestClientReadsUncompressedResponses(t *testing.T) {
+	api := newFakeAPIServer(t)
+
+	client := NewClient(Options{Kubeconfig: api.kubeconfig})
+	if _, err := client.MetricFamilies(context.Background()); err != nil {
+		t.Fatalf("MetricFamilies returned error: %v", err)
+	}
+	if stats := client.Stats(); stats.Encoding != EncodingIdentity || stats.Transferred != stats.Decoded || stats.Series != 1 {
+		t.Fatalf("unexpected stats %+v", stats)
+	}
+}
+
+func TestRequestTimeoutDoesNotBoundScrapeBodies(t *testing.T) {
+	api := newFakeAPIServer(t)
+	api.bodyDelay = 300 * time.Millisecond
+
+	client := NewClient(Options{Kubeconfig: api.kubeconfig, RequestTimeout: 100 * time.Millisecond})
+	families, err := client.MetricFamilies(context.Background())
+	if err != nil {
+		t.Fatalf("expected a slow body to outlast the request timeout, got %v", err)
+	}
+	if len(families) != 1 {
+		t.Fatalf("unexpected families %v", families)
+	}
+}
+
+func TestRequestTimeoutBoundsTheWaitForAResponse(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		time.Sleep(300 * time.Millisecond)
+	}))
+	t.Cleanup(server.Close)
+
+	client := NewClient(Options{PrometheusURL: server.URL, RequestTimeout: 50 * time.Millisecond})
+	if _, err := client.MetricFamilies(context.Background()); !errors.Is(err, context.DeadlineExceeded) || errors.Is(err, context.Canceled) {
+		t.Fatalf("expected a deadline error, got %v", err)
+	}
+}
+
+// fakeAPIServer serves a kube-state-metrics service list and its proxied health and metrics
+// endpoints, counting requests by kind.
+type fakeAPIServer struct {
+	kubeconfig string
+
+	mu        sync.Mutex
+	namespace string
+	denied    string
+	// encoding compresses metrics responses when the scrape accepts it.
+	encoding string
+	// bodyDelay holds back metrics response bodies after the headers are sent.
+	bodyDelay time.Duration
+	// unhealthy makes /healthz report a failure.
+	unhealthy bool
+	counts    map[string]int
+}
+
+func newFakeAPIServer(t *testing.T) *fakeAPIServer {
+	t.Helper()
+
+	api := &fakeAPIServer{namespace: "monitoring", counts: make(map[string]int)}
+	server := httptest.NewServer(http.HandlerFunc(api.serveHTTP))
+	t.Cleanup(server.Close)
+
+	api.kubeconfig = writeKubeconfig(t, server.URL, "test-token")
+
+	return api
+}
+
+func (api *fakeAPIServer) setNamespace(ns string) {
+	api.mu.Lock()
+	defer api.mu.Unlock()
+	api.namespace = ns
+}
+
+func (api *fakeAPIServer) count(kind string) int {
+	api.mu.Lock()
+	defer api.mu.Unlock()
+	return api.counts[kind]
+}
+
+func (api *fakeAPIServer) serveHTTP(w http.ResponseWriter, r *http.Request) {
+	api.mu.Lock()
+	ns, encoding, bodyDelay, unhealthy := api.namespace, api.encoding, api.bodyDelay, api.unhealthy
+	api.mu.Unlock()
+
+	proxy := "/api/v1/namespaces/" + ns + "/services/http:kube-state-metrics:8080/proxy/"
+	pods := "/api/v1/namespaces/" + ns + "/pods/"
+	switch {
+	case ns != "" && r.URL.Path == "/api/v1/namespaces/"+ns+"/endpoints/kube-state-metrics":
+		api.record("endpoints")
+		w.Header().Set("Content-Type", "application/json")
+		w.Write([]byte(`{"kind":"Endpoints","apiVersion":"v1","metadata":{"name":"kube-state-metrics","namespace":"` + ns + `"},` +
+			`"subsets":[{"addresses":[{"ip":"10.0.0.1","targetRef":{"kind":"Pod","name":"ksm-0"}},{"ip":"10.0.0.2","targetRef":{"kind":"Pod","name":"ksm-1"}}],` +
+			`"ports":[{"port":8080}]}]}`))
+	case ns != "" && strings.HasPrefix(r.URL.Path, pods) && strings.HasSuffix(r.URL.Path, ":8080/proxy/metrics"):
+		api.record("shard")
+		pod := strings.TrimSuffix(strings.TrimPrefix(r.URL.Path, pods+"http:"), ":8080/proxy/metrics")
+		w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+		w.Write([]byte("# TYPE kube_pod_info gauge\nkube_pod_info{namespace=\"default\",pod=\"" + pod + "\"} 1\n"))
+	case r.URL.Path == "/api/v1/services":
+		api.record("list")
+		items := ""
+		if ns != "" {
+			items = `{"metadata":{"name":"kube-state-metrics","namespace":"` + ns + `"},"spec":{"ports":[{"port":8080},{"name":"telemetry","port":8081}]}}`
+		}
+		w.Header().Set("Content-Type", "application/json")
+		w.Write([]byte(`{"kind":"ServiceList","apiVersion":"v1","items":[` + items + `]}`))
+	case r.URL.Path == "/apis/authorization.k8s.io/v1/selfsubjectaccessreviews":
+		api.record("review")
+		var review map[string]interface{}
+		json.NewDecoder(r.Body).Decode(&review)
+		attrs := review["spec"].(map[string]interface{})["resourceAttributes"].(map[string]interface{})
+		review["status"] = map[string]interface{}{"allowed": attrs["resource"] != api.denied}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(review)
+	case ns != "" && r.URL.Path == "/api/v1/namespaces/"+ns+"/services/http:kube-state-metrics:8081/proxy/metrics":
+		api.record("telemetry")
+		w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+		w.Write([]byte("# TYPE kube_state_metrics_build_info gauge\n" +
+			"kube_state_metrics_build_info{version=\"v2.13.0\"} 1\n" +
+			"# TYPE kube_state_metrics_list_total counter\n" +
+			"kube_state_metrics_list_total{resource=\"*v1.Pod\",result=\"success\"} 12\n" +
+			"kube_state_metrics_list_total{resource=\"*v1.Secret\",result=\"error\"} 3\n"))
+	case ns != "" && r.URL.Path == proxy+"healthz":
+		api.record("healthz")
+		if unhealthy {
+			w.Write([]byte("not ready"))
+			return
+		}
+		w.Write([]byte("ok"))
+	case ns != "" && r.URL.Path == proxy+"metrics":
+		api.record("metrics")
+		w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+		body := []byte("# TYPE kube_pod_info gauge\nkube_pod_info{namespace=\"default\",pod=\"p1\"} 1\n")
+		if encoding != "" && strings.Contains(r.Header.Get("Accept-Encoding"), encoding) {
+			w.Header().Set("Content-Encoding", encoding)
+			body = compress(encoding, body)
+		}
+		if bodyDelay > 0 {
+			w.WriteHeader(http.StatusOK)
+			w.(http.Flusher).Flush()
+			time.Sleep(bodyDelay)
+		}
+		w.Write(body)
+	default:
+		http.NotFound(w, r)
+	}
+}
+
+func compress(encoding string, body []byte) []byte {
+	var buf bytes.Buffer
+	switch encoding {
+	case EncodingGzip:
+		gz := gzip.NewWriter(&buf)
+		gz.Write(body)
+		gz.Close()
+	case EncodingZstd:
+		zw, _ := zstd.NewWriter(&buf)
+		zw.Write(body)
+		zw.Close()
+	}
+	return buf.Bytes()
+}
+
+func (api *fakeAPIServer) record(kind string) {
+	api.mu.Lock()
+	defer api.mu.Unlock()
+	api.counts[kind]++
+}
@@ -0,0 +1,384 @@
+/*
+ * Copyright 2018 Paul Welch
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License"); you may not use this file except in compliance with the License. You may obtain a copy of the License at
+ *
+ * http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software distributed under the License is distributed on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the License for the specific language governing permissions and limitations under the License.
+ */
+
+package kubestate
+
+import (
+	"sort"
+	"strings"
+
+	dto "github.com/prometheus/client_model/go"
+)
+
+// ObjectRef identifies a namespaced object.
+type ObjectRef struct {
+	Namespace string
+	Name      string
+}
+
+// Cluster is an index of one scrape by object, built once and shared by every view.
+// Cpu is in cores and memory in bytes.
+type Cluster struct {
+	Nodes      map[string]*Node
+	Namespaces map[string]*Namespace
+	Pods       map[ObjectRef]*Pod
+	// Workloads are keyed by kind, one of Deployment, StatefulSet, DaemonSet and Job.
+	Workloads map[string]map[ObjectRef]*Workload
+	Claims    map[ObjectRef]*Claim
+}
+
+// Node is a node with its capacity, allocatable, readiness and the pods scheduled on it.
+type Node struct {
+	Name              string
+	Labels            map[string]string
+	Ready             bool
+	CPUCapacity       float64
+	CPUAllocatable    float64
+	MemoryCapacity    float64
+	MemoryAllocatable float64
+	Pods              []*Pod
+}
+
+// Namespace is a namespace with its pods.
+type Namespace struct {
+	Name   string
+	Labels map[string]string
+	Pods   []*Pod
+}
+
+// Pod is a pod with its phase, node and containers.
+type Pod struct {
+	Namespace  string
+	Name       string
+	Node       string
+	Phase      string
+	Labels     map[string]string
+	Containers []*Container
+}
+
+// Container is a pod container with its requests, limits and status.
+type Container struct {
+	Name          string
+	CPURequest    float64
+	CPULimit      float64
+	MemoryRequest float64
+	MemoryLimit   float64
+	Restarts      float64
+	Ready         bool
+
+	// resourced is set when a request or limit was reported, for any resource.
+	resourced bool
+}
+
+// Workload is the replica counts of a deployment, statefulset or daemonset, or the failed
+// pods of a job.
+type Workload struct {
+	Kind        string
+	Namespace   string
+	Name        string
+	Labels      map[string]string
+	Replicas    float64
+	Available   float64
+	Unavailable float64
+	Failed      float64
+}
+
+// Claim is a persistent volume claim and its phase.
+type Claim struct {
+	Namespace string
+	Name      string
+	Phase     string
+}
+
+// Workload kinds.
+const (
+	KindDeployment  = "Deployment"
+	KindStatefulSet = "StatefulSet"
+	KindDaemonSet   = "DaemonSet"
+	KindJob         = "Job"
+)
+
+// workloadMetrics maps the replica families of each workload kind to the label naming the
+// workload and the field they set.
+var workloadMetrics = map[string]struct {
+	kind, label string
+	set         func(w *Workload, value float64)
+}{
+	"kube_deployment_spec_replicas":                  {KindDeployment, "deployment", func(w *Workload, v float64) { w.Replicas += v }},
+	"kube_deployment_status_replicas_available":      {KindDeployment, "deployment", func(w *Workload, v float64) { w.Available += v }},
+	"kube_deployment_status_replicas_unavailable":    {KindDeployment, "deployment", func(w *Workload, v float64) { w.Unavailable += v }},
+	"kube_deployment_labels":                         {KindDeployment, "deployment", nil},
+	"kube_statefulset_replicas":                      {KindStatefulSet, "statefulset", func(w *Workload, v float64) { w.Replicas += v }},
+	"kube_statefulset_status_replicas_ready":         {KindStatefulSet, "statefulset", func(w *Workload, v float64) { w.Available += v }},
+	"kube_statefulset_labels":                        {KindStatefulSet, "statefulset", nil},
+	"kube_daemonset_status_desired_number_scheduled": {KindDaemonSet, "daemonset", func(w *Workload, v float64) { w.Replicas += v }},
+	"kube_daemonset_status_number_available":         {KindDaemonSet, "daemonset", func(w *Workload, v float64) { w.Available += v }},
+	"kube_daemonset_status_number_unavailable":       {KindDaemonSet, "daemonset", func(w *Workload, v float64) { w.Unavailable += v }},
+	"kube_daemonset_labels":                          {KindDaemonSet, "daemonset", nil},
+	"kube_job_status_failed":                         {KindJob, "job_name", func(w *Workload, v float64) { w.Failed += v }},
+	"kube_job_labels":                                {KindJob, "job_name", nil},
+}
+
+// clusterFamilies are the families NewCluster reads besides those in workloadMetrics.
+var clusterFamilies = []string{
+	"kube_node_info",
+	"kube_node_labels",
+	"kube_node_status_condition",
+	"kube_node_status_capacity",
+	"kube_node_status_allocatable",
+	"kube_namespace_labels",
+	"kube_pod_info",
+	"kube_pod_labels",
+	"kube_pod_status_phase",
+	"kube_pod_container_resource_requests",
+	"kube_pod_container_resource_limits",
+	"kube_pod_container_status_restarts_total",
+	"kube_pod_container_status_ready",
+	"kube_persistentvolumeclaim_status_phase",
+}
+
+// ClusterFilter keeps only the families NewCluster reads, including the legacy names Normalize
+// renames to them, so views built on a Cluster can skip the rest of a scrape.
+func ClusterFilter() Filter {
+	names := append([]string(nil), clusterFamilies...)
+	for name := range workloadMetrics {
+		names = append(names, name)
+	}
+	wanted := make(map[string]bool, len(names))
+	for _, name := range names {
+		wanted[name] = true
+	}
+	for _, rename := range MetricRenames {
+		if wanted[rename.Canonical] {
+			names = append(names, rename.Legacy)
+		}
+	}
+	sort.Strings(names)
+	return Filter{Names: names}
+}
+
+// NewCluster indexes metricFamilies, normalizing legacy metric names first.
+func NewCluster(metricFamilies []*dto.MetricFamily) *Cluster {
+	c := &Cluster{
+		Nodes:      make(map[string]*Node),
+		Namespaces: make(map[string]*Namespace),
+		Pods:       make(map[ObjectRef]*Pod),
+		Workloads:  make(map[string]map[ObjectRef]*Workload),
+		Claims:     make(map[ObjectRef]*Claim),
+	}
+
+	for _, mf := range Normalize(metricFamilies) {
+		name := mf.GetName()
+		for _, m := range mf.Metric {
+			labels := make(map[string]string, len(m.Label))
+			for _, l := range m.Label {
+				labels[l.GetName()] = l.GetValue()
+			}
+			c.add(name, labels, metricValue(m))
+		}
+	}
+
+	for _, p := range c.Pods {
+		if p.Node != "" {
+			n := c.node(p.Node)
+			n.Pods = append(n.Pods, p)
+		}
+		ns := c.namespace(p.Namespace)
+		ns.Pods = append(ns.Pods, p)
+	}
+	for _, n := range c.Nodes {
+		sortPods(n.Pods)
+	}
+	for _, ns := range c.Namespaces {
+		sortPods(ns.Pods)
+	}
+
+	return c
+}
+
+func metricValue(m *dto.Metric) float64 {
+	switch {
+	case m.Gauge != nil:
+		return m.GetGauge().GetValue()
+	case m.Counter != nil:
+		return m.GetCounter().GetValue()
+	}
+	return m.GetUntyped().GetValue()
+}
+
+func (c *Cluster) add(name string, labels map[string]string, value float64) {
+	ns := labels["namespace"]
+
+	switch name {
+	case "kube_node_info":
+		c.node(labels["node"])
+	case "kube_node_labels":
+		c.node(labels["node"]).Labels = objectLabels(labels)
+	case "kube_node_status_condition":
+		if labels["condition"] == "Ready" && labels["status"] == "true" && value == 1 {
+			c.node(labels["node"]).Ready = true
+		} else {
+			c.node(labels["node"])
+		}
+	case "kube_node_status_capacity", "kube_node_status_allocatable":
+		if labels["node"] == "" {
+			return
+		}
+		n := c.node(labels["node"])
+		switch {
+		case name == "kube_node_status_capacity" && labels["resource"] == "cpu":
+			n.CPUCapacity = value
+		case name == "kube_node_status_capacity" && labels["resource"] == "memory":
+			n.MemoryCapacity = value
+		case name == "kube_node_status_allocatable" && labels["resource"] == "cpu":
+			n.CPUAllocatable = value
+		case name == "kube_node_status_allocatable" && labels["resource"] == "memory":
+			n.MemoryAllocatable = value
+		}
+	case "kube_namespace_labels":
+		c.namespace(ns).Labels = objectLabels(labels)
+	case "kube_pod_info":
+		if p := c.pod(ns, labels["pod"]); p != nil && labels["node"] != "" {
+			p.Node = labels["node"]
+		}
+	case "kube_pod_labels":
+		if p := c.pod(ns, labels["pod"]); p != nil {
+			p.Labels = objectLabels(labels)
+		}
+	case "kube_pod_status_phase":
+		if p := c.pod(ns, labels["pod"]); p != nil && value == 1 {
+			p.Phase = labels["phase"]
+		}
+	case "kube_pod_container_resource_requests", "kube_pod_container_resource_limits":
+		p := c.pod(ns, labels["pod"])
+		if p == nil || labels["container"] == "" {
+			return
+		}
+		if p.Node == "" {
+			p.Node = labels["node"]
+		}
+		co := p.container(labels["container"])
+		co.resourced = true
+		switch {
+		case name == "kube_pod_container_resource_requests" && labels["resource"] == "cpu":
+			co.CPURequest += value
+		case name == "kube_pod_container_resource_requests" && labels["resource"] == "memory":
+			co.MemoryRequest += value
+		case name == "kube_pod_container_resource_limits" && labels["resource"] == "cpu":
+			co.CPULimit += value
+		case name == "kube_pod_container_resource_limits" && labels["resource"] == "memory":
+			co.MemoryLimit += value
+		}
+	case "kube_pod_container_status_restarts_total":
+		if p := c.pod(ns, labels["pod"]); p != nil && labels["container"] != "" {
+			p.container(labels["container"]).Restarts += value
+		}
+	case "kube_pod_container_status_ready":
+		if p := c.pod(ns, labels["pod"]); p != nil && labels["container"] != "" {
+			p.container(labels["container"]).Ready = value == 1
+		}
+	case "kube_persistentvolumeclaim_status_phase":
+		if ns == "" || labels["persistentvolumeclaim"] == "" {
+			return
+		}
+		ref := ObjectRef{ns, labels["persistentvolumeclaim"]}
+		if c.Claims[ref] == nil {
+			c.Claims[ref] = &Claim{Namespace: ns, Name: ref.Name}
+		}
+		if value == 1 {
+			c.Claims[ref].Phase = labels["phase"]
+		}
+	default:
+		metric, ok := workloadMetrics[name]
+		if !ok || ns == "" || labels[metric.label] == "" {
+			return
+		}
+		w := c.workload(metric.kind, ns, labels[metric.label])
+		if metric.set != nil {
+			metric.set(w, value)
+		} else {
+			w.Labels = objectLabels(labels)
+		}
+	}
+}
+
+func (c *Cluster) node(name string) *Node {
+	if c.Nodes[name] == nil {
+		c.Nodes[name] = &Node{Name: name}
+	}
+	return c.Nodes[name]
+}
+
+func (c *Cluster) namespace(name string) *Namespace {
+	if c.Namespaces[name] == nil {
+		c.Namespaces[name] = &Namespace{Name: name}
+	}
+	return c.Namespaces[name]
+}
+
+// pod returns the pod, adding it on first sight; it is nil when the series does not name one.
+func (c *Cluster) pod(namespace, name string) *Pod {
+	if namespace == "" || name == "" {
+		return nil
+	}
+	ref := ObjectRef{namespace, name}
+	if c.Pods[ref] == nil {
+		c.Pods[ref] = &Pod{Namespace: namespace, Name: name}
+	}
+	return c.Pods[ref]
+}
+
+func (c *Cluster) workload(kind, namespace, name string) *Workload {
+	if c.Workloads[kind] == nil {
+		c.Workloads[kind] = make(map[ObjectRef]*Workload)
+	}
+	ref := ObjectRef{namespace, name}
+	if c.Workloads[kind][ref] == nil {
+		c.Workloads[kind][ref] = &Workload{Kind: kind, Namespace: namespace, Name: name}
+	}
+	return c.Workloads[kind][ref]
+}
+
+func (p *Pod) container(name string) *Container {
+	for _, co := range p.Containers {
+		if co.Name == name {
+			return co
+		}
+	}
+	co := &Container{Name: name}
+	p.Containers = append(p.Containers, co)
+	sort.Slice(p.Containers, func(i, j int) bool { return p.Containers[i].Name < p.Containers[j].Name })
+	return co
+}
+
+// objectLabels returns the Kubernetes labels carried as label_ prefixed metric labels.
+func objectLabels(labels map[string]string) map[string]string {
+	out := make(map[string]string)
+	for k, v := range labels {
+		if strings.HasPrefix(k, "label_") {
+			out[strings.TrimPrefix(k, "label_")] = v
+		}
+	}
+	return out
+}
+
+func sortPods(pods []*Pod) {
+	sort.Slice(pods, func(i, j int) bool {
+		if pods[i].Namespace != pods[j].Namespace {
+			return pods[i].Namespace < pods[j].Namespace
+		}
+		return pods[i].Name < pods[j].Name
+	})
+}
+
+// inNamespace reports whether ns is selected by namespace, which may be AllNamespaces.
+func inNamespace(namespace, ns string) bool {
+	return namespace == AllNamespaces || namespace == ns
+}
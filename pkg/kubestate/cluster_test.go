@@ -0,0 +1,75 @@
+package kubestate
+
+import (
+	"testing"
+
+	dto "github.com/prometheus/client_model/go"
+)
+
+func TestNewClusterIndexesObjects(t *testing.T) {
+	families := append(sampleFamilies(),
+		family("kube_node_status_condition",
+			gauge(1, "node", "node1", "condition", "Ready", "status", "true"),
+			gauge(1, "node", "node3", "condition", "Ready", "status", "false"),
+		),
+		family("kube_node_labels", gauge(1, "node", "node1", "label_topology_kubernetes_io_zone", "a")),
+		family("kube_pod_status_phase",
+			gauge(1, "namespace", "default", "pod", "api-1", "phase", "Running"),
+			gauge(0, "namespace", "default", "pod", "api-1", "phase", "Pending"),
+		),
+		family("kube_pod_container_status_restarts_total", counter(4, "namespace", "default", "pod", "api-1", "container", "api")),
+		family("kube_pod_container_status_ready", gauge(1, "namespace", "default", "pod", "api-1", "container", "sidecar")),
+		family("kube_statefulset_replicas", gauge(3, "namespace", "data", "statefulset", "db")),
+		family("kube_statefulset_status_replicas_ready", gauge(2, "namespace", "data", "statefulset", "db")),
+		family("kube_job_status_failed", gauge(2, "namespace", "default", "job_name", "migrate")),
+		family("kube_persistentvolumeclaim_status_phase",
+			gauge(1, "namespace", "data", "persistentvolumeclaim", "db-0", "phase", "Pending"),
+			gauge(0, "namespace", "data", "persistentvolumeclaim", "db-0", "phase", "Bound"),
+		),
+	)
+
+	c := NewCluster(families)
+
+	if n := c.Nodes["node1"]; n == nil || !n.Ready || n.CPUAllocatable != 4 || n.Labels["topology_kubernetes_io_zone"] != "a" || len(n.Pods) != 2 {
+		t.Fatalf("unexpected node1 %+v", n)
+	}
+	if n := c.Nodes["node3"]; n == nil || n.Ready || len(n.Pods) != 0 {
+		t.Fatalf("expected a not ready node3 without pods, got %+v", n)
+	}
+
+	p := c.Pods[ObjectRef{"default", "api-1"}]
+	if p == nil || p.Phase != "Running" || p.Node != "node1" || len(p.Containers) != 2 {
+		t.Fatalf("unexpected pod %+v", p)
+	}
+	if co := p.Containers[0]; co.Name != "api" || co.CPURequest != 2 || co.Restarts != 4 {
+		t.Fatalf("unexpected api container %+v", co)
+	}
+	if co := p.Containers[1]; co.Name != "sidecar" || !co.Ready {
+		t.Fatalf("unexpected sidecar container %+v", co)
+	}
+	if ns := c.Namespaces["default"]; ns == nil || len(ns.Pods) != 3 || ns.Pods[0].Name != "api-1" {
+		t.Fatalf("unexpected default namespace %+v", ns)
+	}
+
+	if w := c.Workloads[KindStatefulSet][ObjectRef{"data", "db"}]; w == nil || w.Replicas != 3 || w.Available != 2 {
+		t.Fatalf("unexpected statefulset %+v", w)
+	}
+	if w := c.Workloads[KindJob][ObjectRef{"default", "migrate"}]; w == nil || w.Failed != 2 {
+		t.Fatalf("unexpected job %+v", w)
+	}
+	if pvc := c.Claims[ObjectRef{"data", "db-0"}]; pvc == nil || pvc.Phase != "Pending" {
+		t.Fatalf("unexpected claim %+v", pvc)
+	}
+
+	// containers without a request or limit have no resource rows
+	if rows := c.PodResources("default"); len(rows) != 3 {
+		t.Fatalf("expected 3 resource rows in default, got %+v", rows)
+	}
+}
+
+func counter(value float64, labels ...string) *dto.Metric {
+	m := gauge(0, labels...)
+	m.Gauge = nil
+	m.Counter = &dto.Counter{Value: &value}
+	return m
+}
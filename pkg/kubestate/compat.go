@@ -0,0 +1,154 @@
+/*
+ * Copyright 2018 Paul Welch
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License"); you may not use this file except in compliance with the License. You may obtain a copy of the License at
+ *
+ * http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software distributed under the License is distributed on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the License for the specific language governing permissions and limitations under the License.
+ */
+
+package kubestate
+
+import (
+	"sort"
+
+	dto "github.com/prometheus/client_model/go"
+)
+
+// MetricRename maps a family exposed by older kube-state-metrics releases to the family that
+// replaced it.
+type MetricRename struct {
+	Legacy    string
+	Canonical string
+	// Labels are added to each series, such as the resource label that replaced per resource names.
+	Labels map[string]string
+	// RenameLabels renames label names, such as hpa to horizontalpodautoscaler.
+	RenameLabels map[string]string
+	// Removed is the first kube-state-metrics release without the legacy family.
+	Removed string
+}
+
+// MetricRenames is the compatibility table applied by Normalize. Ingress families kept their
+// names when kube-state-metrics moved to networking.k8s.io/v1 and need no entry.
+var MetricRenames = []MetricRename{
+	{Legacy: "kube_pod_container_resource_requests_cpu_cores", Canonical: "kube_pod_container_resource_requests", Labels: map[string]string{"resource": "cpu", "unit": "core"}, Removed: "v2.0.0"},
+	{Legacy: "kube_pod_container_resource_requests_memory_bytes", Canonical: "kube_pod_container_resource_requests", Labels: map[string]string{"resource": "memory", "unit": "byte"}, Removed: "v2.0.0"},
+	{Legacy: "kube_pod_container_resource_limits_cpu_cores", Canonical: "kube_pod_container_resource_limits", Labels: map[string]string{"resource": "cpu", "unit": "core"}, Removed: "v2.0.0"},
+	{Legacy: "kube_pod_container_resource_limits_memory_bytes", Canonical: "kube_pod_container_resource_limits", Labels: map[string]string{"resource": "memory", "unit": "byte"}, Removed: "v2.0.0"},
+	{Legacy: "kube_node_status_capacity_cpu_cores", Canonical: "kube_node_status_capacity", Labels: map[string]string{"resource": "cpu", "unit": "core"}, Removed: "v2.0.0"},
+	{Legacy: "kube_node_status_capacity_memory_bytes", Canonical: "kube_node_status_capacity", Labels: map[string]string{"resource": "memory", "unit": "byte"}, Removed: "v2.0.0"},
+	{Legacy: "kube_node_status_capacity_pods", Canonical: "kube_node_status_capacity", Labels: map[string]string{"resource": "pods", "unit": "integer"}, Removed: "v2.0.0"},
+	{Legacy: "kube_node_status_allocatable_cpu_cores", Canonical: "kube_node_status_allocatable", Labels: map[string]string{"resource": "cpu", "unit": "core"}, Removed: "v2.0.0"},
+	{Legacy: "kube_node_status_allocatable_memory_bytes", Canonical: "kube_node_status_allocatable", Labels: map[string]string{"resource": "memory", "unit": "byte"}, Removed: "v2.0.0"},
+	{Legacy: "kube_node_status_allocatable_pods", Canonical: "kube_node_status_allocatable", Labels: map[string]string{"resource": "pods", "unit": "integer"}, Removed: "v2.0.0"},
+	{Legacy: "kube_daemonset_updated_number_scheduled", Canonical: "kube_daemonset_status_updated_number_scheduled", Removed: "v2.0.0"},
+	{Legacy: "kube_hpa_labels", Canonical: "kube_horizontalpodautoscaler_labels", RenameLabels: hpaLabel, Removed: "v2.0.0"},
+	{Legacy: "kube_hpa_metadata_generation", Canonical: "kube_horizontalpodautoscaler_metadata_generation", RenameLabels: hpaLabel, Removed: "v2.0.0"},
+	{Legacy: "kube_hpa_spec_max_replicas", Canonical: "kube_horizontalpodautoscaler_spec_max_replicas", RenameLabels: hpaLabel, Removed: "v2.0.0"},
+	{Legacy: "kube_hpa_spec_min_replicas", Canonical: "kube_horizontalpodautoscaler_spec_min_replicas", RenameLabels: hpaLabel, Removed: "v2.0.0"},
+	{Legacy: "kube_hpa_spec_target_metric", Canonical: "kube_horizontalpodautoscaler_spec_target_metric", RenameLabels: hpaLabel, Removed: "v2.0.0"},
+	{Legacy: "kube_hpa_status_condition", Canonical: "kube_horizontalpodautoscaler_status_condition", RenameLabels: hpaLabel, Removed: "v2.0.0"},
+	{Legacy: "kube_hpa_status_current_replicas", Canonical: "kube_horizontalpodautoscaler_status_current_replicas", RenameLabels: hpaLabel, Removed: "v2.0.0"},
+	{Legacy: "kube_hpa_status_desired_replicas", Canonical: "kube_horizontalpodautoscaler_status_desired_replicas", RenameLabels: hpaLabel, Removed: "v2.0.0"},
+}
+
+var hpaLabel = map[string]string{"hpa": "horizontalpodautoscaler"}
+
+// LegacyFamilies returns the renames that apply to families, in table order, so callers can
+// tell an older kube-state-metrics release is being normalized.
+func LegacyFamilies(metricFamilies []*dto.MetricFamily) []MetricRename {
+	present := make(map[string]bool, len(metricFamilies))
+	for _, mf := range metricFamilies {
+		present[mf.GetName()] = true
+	}
+
+	renames := make([]MetricRename, 0)
+	for _, rename := range MetricRenames {
+		if present[rename.Legacy] {
+			renames = append(renames, rename)
+		}
+	}
+	return renames
+}
+
+// Normalize rewrites legacy families into their current names and labels, so the views only
+// need to know one naming scheme. Transitional releases expose both forms; there the current
+// family wins and the legacy one is dropped rather than counted twice. The input is not modified,
+// and is returned as is when it has no legacy families.
+func Normalize(metricFamilies []*dto.MetricFamily) []*dto.MetricFamily {
+	renames := LegacyFamilies(metricFamilies)
+	if len(renames) == 0 {
+		return metricFamilies
+	}
+
+	byLegacy := make(map[string]MetricRename, len(renames))
+	for _, rename := range renames {
+		byLegacy[rename.Legacy] = rename
+	}
+	present := make(map[string]bool, len(metricFamilies))
+	for _, mf := range metricFamilies {
+		present[mf.GetName()] = true
+	}
+
+	normalized := make([]*dto.MetricFamily, 0, len(metricFamilies))
+	converted := make(map[string]*dto.MetricFamily)
+	for _, mf := range metricFamilies {
+		rename, ok := byLegacy[mf.GetName()]
+		if !ok {
+			normalized = append(normalized, mf)
+			continue
+		}
+		if present[rename.Canonical] {
+			continue
+		}
+
+		canonical := converted[rename.Canonical]
+		if canonical == nil {
+			name := rename.Canonical
+			canonical = &dto.MetricFamily{Name: &name, Help: mf.Help, Type: mf.Type}
+			converted[rename.Canonical] = canonical
+		}
+		for _, m := range mf.Metric {
+			canonical.Metric = append(canonical.Metric, rename.apply(m))
+		}
+	}
+
+	names := make([]string, 0, len(converted))
+	for name := range converted {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		normalized = append(normalized, converted[name])
+	}
+
+	return normalized
+}
+
+// apply returns a copy of m with the rename's labels added and renamed.
+func (r MetricRename) apply(m *dto.Metric) *dto.Metric {
+	labels := make([]*dto.LabelPair, 0, len(m.Label)+len(r.Labels))
+	for _, l := range m.Label {
+		if to, ok := r.RenameLabels[l.GetName()]; ok {
+			name := to
+			l = &dto.LabelPair{Name: &name, Value: l.Value}
+		}
+		labels = append(labels, l)
+	}
+	for name, value := range r.Labels {
+		name, value := name, value
+		labels = append(labels, &dto.LabelPair{Name: &name, Value: &value})
+	}
+	sort.Slice(labels, func(i, j int) bool { return labels[i].GetName() < labels[j].GetName() })
+
+	return &dto.Metric{
+		Label:       labels,
+		Gauge:       m.Gauge,
+		Counter:     m.Counter,
+		Summary:     m.Summary,
+		Untyped:     m.Untyped,
+		Histogram:   m.Histogram,
+		TimestampMs: m.TimestampMs,
+	}
+}
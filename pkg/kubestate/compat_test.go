@@ -0,0 +1,115 @@
+package kubestate
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+
+	dto "github.com/prometheus/client_model/go"
+)
+
+var fixtureVersions = []struct {
+	version string
+	legacy  int
+}{
+	{"v1.8.0", 10},
+	{"v1.9.8", 10},
+	{"v2.13.0", 0},
+}
+
+func loadFixture(t *testing.T, version string) []*dto.MetricFamily {
+	t.Helper()
+
+	resp, err := os.ReadFile(filepath.Join("testdata", "ksm-"+version+".prom"))
+	if err != nil {
+		t.Fatalf("reading fixture: %v", err)
+	}
+	families, err := ParseMetrics(resp)
+	if err != nil {
+		t.Fatalf("parsing fixture: %v", err)
+	}
+	return families
+}
+
+func TestViewsAgreeAcrossKubeStateMetricsVersions(t *testing.T) {
+	want := loadFixture(t, "v2.13.0")
+	wantPods, wantNodes := TopPods(want, AllNamespaces), TopNodes(want, AllNamespaces)
+	if len(wantPods) != 2 || len(wantNodes) != 1 || wantNodes[0].CPUAllocatable != 4 {
+		t.Fatalf("unexpected v2 baseline %+v %+v", wantPods, wantNodes)
+	}
+
+	for _, fixture := range fixtureVersions {
+		t.Run(fixture.version, func(t *testing.T) {
+			families := loadFixture(t, fixture.version)
+
+			if got := LegacyFamilies(families); len(got) != fixture.legacy {
+				t.Fatalf("expected %d legacy families, got %d", fixture.legacy, len(got))
+			}
+			if got := TopPods(families, AllNamespaces); !reflect.DeepEqual(got, wantPods) {
+				t.Fatalf("TopPods = %+v, want %+v", got, wantPods)
+			}
+			if got := TopNodes(families, AllNamespaces); !reflect.DeepEqual(got, wantNodes) {
+				t.Fatalf("TopNodes = %+v, want %+v", got, wantNodes)
+			}
+			if got := TopDeployments(families, AllNamespaces); len(got) != 1 || got[0].Unavailable != 1 {
+				t.Fatalf("unexpected deployments %+v", got)
+			}
+		})
+	}
+}
+
+func TestNormalizeRenamesHPAFamiliesAndLabels(t *testing.T) {
+	for _, fixture := range fixtureVersions {
+		t.Run(fixture.version, func(t *testing.T) {
+			families := Normalize(loadFixture(t, fixture.version))
+
+			var hpa *dto.MetricFamily
+			for _, mf := range families {
+				if mf.GetName() == "kube_hpa_spec_max_replicas" {
+					t.Fatalf("expected legacy hpa family to be renamed")
+				}
+				if mf.GetName() == "kube_horizontalpodautoscaler_spec_max_replicas" {
+					hpa = mf
+				}
+			}
+			if hpa == nil || len(hpa.Metric) != 1 {
+				t.Fatalf("expected one kube_horizontalpodautoscaler_spec_max_replicas series, got %v", hpa)
+			}
+			labels := make(map[string]string)
+			for _, l := range hpa.Metric[0].Label {
+				labels[l.GetName()] = l.GetValue()
+			}
+			if labels["horizontalpodautoscaler"] != "api" || labels["hpa"] != "" {
+				t.Fatalf("expected the hpa label to be renamed, got %v", labels)
+			}
+		})
+	}
+}
+
+func TestNormalizePrefersCurrentFamiliesAndLeavesInputUntouched(t *testing.T) {
+	families := loadFixture(t, "v1.9.8")
+	before := len(families)
+
+	normalized := Normalize(families)
+	count := 0
+	for _, mf := range normalized {
+		if mf.GetName() == "kube_pod_container_resource_requests" {
+			count++
+			if len(mf.Metric) != 4 {
+				t.Fatalf("expected legacy requests not to be counted twice, got %d series", len(mf.Metric))
+			}
+		}
+		if mf.GetName() == "kube_pod_container_resource_requests_cpu_cores" {
+			t.Fatalf("expected the legacy family to be dropped")
+		}
+	}
+	if count != 1 || len(families) != before {
+		t.Fatalf("expected one requests family and an untouched input")
+	}
+
+	current := loadFixture(t, "v2.13.0")
+	if got := Normalize(current); &got[0] != &current[0] {
+		t.Fatalf("expected current families to be returned as is")
+	}
+}
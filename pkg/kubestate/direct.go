@@ -0,0 +1,103 @@
+/*
+ * Copyright 2018 Paul Welch
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License"); you may not use this file except in compliance with the License. You may obtain a copy of the License at
+ *
+ * http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software distributed under the License is distributed on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the License for the specific language governing permissions and limitations under the License.
+ */
+
+package kubestate
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/url"
+
+	"k8s.io/client-go/rest"
+)
+
+// readDirect streams MetricsURL into read without the API server proxy, for clusters that only
+// expose kube-state-metrics over TLS behind kube-rbac-proxy. The request carries the bearer
+// token from the kubeconfig or service account, and a URL without a path scrapes /metrics.
+func (c *Client) readDirect(ctx context.Context, accept string, read scrapeReader) (*scrapeResult, error) {
+	client, err := c.directClient()
+	if err != nil {
+		return nil, err
+	}
+
+	target, err := directMetricsURL(c.opts.MetricsURL)
+	if err != nil {
+		return nil, err
+	}
+	ctx, responded, cancel := c.headerTimeout(ctx)
+	defer cancel()
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, target, nil)
+	if err != nil {
+		return nil, err
+	}
+	if accept != "" {
+		req.Header.Set("Accept", accept)
+	}
+	req.Header.Set("Accept-Encoding", acceptEncoding)
+
+	resp, err := client.Do(req)
+	if !responded() {
+		if err == nil {
+			resp.Body.Close()
+		}
+		return nil, c.errNoResponse(target)
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("scraping %s: %s", target, resp.Status)
+	}
+	return c.readBody(resp.Body, read)
+}
+
+// directClient builds an HTTP client from the rest config on first use, so it shares the
+// kubeconfig's bearer token, client certificate and TLS settings.
+func (c *Client) directClient() (*http.Client, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.direct != nil {
+		return c.direct, nil
+	}
+	if err := c.init(); err != nil {
+		return nil, err
+	}
+
+	cfg := rest.CopyConfig(c.cfg)
+	cfg.TLSClientConfig.ServerName = ""
+	// readDirect bounds the wait for a response instead of the whole scrape
+	cfg.Timeout = 0
+	client, err := rest.HTTPClientFor(cfg)
+	if err != nil {
+		return nil, err
+	}
+	c.direct = client
+	return client, nil
+}
+
+func directMetricsURL(raw string) (string, error) {
+	u, err := url.Parse(raw)
+	if err != nil {
+		return "", err
+	}
+	switch u.Scheme {
+	case "http", "https":
+	default:
+		return "", fmt.Errorf("%w %q in metrics URL %q: want http or https", ErrUnsupportedScheme, u.Scheme, raw)
+	}
+	if u.Path == "" || u.Path == "/" {
+		u.Path = "/metrics"
+	}
+	return u.String(), nil
+}
@@ -0,0 +1,74 @@
+package kubestate
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestClientScrapesMetricsURLWithBearerToken(t *testing.T) {
+	server := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Authorization") != "Bearer test-token" {
+			http.Error(w, "Unauthorized", http.StatusUnauthorized)
+			return
+		}
+		if r.URL.Path != "/metrics" {
+			http.NotFound(w, r)
+			return
+		}
+		w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+		w.Write([]byte("# TYPE kube_pod_info gauge\nkube_pod_info{namespace=\"default\",pod=\"p1\"} 1\n"))
+	}))
+	defer server.Close()
+
+	kubeconfig := writeKubeconfig(t, "https://kubernetes.invalid", "test-token")
+	client := NewClient(Options{Kubeconfig: kubeconfig, MetricsURL: server.URL, InsecureSkipTLSVerify: true})
+	families, err := client.MetricFamilies(context.Background())
+	if err != nil {
+		t.Fatalf("MetricFamilies returned error: %v", err)
+	}
+	if len(families) != 1 || families[0].GetName() != "kube_pod_info" {
+		t.Fatalf("unexpected families %v", families)
+	}
+
+	kubeconfig = writeKubeconfig(t, "https://kubernetes.invalid", "wrong-token")
+	client = NewClient(Options{Kubeconfig: kubeconfig, MetricsURL: server.URL + "/metrics", InsecureSkipTLSVerify: true})
+	if _, err := client.RawMetrics(context.Background()); err == nil {
+		t.Fatalf("expected an unauthorized scrape to fail")
+	}
+}
+
+func TestDirectMetricsURL(t *testing.T) {
+	for raw, want := range map[string]string{
+		"https://ksm.monitoring.svc:8443":         "https://ksm.monitoring.svc:8443/metrics",
+		"https://ksm.monitoring.svc:8443/":        "https://ksm.monitoring.svc:8443/metrics",
+		"http://10.0.0.1:8080/custom/metrics?x=1": "http://10.0.0.1:8080/custom/metrics?x=1",
+	} {
+		got, err := directMetricsURL(raw)
+		if err != nil || got != want {
+			t.Fatalf("directMetricsURL(%q) = %q, %v; want %q", raw, got, err, want)
+		}
+	}
+	if _, err := directMetricsURL("ftp://ksm"); !errors.Is(err, ErrUnsupportedScheme) {
+		t.Fatalf("expected ErrUnsupportedScheme, got %v", err)
+	}
+}
+
+func writeKubeconfig(t *testing.T, server, token string) string {
+	t.Helper()
+
+	path := filepath.Join(t.TempDir(), "kubeconfig")
+	kubeconfig := "apiVersion: v1\nkind: Config\n" +
+		"clusters:\n- name: test\n  cluster:\n    server: " + server + "\n" +
+		"contexts:\n- name: test\n  context:\n    cluster: test\n    user: test\n" +
+		"current-context: test\n" +
+		"users:\n- name: test\n  user:\n    token: " + token + "\n"
+	if err := os.WriteFile(path, []byte(kubeconfig), 0600); err != nil {
+		t.Fatalf("writing kubeconfig: %v", err)
+	}
+	return path
+}
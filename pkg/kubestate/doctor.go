@@ -0,0 +1,392 @@
+/*
+ * Copyright 2018 Paul Welch
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License"); you may not use this file except in compliance with the License. You may obtain a copy of the License at
+ *
+ * http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software distributed under the License is distributed on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the License for the specific language governing permissions and limitations under the License.
+ */
+
+package kubestate
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+
+	dto "github.com/prometheus/client_model/go"
+	authorizationv1 "k8s.io/api/authorization/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+// CheckStatus is the outcome of one Diagnose step.
+type CheckStatus string
+
+const (
+	CheckOK      CheckStatus = "ok"
+	CheckWarn    CheckStatus = "warn"
+	CheckFail    CheckStatus = "fail"
+	CheckSkipped CheckStatus = "skipped"
+)
+
+// Check is one step of a Diagnosis.
+type Check struct {
+	Name   string
+	Status CheckStatus
+	Detail string
+}
+
+// ScrapeStats describes a single scrape of kube-state-metrics.
+type ScrapeStats struct {
+	Latency time.Duration
+	Bytes   int
+	// Transferred and Encoding describe the response as received, before decompression.
+	Transferred int64
+	Encoding    string
+	Format      string
+	Families    int
+	Series      int
+}
+
+// Diagnosis reports each step of reaching kube-state-metrics, in order, with what was found
+// along the way. Steps that depend on a failed one are skipped.
+type Diagnosis struct {
+	Checks  []Check
+	Service *ServiceRef
+	Shards  []ShardRef
+	Scrape  *ScrapeStats
+	// Version is the kube-state-metrics version from kube_state_metrics_build_info.
+	Version string
+	// ListErrors and WatchErrors count failed list and watch calls per resource, from the telemetry port.
+	ListErrors  map[string]float64
+	WatchErrors map[string]float64
+}
+
+// OK reports whether no check failed.
+func (d *Diagnosis) OK() bool {
+	for _, check := range d.Checks {
+		if check.Status == CheckFail {
+			return false
+		}
+	}
+	return true
+}
+
+func (d *Diagnosis) add(name string, status CheckStatus, format string, args ...interface{}) {
+	d.Checks = append(d.Checks, Check{Name: name, Status: status, Detail: fmt.Sprintf(format, args...)})
+}
+
+func (d *Diagnosis) skip(names ...string) {
+	for _, name := range names {
+		d.add(name, CheckSkipped, "")
+	}
+}
+
+// Diagnose walks through discovery, permissions, health, scraping and the kube-state-metrics
+// self-telemetry without using or updating the cached service, so it reflects the cluster as it is now.
+func (c *Client) Diagnose(ctx context.Context) *Diagnosis {
+	d := &Diagnosis{}
+
+	if c.opts.PrometheusURL != "" {
+		d.add("config", CheckOK, "Prometheus %s", c.opts.PrometheusURL)
+		d.skip("permissions", "service", "health")
+		start := time.Now()
+		result, err := c.readPrometheus(ctx, acceptHeader, readRaw)
+		if err != nil {
+			d.add("scrape", CheckFail, "%v", err)
+			d.skip("version", "telemetry")
+			return d
+		}
+		families := d.scraped(time.Since(start), []*scrapeResult{result})
+		d.version(families, nil)
+		d.skip("telemetry")
+		return d
+	}
+
+	c.mu.Lock()
+	err := c.init()
+	c.mu.Unlock()
+	if err != nil {
+		d.add("config", CheckFail, "%v", err)
+		d.skip("permissions", "service", "health", "scrape", "version", "telemetry")
+		return d
+	}
+	d.add("config", CheckOK, "API server %s", c.cfg.Host)
+
+	if c.opts.MetricsURL != "" {
+		d.skip("permissions", "service", "health")
+		start := time.Now()
+		result, err := c.readDirect(ctx, acceptHeader, readRaw)
+		if err != nil {
+			d.add("scrape", CheckFail, "%s: %v", c.opts.MetricsURL, err)
+			d.skip("version", "telemetry")
+			return d
+		}
+		families := d.scraped(time.Since(start), []*scrapeResult{result})
+		d.version(families, nil)
+		d.skip("telemetry")
+		return d
+	}
+
+	d.permissions(ctx, c)
+
+	service, err := ResolveService(ctx, c.clientset, c.opts)
+	if err != nil {
+		d.add("service", CheckFail, "%s", describeAPIError(err))
+		d.skip("health", "scrape", "version", "telemetry")
+		return d
+	}
+	d.Service = &service
+	port := service.Port
+	if port == "" {
+		port = "unnamed port"
+	}
+	d.add("service", CheckOK, "%s/%s %s via %s", service.Namespace, service.Name, port, service.ProxyName)
+
+	start := time.Now()
+	resp, err := c.get(ctx, proxyURI(c.cfg, service, "healthz"))
+	switch {
+	case err != nil:
+		d.add("health", CheckFail, "%s", describeAPIError(err))
+		d.skip("scrape", "version", "telemetry")
+		return d
+	case !strings.EqualFold(strings.TrimSpace(string(resp)), "ok"):
+		d.add("health", CheckFail, "/healthz returned %q", strings.TrimSpace(string(resp)))
+		d.skip("scrape", "version", "telemetry")
+		return d
+	}
+	d.add("health", CheckOK, "/healthz ok in %s", time.Since(start).Round(time.Millisecond))
+
+	var shards []ShardRef
+	if c.opts.Sharded {
+		if shards, err = ResolveShards(ctx, c.clientset, service); err != nil {
+			d.add("shards", CheckFail, "%s", describeAPIError(err))
+			d.skip("scrape", "version", "telemetry")
+			return d
+		}
+		d.Shards = shards
+		pods := make([]string, 0, len(shards))
+		for _, shard := range shards {
+			pods = append(pods, shard.Pod)
+		}
+		d.add("shards", CheckOK, "%d ready: %s", len(shards), strings.Join(pods, ", "))
+	}
+
+	start = time.Now()
+	results, err := c.fetch(ctx, service, shards, acceptHeader, readRaw)
+	if err != nil {
+		d.add("scrape", CheckFail, "%s", describeAPIError(err))
+		d.skip("version", "telemetry")
+		return d
+	}
+	families := d.scraped(time.Since(start), results)
+
+	if service.TelemetryProxyName == "" {
+		d.version(families)
+		d.add("telemetry", CheckSkipped, "service exposes no telemetry port")
+		return d
+	}
+
+	telemetryRef := service
+	telemetryRef.ProxyName = service.TelemetryProxyName
+	var telemetry []*dto.MetricFamily
+	result, err := c.read(ctx, proxyURI(c.cfg, telemetryRef, "metrics"), acceptHeader, readFamilies(Filter{}))
+	if err == nil {
+		telemetry = result.families
+	}
+	d.version(families, telemetry)
+	if err != nil {
+		d.add("telemetry", CheckWarn, "%s: %s", service.TelemetryProxyName, describeAPIError(err))
+		return d
+	}
+	d.telemetry(telemetry)
+	return d
+}
+
+// scraped records the scrape statistics and returns the merged families.
+func (d *Diagnosis) scraped(latency time.Duration, results []*scrapeResult) []*dto.MetricFamily {
+	stats := &ScrapeStats{Latency: latency}
+	sets := make([][]*dto.MetricFamily, 0, len(results))
+	for _, result := range results {
+		families, format, err := ParseMetricsFormat(result.raw)
+		if err != nil {
+			d.add("scrape", CheckFail, "%v", err)
+			return nil
+		}
+		stats.Bytes += len(result.raw)
+		stats.Transferred += result.transferred
+		stats.Encoding = result.encoding
+		stats.Format = format
+		sets = append(sets, families)
+	}
+
+	families := MergeFamilies(sets...)
+	stats.Families = len(families)
+	for _, mf := range families {
+		stats.Series += len(mf.Metric)
+	}
+	d.Scrape = stats
+
+	status := CheckOK
+	if stats.Format != FormatProtobuf {
+		status = CheckWarn
+	}
+	size := fmt.Sprintf("%d bytes", stats.Bytes)
+	if stats.Encoding != EncodingIdentity {
+		size = fmt.Sprintf("%d bytes (%d %s)", stats.Bytes, stats.Transferred, stats.Encoding)
+	}
+	d.add("scrape", status, "%s, %s in %s, %d families, %d series",
+		stats.Format, size, latency.Round(time.Millisecond), stats.Families, stats.Series)
+	return families
+}
+
+func (d *Diagnosis) version(sets ...[]*dto.MetricFamily) {
+	legacy := ""
+	if len(sets) > 0 {
+		if renames := LegacyFamilies(sets[0]); len(renames) > 0 {
+			legacy = fmt.Sprintf("%d legacy families normalized (removed in %s)", len(renames), renames[0].Removed)
+		}
+	}
+
+	for _, families := range sets {
+		for _, mf := range families {
+			if mf.GetName() != "kube_state_metrics_build_info" {
+				continue
+			}
+			for _, m := range mf.Metric {
+				for _, l := range m.Label {
+					if l.GetName() == "version" {
+						d.Version = l.GetValue()
+						if legacy != "" {
+							d.add("version", CheckOK, "%s, %s", d.Version, legacy)
+						} else {
+							d.add("version", CheckOK, "%s", d.Version)
+						}
+						return
+					}
+				}
+			}
+		}
+	}
+
+	if legacy != "" {
+		d.add("version", CheckWarn, "kube_state_metrics_build_info not found, %s", legacy)
+		return
+	}
+	d.add("version", CheckWarn, "kube_state_metrics_build_info not found")
+}
+
+// telemetry sums the failed list and watch calls reported on the telemetry port.
+func (d *Diagnosis) telemetry(families []*dto.MetricFamily) {
+	d.ListErrors = make(map[string]float64)
+	d.WatchErrors = make(map[string]float64)
+	for _, mf := range families {
+		var errs map[string]float64
+		switch mf.GetName() {
+		case "kube_state_metrics_list_total":
+			errs = d.ListErrors
+		case "kube_state_metrics_watch_total":
+			errs = d.WatchErrors
+		default:
+			continue
+		}
+		for _, m := range mf.Metric {
+			resource, result := "", ""
+			for _, l := range m.Label {
+				switch l.GetName() {
+				case "resource":
+					resource = l.GetValue()
+				case "result":
+					result = l.GetValue()
+				}
+			}
+			if result == "error" && m.GetCounter().GetValue() > 0 {
+				errs[resource] += m.GetCounter().GetValue()
+			}
+		}
+	}
+
+	if len(d.ListErrors) == 0 && len(d.WatchErrors) == 0 {
+		d.add("telemetry", CheckOK, "no list or watch errors")
+		return
+	}
+	d.add("telemetry", CheckWarn, "list errors: %s; watch errors: %s", formatCounts(d.ListErrors), formatCounts(d.WatchErrors))
+}
+
+func formatCounts(counts map[string]float64) string {
+	if len(counts) == 0 {
+		return "none"
+	}
+	keys := make([]string, 0, len(counts))
+	for k := range counts {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	parts := make([]string, 0, len(keys))
+	for _, k := range keys {
+		parts = append(parts, fmt.Sprintf("%s=%g", k, counts[k]))
+	}
+	return strings.Join(parts, ", ")
+}
+
+// permissions asks the API server whether the current user may make each request kubestate needs.
+func (d *Diagnosis) permissions(ctx context.Context, c *Client) {
+	ns := c.opts.MetricsNamespace
+	checks := []authorizationv1.ResourceAttributes{
+		{Verb: "list", Resource: "services", Namespace: ns},
+		{Verb: "get", Resource: "services", Subresource: "proxy", Namespace: ns},
+	}
+	if c.opts.Sharded {
+		checks = append(checks,
+			authorizationv1.ResourceAttributes{Verb: "get", Resource: "endpoints", Namespace: ns},
+			authorizationv1.ResourceAttributes{Verb: "get", Resource: "pods", Subresource: "proxy", Namespace: ns},
+		)
+	}
+
+	denied := make([]string, 0)
+	for _, attrs := range checks {
+		attrs := attrs
+		review := &authorizationv1.SelfSubjectAccessReview{Spec: authorizationv1.SelfSubjectAccessReviewSpec{ResourceAttributes: &attrs}}
+		result, err := c.clientset.AuthorizationV1().SelfSubjectAccessReviews().Create(ctx, review, metav1.CreateOptions{})
+		if err != nil {
+			d.add("permissions", CheckWarn, "could not review access: %s", describeAPIError(err))
+			return
+		}
+		if !result.Status.Allowed {
+			denied = append(denied, describeAccess(attrs))
+		}
+	}
+
+	if len(denied) > 0 {
+		d.add("permissions", CheckFail, "not allowed to %s", strings.Join(denied, ", "))
+		return
+	}
+	d.add("permissions", CheckOK, "%d required permissions granted", len(checks))
+}
+
+func describeAccess(attrs authorizationv1.ResourceAttributes) string {
+	resource := attrs.Resource
+	if attrs.Subresource != "" {
+		resource += "/" + attrs.Subresource
+	}
+	scope := "in all namespaces"
+	if attrs.Namespace != "" {
+		scope = "in namespace " + attrs.Namespace
+	}
+	return attrs.Verb + " " + resource + " " + scope
+}
+
+// describeAPIError points out authorization failures, whose messages name the user and the missing permission.
+func describeAPIError(err error) string {
+	switch {
+	case apierrors.IsForbidden(err):
+		return "RBAC: " + err.Error()
+	case apierrors.IsUnauthorized(err):
+		return "authentication: " + err.Error()
+	}
+	return err.Error()
+}
@@ -0,0 +1,91 @@
+package kubestate
+
+import (
+	"context"
+	"strings"
+	"testing"
+)
+
+func TestDiagnoseReportsServiceScrapeAndTelemetry(t *testing.T) {
+	api := newFakeAPIServer(t)
+
+	d := NewClient(Options{Kubeconfig: api.kubeconfig}).Diagnose(context.Background())
+	if !d.OK() {
+		t.Fatalf("expected a healthy diagnosis, got %+v", d.Checks)
+	}
+
+	names := make([]string, 0, len(d.Checks))
+	for _, check := range d.Checks {
+		names = append(names, check.Name)
+	}
+	if got := strings.Join(names, ","); got != "config,permissions,service,health,scrape,version,telemetry" {
+		t.Fatalf("unexpected check order %s", got)
+	}
+
+	if d.Service == nil || d.Service.ProxyName != "http:kube-state-metrics:8080" || d.Service.TelemetryProxyName != "http:kube-state-metrics:8081" {
+		t.Fatalf("unexpected service %+v", d.Service)
+	}
+	if d.Scrape == nil || d.Scrape.Format != FormatText || d.Scrape.Families != 1 || d.Scrape.Series != 1 || d.Scrape.Bytes == 0 {
+		t.Fatalf("unexpected scrape stats %+v", d.Scrape)
+	}
+	if d.Version != "v2.13.0" {
+		t.Fatalf("expected version from the telemetry port, got %q", d.Version)
+	}
+	if d.ListErrors["*v1.Secret"] != 3 || len(d.WatchErrors) != 0 {
+		t.Fatalf("unexpected list/watch errors %v %v", d.ListErrors, d.WatchErrors)
+	}
+	if last := d.Checks[len(d.Checks)-1]; last.Status != CheckWarn || !strings.Contains(last.Detail, "*v1.Secret=3") {
+		t.Fatalf("expected a telemetry warning, got %+v", last)
+	}
+}
+
+func TestDiagnoseReportsMissingPermissionsAndService(t *testing.T) {
+	api := newFakeAPIServer(t)
+	api.denied = "services"
+	api.setNamespace("")
+
+	d := NewClient(Options{Kubeconfig: api.kubeconfig}).Diagnose(context.Background())
+	if d.OK() {
+		t.Fatalf("expected a failed diagnosis")
+	}
+
+	statuses := make(map[string]Check)
+	for _, check := range d.Checks {
+		statuses[check.Name] = check
+	}
+	if c := statuses["permissions"]; c.Status != CheckFail || !strings.Contains(c.Detail, "list services in all namespaces") {
+		t.Fatalf("expected missing list permission, got %+v", c)
+	}
+	if c := statuses["service"]; c.Status != CheckFail {
+		t.Fatalf("expected the service check to fail, got %+v", c)
+	}
+	if c := statuses["scrape"]; c.Status != CheckSkipped {
+		t.Fatalf("expected the scrape to be skipped, got %+v", c)
+	}
+}
+
+func TestDiagnoseSkipsScrapeWhenUnhealthy(t *testing.T) {
+	api := newFakeAPIServer(t)
+	api.unhealthy = true
+
+	d := NewClient(Options{Kubeconfig: api.kubeconfig}).Diagnose(context.Background())
+	if d.OK() {
+		t.Fatalf("expected a failed diagnosis")
+	}
+
+	statuses := make(map[string]Check)
+	for _, check := range d.Checks {
+		statuses[check.Name] = check
+	}
+	if c := statuses["health"]; c.Status != CheckFail || !strings.Contains(c.Detail, "not ready") {
+		t.Fatalf("expected the health check to fail, got %+v", c)
+	}
+	for _, name := range []string{"scrape", "version", "telemetry"} {
+		if c := statuses[name]; c.Status != CheckSkipped {
+			t.Fatalf("expected %s to be skipped, got %+v", name, c)
+		}
+	}
+	if got := api.count("metrics"); got != 0 {
+		t.Fatalf("expected no scrape after a failed health check, got %d", got)
+	}
+}
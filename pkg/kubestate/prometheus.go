@@ -0,0 +1,307 @@
+/*
+ * Copyright 2018 Paul Welch
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License"); you may not use this file except in compliance with the License. You may obtain a copy of the License at
+ *
+ * http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software distributed under the License is distributed on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the License for the specific language governing permissions and limitations under the License.
+ */
+
+package kubestate
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/matttproud/golang_protobuf_extensions/pbutil"
+	dto "github.com/prometheus/client_model/go"
+	"github.com/prometheus/common/expfmt"
+)
+
+// Prometheus APIs a Prometheus source reads from.
+const (
+	// PrometheusQuery runs an instant query against /api/v1/query.
+	PrometheusQuery = "query"
+	// PrometheusFederate reads the /federate endpoint.
+	PrometheusFederate = "federate"
+)
+
+// kubeSeries selects the kube-state-metrics series in Prometheus.
+const kubeSeries = `__name__=~"kube_.+"`
+
+// readPrometheus reads the kube-state-metrics series stored in the Prometheus compatible server
+// at PrometheusURL, such as Thanos or Mimir, and passes them to read encoded as if scraped from
+// kube-state-metrics itself.
+func (c *Client) readPrometheus(ctx context.Context, accept string, read scrapeReader) (*scrapeResult, error) {
+	target, err := prometheusURL(c.opts)
+	if err != nil {
+		return nil, err
+	}
+	ctx, responded, cancel := c.headerTimeout(ctx)
+	defer cancel()
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, target, nil)
+	if err != nil {
+		return nil, err
+	}
+	if c.opts.PrometheusMode == PrometheusFederate {
+		req.Header.Set("Accept", acceptHeader)
+	} else {
+		req.Header.Set("Accept", "application/json")
+	}
+	req.Header.Set("Accept-Encoding", acceptEncoding)
+
+	start := time.Now()
+	resp, err := http.DefaultClient.Do(req)
+	if !responded() {
+		if err == nil {
+			resp.Body.Close()
+		}
+		return nil, c.errNoResponse(c.opts.PrometheusURL)
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	wire := &countingReader{r: resp.Body}
+	decoded, encoding, err := decompress(wire)
+	if err != nil {
+		return nil, err
+	}
+	defer decoded.Close()
+	plain := &countingReader{r: decoded}
+
+	var families []*dto.MetricFamily
+	if c.opts.PrometheusMode == PrometheusFederate {
+		if resp.StatusCode != http.StatusOK {
+			return nil, fmt.Errorf("federating from %s: %s", c.opts.PrometheusURL, resp.Status)
+		}
+		families, _, err = ParseMetricsStream(plain, Filter{})
+	} else {
+		families, err = decodeQueryResponse(plain, resp.Status)
+	}
+	if err != nil {
+		return nil, err
+	}
+	restoreExportedLabels(families)
+	dropDuplicateSeries(families)
+
+	var buf bytes.Buffer
+	for _, mf := range families {
+		if accept == "" {
+			_, err = expfmt.MetricFamilyToText(&buf, mf)
+		} else {
+			_, err = pbutil.WriteDelimited(&buf, mf)
+		}
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	result, err := read(&buf)
+	if err != nil {
+		return nil, err
+	}
+	result.transferred = wire.n
+	result.decoded = plain.n
+	result.encoding = encoding
+	result.decodeTime = time.Since(start) - wire.wait
+	c.record(result)
+
+	return result, nil
+}
+
+// prometheusURL builds the query or federate request for the kube-state-metrics series,
+// narrowed by PrometheusSelector.
+func prometheusURL(opts Options) (string, error) {
+	u, err := url.Parse(opts.PrometheusURL)
+	if err != nil {
+		return "", err
+	}
+	switch u.Scheme {
+	case "http", "https":
+	default:
+		return "", fmt.Errorf("%w: scheme %q in %q: want http or https", ErrInvalidPrometheusSource, u.Scheme, opts.PrometheusURL)
+	}
+
+	selector := kubeSeries
+	if s := strings.Trim(strings.TrimSpace(opts.PrometheusSelector), "{}"); s != "" {
+		selector += "," + s
+	}
+	selector = "{" + selector + "}"
+
+	query := url.Values{}
+	switch opts.PrometheusMode {
+	case "", PrometheusQuery:
+		u.Path = strings.TrimSuffix(u.Path, "/") + "/api/v1/query"
+		query.Set("query", selector)
+	case PrometheusFederate:
+		u.Path = strings.TrimSuffix(u.Path, "/") + "/federate"
+		query.Set("match[]", selector)
+	default:
+		return "", fmt.Errorf("%w: mode %q: want %s or %s", ErrInvalidPrometheusSource, opts.PrometheusMode, PrometheusQuery, PrometheusFederate)
+	}
+	u.RawQuery = query.Encode()
+	return u.String(), nil
+}
+
+// queryResponse is the instant query response of the Prometheus HTTP API.
+type queryResponse struct {
+	Status    string `json:"status"`
+	ErrorType string `json:"errorType"`
+	Error     string `json:"error"`
+	Data      struct {
+		ResultType string `json:"resultType"`
+		Result     []struct {
+			Metric map[string]string `json:"metric"`
+			Value  [2]interface{}    `json:"value"`
+		} `json:"result"`
+	} `json:"data"`
+}
+
+// decodeQueryResponse converts an instant query vector to families sorted by name. The API
+// carries no metric metadata, so families ending in _total are counters and the rest gauges.
+func decodeQueryResponse(body io.Reader, status string) ([]*dto.MetricFamily, error) {
+	var resp queryResponse
+	if err := json.NewDecoder(body).Decode(&resp); err != nil {
+		return nil, fmt.Errorf("Error reading Prometheus query response (%s): %v", status, err)
+	}
+	if resp.Status != "success" {
+		return nil, fmt.Errorf("Prometheus query failed: %s: %s", resp.ErrorType, resp.Error)
+	}
+	if resp.Data.ResultType != "vector" {
+		return nil, fmt.Errorf("Prometheus query returned a %s, want a vector", resp.Data.ResultType)
+	}
+
+	byName := make(map[string]*dto.MetricFamily)
+	for _, sample := range resp.Data.Result {
+		name := sample.Metric["__name__"]
+		raw, _ := sample.Value[1].(string)
+		value, err := strconv.ParseFloat(raw, 64)
+		if name == "" || err != nil {
+			continue
+		}
+
+		mf := byName[name]
+		if mf == nil {
+			t := dto.MetricType_GAUGE
+			if strings.HasSuffix(name, "_total") {
+				t = dto.MetricType_COUNTER
+			}
+			mf = &dto.MetricFamily{Name: &name, Type: &t}
+			byName[name] = mf
+		}
+
+		m := &dto.Metric{}
+		for _, label := range sortedLabelNames(sample.Metric) {
+			if label == "__name__" {
+				continue
+			}
+			labelName, labelValue := label, sample.Metric[label]
+			m.Label = append(m.Label, &dto.LabelPair{Name: &labelName, Value: &labelValue})
+		}
+		if mf.GetType() == dto.MetricType_COUNTER {
+			m.Counter = &dto.Counter{Value: &value}
+		} else {
+			m.Gauge = &dto.Gauge{Value: &value}
+		}
+		mf.Metric = append(mf.Metric, m)
+	}
+
+	families := make([]*dto.MetricFamily, 0, len(byName))
+	for _, mf := range byName {
+		families = append(families, mf)
+	}
+	sort.Slice(families, func(i, j int) bool { return families[i].GetName() < families[j].GetName() })
+	return families, nil
+}
+
+func sortedLabelNames(labels map[string]string) []string {
+	names := make([]string, 0, len(labels))
+	for name := range labels {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// prometheusTargetLabels are the labels Prometheus attaches to series from the
+// kube-state-metrics scrape target. The scrape-only ones are always dropped; the rest are
+// also kube-state-metrics labels, and are only dropped when the series' own value was
+// moved aside to an exported_ label.
+var prometheusTargetLabels = map[string]bool{
+	"instance":  true,
+	"job":       true,
+	"endpoint":  true,
+	"service":   true,
+	"namespace": false,
+	"pod":       false,
+	"container": false,
+}
+
+// restoreExportedLabels undoes the labelling Prometheus applies to kube-state-metrics series.
+// The target's instance, job, endpoint and service labels are dropped. Without honor_labels,
+// series labels that clashed with the target's are stored as exported_namespace, exported_pod
+// and so on; those get their names back in place of the target's. With honor_labels the
+// series labels are already in place and are kept.
+func restoreExportedLabels(families []*dto.MetricFamily) {
+	for _, mf := range families {
+		for _, m := range mf.Metric {
+			exported := make(map[string]bool)
+			for _, l := range m.Label {
+				if name, ok := strings.CutPrefix(l.GetName(), "exported_"); ok {
+					exported[name] = true
+				}
+			}
+
+			kept := m.Label[:0]
+			for _, l := range m.Label {
+				if scrapeOnly, ok := prometheusTargetLabels[l.GetName()]; ok && (scrapeOnly || exported[l.GetName()]) {
+					continue
+				}
+				if name, ok := strings.CutPrefix(l.GetName(), "exported_"); ok {
+					value := l.GetValue()
+					l = &dto.LabelPair{Name: &name, Value: &value}
+				}
+				kept = append(kept, l)
+			}
+			sort.Slice(kept, func(i, j int) bool { return kept[i].GetName() < kept[j].GetName() })
+			m.Label = kept
+		}
+	}
+}
+
+// dropDuplicateSeries keeps the first of each series with the same labels. Once the target
+// labels are gone, replicas of a highly available kube-state-metrics, or a series scraped
+// by more than one job, are indistinguishable and would otherwise be counted twice.
+func dropDuplicateSeries(families []*dto.MetricFamily) {
+	for _, mf := range families {
+		seen := make(map[string]bool, len(mf.Metric))
+		kept := mf.Metric[:0]
+		for _, m := range mf.Metric {
+			var key strings.Builder
+			for _, l := range m.Label {
+				key.WriteString(l.GetName())
+				key.WriteByte(0)
+				key.WriteString(l.GetValue())
+				key.WriteByte(0)
+			}
+			if seen[key.String()] {
+				continue
+			}
+			seen[key.String()] = true
+			kept = append(kept, m)
+		}
+		mf.Metric = kept
+	}
+}
@@ -0,0 +1,213 @@
+package kubestate
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strconv"
+	"strings"
+	"testing"
+
+	dto "github.com/prometheus/client_model/go"
+	"github.com/prometheus/common/expfmt"
+	"google.golang.org/protobuf/proto"
+)
+
+// scrapeTargets are the replicas of a highly available kube-state-metrics a fake Prometheus scrapes.
+var scrapeTargets = []map[string]string{
+	{"instance": "10.0.0.7:8080", "pod": "ksm-0"},
+	{"instance": "10.0.0.8:8080", "pod": "ksm-1"},
+}
+
+// fakePrometheus serves families through /api/v1/query and /federate the way Prometheus does
+// after scraping every replica in scrapeTargets. Without honorLabels, series labels that clash
+// with the target's are stored as exported_ labels; with it, the series labels win.
+func fakePrometheus(t *testing.T, families []*dto.MetricFamily, honorLabels bool) (*httptest.Server, *[]string) {
+	t.Helper()
+
+	var scraped []*dto.MetricFamily
+	for _, mf := range families {
+		mf = proto.Clone(mf).(*dto.MetricFamily)
+		var metrics []*dto.Metric
+		for _, target := range scrapeTargets {
+			for _, m := range mf.Metric {
+				labels := map[string]string{
+					"instance":  target["instance"],
+					"job":       "kube-state-metrics",
+					"endpoint":  "http",
+					"service":   "kube-state-metrics",
+					"namespace": "monitoring",
+					"pod":       target["pod"],
+					"container": "kube-state-metrics",
+				}
+				for _, l := range m.Label {
+					name := l.GetName()
+					if _, ok := labels[name]; ok && !honorLabels {
+						name = "exported_" + name
+					}
+					labels[name] = l.GetValue()
+				}
+				m = proto.Clone(m).(*dto.Metric)
+				m.Label = nil
+				for _, name := range sortedLabelNames(labels) {
+					m.Label = append(m.Label, &dto.LabelPair{Name: proto.String(name), Value: proto.String(labels[name])})
+				}
+				metrics = append(metrics, m)
+			}
+		}
+		mf.Metric = metrics
+		scraped = append(scraped, mf)
+	}
+
+	var selectors []string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/prometheus/api/v1/query":
+			selectors = append(selectors, r.URL.Query().Get("query"))
+			result := make([]map[string]interface{}, 0)
+			for _, mf := range scraped {
+				for _, m := range mf.Metric {
+					labels := map[string]string{"__name__": mf.GetName()}
+					for _, l := range m.Label {
+						labels[l.GetName()] = l.GetValue()
+					}
+					value := strconv.FormatFloat(metricValue(m), 'f', -1, 64)
+					result = append(result, map[string]interface{}{"metric": labels, "value": []interface{}{1700000000.5, value}})
+				}
+			}
+			w.Header().Set("Content-Type", "application/json")
+			json.NewEncoder(w).Encode(map[string]interface{}{
+				"status": "success",
+				"data":   map[string]interface{}{"resultType": "vector", "result": result},
+			})
+		case "/prometheus/federate":
+			selectors = append(selectors, r.URL.Query().Get("match[]"))
+			w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+			for _, mf := range scraped {
+				expfmt.MetricFamilyToText(w, mf)
+			}
+		default:
+			http.NotFound(w, r)
+		}
+	}))
+	t.Cleanup(server.Close)
+
+	return server, &selectors
+}
+
+func TestPrometheusSourceServesTheSameViews(t *testing.T) {
+	want := loadFixture(t, "v2.13.0")
+
+	for _, honorLabels := range []bool{false, true} {
+		server, selectors := fakePrometheus(t, want, honorLabels)
+
+		for _, mode := range []string{PrometheusQuery, PrometheusFederate} {
+			t.Run(fmt.Sprintf("%s honor_labels=%t", mode, honorLabels), func(t *testing.T) {
+				client := NewClient(Options{PrometheusURL: server.URL + "/prometheus/", PrometheusMode: mode, PrometheusSelector: `cluster="prod"`})
+				families, err := client.MetricFamilies(context.Background())
+				if err != nil {
+					t.Fatalf("MetricFamilies returned error: %v", err)
+				}
+
+				if got := (*selectors)[len(*selectors)-1]; got != `{__name__=~"kube_.+",cluster="prod"}` {
+					t.Fatalf("unexpected selector %q", got)
+				}
+				if got, want := TopPods(families, AllNamespaces), TopPods(want, AllNamespaces); !reflect.DeepEqual(got, want) {
+					t.Fatalf("TopPods = %+v, want %+v", got, want)
+				}
+				if got, want := TopNodes(families, AllNamespaces), TopNodes(want, AllNamespaces); !reflect.DeepEqual(got, want) {
+					t.Fatalf("TopNodes = %+v, want %+v", got, want)
+				}
+				if got := TopDeployments(families, AllNamespaces); len(got) != 1 || got[0].Namespace != "default" {
+					t.Fatalf("expected the deployment's own namespace, got %+v", got)
+				}
+				for _, mf := range families {
+					for _, m := range mf.Metric {
+						for _, l := range m.Label {
+							if l.GetName() == "instance" || l.GetName() == "job" {
+								t.Fatalf("expected target labels to be dropped from %s, got %v", mf.GetName(), m.Label)
+							}
+						}
+					}
+				}
+
+				raw, err := client.RawMetrics(context.Background())
+				if err != nil || !strings.Contains(raw, "# TYPE kube_node_status_capacity gauge") {
+					t.Fatalf("expected a text exposition, got %q, %v", raw, err)
+				}
+			})
+		}
+	}
+}
+
+func TestDecodeQueryResponseTypesCounters(t *testing.T) {
+	body := `{"status":"success","data":{"resultType":"vector","result":[` +
+		`{"metric":{"__name__":"kube_pod_container_status_restarts_total","container":"api","namespace":"default","pod":"api-1"},"value":[1700000000,"3"]},` +
+		`{"metric":{"__name__":"kube_node_info","node":"n1"},"value":[1700000000,"1"]}]}}`
+
+	families, err := decodeQueryResponse(strings.NewReader(body), "200 OK")
+	if err != nil {
+		t.Fatalf("decodeQueryResponse returned error: %v", err)
+	}
+	if len(families) != 2 || families[0].GetName() != "kube_node_info" || families[0].GetType() != dto.MetricType_GAUGE {
+		t.Fatalf("unexpected families %v", families)
+	}
+	restarts := families[1]
+	if restarts.GetType() != dto.MetricType_COUNTER || restarts.Metric[0].GetCounter().GetValue() != 3 || len(restarts.Metric[0].Label) != 3 {
+		t.Fatalf("unexpected restarts family %v", restarts)
+	}
+
+	_, err = decodeQueryResponse(strings.NewReader(`{"status":"error","errorType":"bad_data","error":"parse error"}`), "400 Bad Request")
+	if err == nil || !strings.Contains(err.Error(), "parse error") {
+		t.Fatalf("expected the query error to be reported, got %v", err)
+	}
+}
+
+func TestPrometheusURLRejectsInvalidSources(t *testing.T) {
+	for _, opts := range []Options{
+		{PrometheusURL: "ftp://prometheus:9090"},
+		{PrometheusURL: "http://prometheus:9090", PrometheusMode: "remote-read"},
+	} {
+		if _, err := prometheusURL(opts); !errors.Is(err, ErrInvalidPrometheusSource) {
+			t.Fatalf("expected ErrInvalidPrometheusSource for %+v, got %v", opts, err)
+		}
+	}
+}
+
+func TestRestoreExportedLabelsDropsTargetLabels(t *testing.T) {
+	families, err := decodeQueryResponse(strings.NewReader(`{"status":"success","data":{"resultType":"vector","result":[`+
+		`{"metric":{"__name__":"kube_node_info","node":"n1","instance":"10.0.0.7:8080","job":"kube-state-metrics","endpoint":"http","service":"kube-state-metrics"},"value":[1700000000,"1"]},`+
+		`{"metric":{"__name__":"kube_pod_container_info","container":"api","namespace":"default","pod":"api-1","instance":"10.0.0.7:8080","job":"kube-state-metrics"},"value":[1700000000,"1"]},`+
+		`{"metric":{"__name__":"kube_pod_container_info","container":"api","namespace":"default","pod":"api-1","instance":"10.0.0.8:8080","job":"kube-state-metrics"},"value":[1700000000,"1"]},`+
+		`{"metric":{"__name__":"kube_pod_info","node":"n1","job":"kube-state-metrics","namespace":"monitoring","pod":"ksm-0","exported_namespace":"default","exported_pod":"api-1"},"value":[1700000000,"1"]}]}}`), "200 OK")
+	if err != nil {
+		t.Fatalf("decodeQueryResponse returned error: %v", err)
+	}
+	restoreExportedLabels(families)
+	dropDuplicateSeries(families)
+
+	labels := func(m *dto.Metric) map[string]string {
+		got := make(map[string]string)
+		for _, l := range m.Label {
+			got[l.GetName()] = l.GetValue()
+		}
+		return got
+	}
+	if got := labels(families[0].Metric[0]); !reflect.DeepEqual(got, map[string]string{"node": "n1"}) {
+		t.Fatalf("expected target labels to be dropped from the node series, got %v", got)
+	}
+	containers := families[1].Metric
+	if len(containers) != 1 {
+		t.Fatalf("expected the replicas' copies of a series to be merged, got %v", containers)
+	}
+	if got := labels(containers[0]); !reflect.DeepEqual(got, map[string]string{"container": "api", "namespace": "default", "pod": "api-1"}) {
+		t.Fatalf("expected honored labels to be kept on the container series, got %v", got)
+	}
+	if got := labels(families[2].Metric[0]); !reflect.DeepEqual(got, map[string]string{"namespace": "default", "node": "n1", "pod": "api-1"}) {
+		t.Fatalf("expected exported labels to be restored on the pod series, got %v", got)
+	}
+}
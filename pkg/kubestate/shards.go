@@ -0,0 +1,109 @@
+/*
+ * Copyright 2018 Paul Welch
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License"); you may not use this file except in compliance with the License. You may obtain a copy of the License at
+ *
+ * http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software distributed under the License is distributed on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the License for the specific language governing permissions and limitations under the License.
+ */
+
+package kubestate
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"strconv"
+
+	dto "github.com/prometheus/client_model/go"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/rest"
+)
+
+// ShardRef identifies one kube-state-metrics shard pod and the proxy name used to reach it.
+type ShardRef struct {
+	Namespace string
+	Pod       string
+	ProxyName string
+}
+
+// ResolveShards lists the ready pods behind the kube-state-metrics service, one per shard,
+// so a sharded install can be scraped in full rather than through whichever shard the
+// service happens to route to.
+func ResolveShards(ctx context.Context, k8sclient kubernetes.Interface, service ServiceRef) ([]ShardRef, error) {
+	endpoints, err := k8sclient.CoreV1().Endpoints(service.Namespace).Get(ctx, service.Name, metav1.GetOptions{})
+	if apierrors.IsNotFound(err) {
+		return nil, fmt.Errorf("%w: no endpoints for service %q in namespace %q", ErrServiceUnhealthy, service.Name, service.Namespace)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	scheme := service.Scheme
+	if scheme == "" {
+		scheme = "http"
+	}
+
+	shards := make([]ShardRef, 0)
+	for _, subset := range endpoints.Subsets {
+		port := -1
+		for _, p := range subset.Ports {
+			if p.Name == service.Port || len(subset.Ports) == 1 {
+				port = int(p.Port)
+				break
+			}
+		}
+		if port < 0 {
+			continue
+		}
+		for _, addr := range subset.Addresses {
+			if addr.TargetRef == nil || addr.TargetRef.Kind != "Pod" {
+				continue
+			}
+			proxyName := scheme + ":" + addr.TargetRef.Name + ":" + strconv.Itoa(port)
+			shards = append(shards, ShardRef{Namespace: service.Namespace, Pod: addr.TargetRef.Name, ProxyName: proxyName})
+		}
+	}
+
+	if len(shards) == 0 {
+		return nil, fmt.Errorf("%w: no ready pods behind service %q in namespace %q", ErrServiceUnhealthy, service.Name, service.Namespace)
+	}
+
+	sort.Slice(shards, func(i, j int) bool { return shards[i].Pod < shards[j].Pod })
+	return shards, nil
+}
+
+func podProxyURI(cfg *rest.Config, shard ShardRef, path string) string {
+	return cfg.Host + "/api/v1/namespaces/" + shard.Namespace + "/pods/" + shard.ProxyName + "/proxy/" + path
+}
+
+// MergeFamilies combines the families scraped from each shard into one set sorted by name.
+// Shards partition objects between them, so the series of same-named families are appended.
+func MergeFamilies(sets ...[]*dto.MetricFamily) []*dto.MetricFamily {
+	byName := make(map[string]*dto.MetricFamily)
+	for _, families := range sets {
+		for _, mf := range families {
+			merged, ok := byName[mf.GetName()]
+			if !ok {
+				merged = &dto.MetricFamily{Name: mf.Name, Help: mf.Help, Type: mf.Type, Unit: mf.Unit}
+				byName[mf.GetName()] = merged
+			}
+			merged.Metric = append(merged.Metric, mf.Metric...)
+		}
+	}
+
+	names := make([]string, 0, len(byName))
+	for name := range byName {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	merged := make([]*dto.MetricFamily, 0, len(names))
+	for _, name := range names {
+		merged = append(merged, byName[name])
+	}
+	return merged
+}
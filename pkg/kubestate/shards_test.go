@@ -0,0 +1,69 @@
+package kubestate
+
+import (
+	"context"
+	"errors"
+	"testing"
+
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes/fake"
+)
+
+func TestResolveShardsUsesReadyPodsOnMetricsPort(t *testing.T) {
+	endpoints := &corev1.Endpoints{
+		ObjectMeta: metav1.ObjectMeta{Name: "kube-state-metrics", Namespace: "monitoring"},
+		Subsets: []corev1.EndpointSubset{{
+			Addresses: []corev1.EndpointAddress{
+				{IP: "10.0.0.2", TargetRef: &corev1.ObjectReference{Kind: "Pod", Name: "kube-state-metrics-1"}},
+				{IP: "10.0.0.1", TargetRef: &corev1.ObjectReference{Kind: "Pod", Name: "kube-state-metrics-0"}},
+			},
+			NotReadyAddresses: []corev1.EndpointAddress{
+				{IP: "10.0.0.3", TargetRef: &corev1.ObjectReference{Kind: "Pod", Name: "kube-state-metrics-2"}},
+			},
+			Ports: []corev1.EndpointPort{{Name: "telemetry", Port: 8081}, {Name: "http-metrics", Port: 8080}},
+		}},
+	}
+	service := ServiceRef{Namespace: "monitoring", Name: "kube-state-metrics", Port: "http-metrics"}
+
+	shards, err := ResolveShards(context.Background(), fake.NewSimpleClientset(endpoints), service)
+	if err != nil {
+		t.Fatalf("ResolveShards returned error: %v", err)
+	}
+	if len(shards) != 2 || shards[0].Pod != "kube-state-metrics-0" || shards[0].ProxyName != "http:kube-state-metrics-0:8080" {
+		t.Fatalf("unexpected shards %+v", shards)
+	}
+
+	service.Scheme = "https"
+	shards, err = ResolveShards(context.Background(), fake.NewSimpleClientset(endpoints), service)
+	if err != nil || shards[1].ProxyName != "https:kube-state-metrics-1:8080" {
+		t.Fatalf("expected shards to use the service scheme, got %+v, %v", shards, err)
+	}
+
+	if _, err := ResolveShards(context.Background(), fake.NewSimpleClientset(), service); !errors.Is(err, ErrServiceUnhealthy) {
+		t.Fatalf("expected ErrServiceUnhealthy without endpoints, got %v", err)
+	}
+}
+
+func TestMergeFamiliesAppendsShardSeries(t *testing.T) {
+	families := sampleFamilies()
+	series := len(families[1].Metric)
+	merged := MergeFamilies(families[:2], families[1:3])
+
+	if len(merged) != 3 {
+		t.Fatalf("expected 3 distinct families, got %d", len(merged))
+	}
+	for i := 1; i < len(merged); i++ {
+		if merged[i-1].GetName() > merged[i].GetName() {
+			t.Fatalf("expected families sorted by name, got %v", merged)
+		}
+	}
+	for _, mf := range merged {
+		if mf.GetName() == families[1].GetName() && len(mf.Metric) != 2*series {
+			t.Fatalf("expected series from both shards in %s, got %d", mf.GetName(), len(mf.Metric))
+		}
+	}
+	if len(families[1].Metric) != series {
+		t.Fatalf("expected the input families to be left untouched")
+	}
+}
@@ -0,0 +1,246 @@
+/*
+ * Copyright 2018 Paul Welch
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License"); you may not use this file except in compliance with the License. You may obtain a copy of the License at
+ *
+ * http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software distributed under the License is distributed on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the License for the specific language governing permissions and limitations under the License.
+ */
+
+package kubestate
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"sort"
+	"strings"
+
+	dto "github.com/prometheus/client_model/go"
+	"github.com/prometheus/common/expfmt"
+	"github.com/prometheus/common/model"
+	"google.golang.org/protobuf/proto"
+)
+
+// Filter selects the families and series a scrape keeps. The zero Filter keeps everything.
+type Filter struct {
+	// Names are the family names to keep; empty keeps every family.
+	Names []string
+	// Labels keeps only series with each of these label values; families left without
+	// series are dropped.
+	Labels map[string]string
+}
+
+func (f Filter) keepsFamily(name string) bool {
+	if len(f.Names) == 0 {
+		return true
+	}
+	for _, n := range f.Names {
+		if n == name {
+			return true
+		}
+	}
+	return false
+}
+
+// series applies the label filter to mf, returning nil when no series match.
+func (f Filter) series(mf *dto.MetricFamily) *dto.MetricFamily {
+	if len(f.Labels) == 0 {
+		return mf
+	}
+
+	kept := mf.Metric[:0]
+	for _, m := range mf.Metric {
+		matched := 0
+		for _, l := range m.Label {
+			if v, ok := f.Labels[l.GetName()]; ok && v == l.GetValue() {
+				matched++
+			}
+		}
+		if matched == len(f.Labels) {
+			kept = append(kept, m)
+		}
+	}
+	if len(kept) == 0 {
+		return nil
+	}
+	mf.Metric = kept
+	return mf
+}
+
+// Apply returns the families of an already parsed scrape that filter keeps. Families are
+// copied before their series are filtered, so the input is not modified.
+func (f Filter) Apply(metricFamilies []*dto.MetricFamily) []*dto.MetricFamily {
+	kept := make([]*dto.MetricFamily, 0)
+	for _, mf := range metricFamilies {
+		if !f.keepsFamily(mf.GetName()) {
+			continue
+		}
+		if len(f.Labels) > 0 {
+			mf = &dto.MetricFamily{Name: mf.Name, Help: mf.Help, Type: mf.Type, Unit: mf.Unit,
+				Metric: append([]*dto.Metric(nil), mf.Metric...)}
+		}
+		if mf = f.series(mf); mf != nil {
+			kept = append(kept, mf)
+		}
+	}
+	return kept
+}
+
+// ParseMetricsStream is ParseMetricsFormat for a response that is still being read. Families
+// that filter drops are skipped as they stream past; in the protobuf format they are not
+// even decoded, and in the text format only their lines are discarded before parsing.
+func ParseMetricsStream(r io.Reader, filter Filter) ([]*dto.MetricFamily, string, error) {
+	br := bufio.NewReaderSize(r, 64*1024)
+
+	if isDelimitedProtobuf(br) {
+		families, err := readProtobufFamilies(br, filter)
+		return families, FormatProtobuf, err
+	}
+
+	text := io.Reader(br)
+	if len(filter.Names) > 0 {
+		var kept bytes.Buffer
+		if err := filterTextFamilies(br, &kept, filter.keepsFamily); err != nil {
+			return nil, "", err
+		}
+		text = &kept
+	}
+
+	textParser := expfmt.NewTextParser(model.NameValidationScheme)
+	parsed, err := textParser.TextToMetricFamilies(text)
+	if err != nil {
+		return nil, "", fmt.Errorf("Error reading metric family text: %v", err)
+	}
+
+	names := make([]string, 0, len(parsed))
+	for name := range parsed {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	families := make([]*dto.MetricFamily, 0, len(names))
+	for _, name := range names {
+		if mf := filter.series(parsed[name]); mf != nil {
+			families = append(families, mf)
+		}
+	}
+	return families, FormatText, nil
+}
+
+// isDelimitedProtobuf peeks at the first message: a length prefix followed by the tag of the
+// MetricFamily name field. Text starts with a comment or a metric name instead.
+func isDelimitedProtobuf(br *bufio.Reader) bool {
+	head, _ := br.Peek(binary.MaxVarintLen64 + 1)
+	_, n := binary.Uvarint(head)
+	return n > 0 && n < len(head) && head[n] == 0x0a
+}
+
+func readProtobufFamilies(br *bufio.Reader, filter Filter) ([]*dto.MetricFamily, error) {
+	families := make([]*dto.MetricFamily, 0)
+	var buf []byte
+	for {
+		size, err := binary.ReadUvarint(br)
+		if err == io.EOF {
+			return families, nil
+		}
+		if err != nil {
+			return nil, fmt.Errorf("Error reading metric family protobuf: %v", err)
+		}
+
+		if uint64(cap(buf)) < size {
+			buf = make([]byte, size)
+		}
+		buf = buf[:size]
+		if _, err := io.ReadFull(br, buf); err != nil {
+			return nil, fmt.Errorf("Error reading metric family protobuf: %v", err)
+		}
+
+		if name, ok := protobufFamilyName(buf); ok && !filter.keepsFamily(name) {
+			continue
+		}
+		mf := &dto.MetricFamily{}
+		if err := proto.Unmarshal(buf, mf); err != nil {
+			return nil, fmt.Errorf("Error reading metric family protobuf: %v", err)
+		}
+		if !filter.keepsFamily(mf.GetName()) {
+			continue
+		}
+		if mf = filter.series(mf); mf != nil {
+			families = append(families, mf)
+		}
+	}
+}
+
+// protobufFamilyName reads the name of an encoded MetricFamily without decoding it, when the
+// name is the first field as every encoder writes it.
+func protobufFamilyName(msg []byte) (string, bool) {
+	if len(msg) < 2 || msg[0] != 0x0a {
+		return "", false
+	}
+	size, n := binary.Uvarint(msg[1:])
+	if n <= 0 || uint64(len(msg)-1-n) < size {
+		return "", false
+	}
+	return string(msg[1+n : 1+n+int(size)]), true
+}
+
+// filterTextFamilies copies the lines of the families keep selects. Samples belong to the
+// family of the preceding HELP or TYPE line, including the _sum, _count and _bucket series
+// of summaries and histograms; samples without one are their own family.
+func filterTextFamilies(r *bufio.Reader, w *bytes.Buffer, keep func(string) bool) error {
+	family, keeping := "", false
+	for {
+		line, err := r.ReadString('\n')
+		if len(line) > 0 {
+			if name, ok := textFamilyName(line, family); ok && name != family {
+				family, keeping = name, keep(name)
+			}
+			if keeping {
+				w.WriteString(line)
+				if !strings.HasSuffix(line, "\n") {
+					w.WriteByte('\n')
+				}
+			}
+		}
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+	}
+}
+
+// textFamilyName returns the family a text exposition line belongs to, given the current
+// family; ok is false for lines that do not name one, such as blank lines and plain comments.
+func textFamilyName(line, family string) (string, bool) {
+	trimmed := strings.TrimLeft(line, " \t")
+	if strings.HasPrefix(trimmed, "#") {
+		fields := strings.Fields(trimmed)
+		if len(fields) >= 3 && (fields[1] == "HELP" || fields[1] == "TYPE") {
+			return fields[2], true
+		}
+		return "", false
+	}
+
+	end := strings.IndexAny(trimmed, "{ \t\r\n")
+	if end < 0 {
+		end = len(trimmed)
+	}
+	sample := trimmed[:end]
+	if sample == "" {
+		return "", false
+	}
+	if family != "" {
+		for _, suffix := range []string{"", "_sum", "_count", "_bucket"} {
+			if sample == family+suffix {
+				return family, true
+			}
+		}
+	}
+	return sample, true
+}
@@ -0,0 +1,114 @@
+package kubestate
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/matttproud/golang_protobuf_extensions/pbutil"
+)
+
+func TestParseMetricsStreamProtobufKeepsFilteredFamilies(t *testing.T) {
+	var buf bytes.Buffer
+	for _, mf := range sampleFamilies() {
+		if _, err := pbutil.WriteDelimited(&buf, mf); err != nil {
+			t.Fatalf("WriteDelimited: %v", err)
+		}
+	}
+
+	families, format, err := ParseMetricsStream(&buf, Filter{Names: []string{"kube_node_status_capacity"}})
+	if err != nil {
+		t.Fatalf("ParseMetricsStream returned error: %v", err)
+	}
+	if format != FormatProtobuf {
+		t.Fatalf("expected protobuf format, got %q", format)
+	}
+	if len(families) != 1 || families[0].GetName() != "kube_node_status_capacity" || len(families[0].Metric) != 2 {
+		t.Fatalf("unexpected families %v", families)
+	}
+}
+
+func TestParseMetricsStreamTextKeepsHistogramSeries(t *testing.T) {
+	text := "# HELP kube_pod_info Pod info.\n" +
+		"# TYPE kube_pod_info gauge\n" +
+		`kube_pod_info{namespace="default",pod="p1"} 1` + "\n" +
+		"# TYPE http_request_duration_seconds histogram\n" +
+		`http_request_duration_seconds_bucket{le="1"} 2` + "\n" +
+		`http_request_duration_seconds_bucket{le="+Inf"} 3` + "\n" +
+		"http_request_duration_seconds_sum 1.5\n" +
+		"http_request_duration_seconds_count 3\n" +
+		"# TYPE kube_node_info gauge\n" +
+		`kube_node_info{node="n1"} 1`
+
+	families, format, err := ParseMetricsStream(strings.NewReader(text), Filter{Names: []string{"http_request_duration_seconds", "kube_node_info"}})
+	if err != nil {
+		t.Fatalf("ParseMetricsStream returned error: %v", err)
+	}
+	if format != FormatText {
+		t.Fatalf("expected text format, got %q", format)
+	}
+	if len(families) != 2 || families[0].GetName() != "http_request_duration_seconds" || families[1].GetName() != "kube_node_info" {
+		t.Fatalf("unexpected families %v", families)
+	}
+	if h := families[0].Metric[0].GetHistogram(); h.GetSampleCount() != 3 || len(h.Bucket) != 2 {
+		t.Fatalf("unexpected histogram %v", h)
+	}
+}
+
+func TestParseMetricsStreamLabelFilterDropsEmptyFamilies(t *testing.T) {
+	text := "# TYPE kube_pod_info gauge\n" +
+		`kube_pod_info{namespace="default",pod="p1"} 1` + "\n" +
+		`kube_pod_info{namespace="kube-system",pod="dns"} 1` + "\n" +
+		"# TYPE kube_node_info gauge\n" +
+		`kube_node_info{node="n1"} 1` + "\n"
+
+	families, _, err := ParseMetricsStream(strings.NewReader(text), Filter{Labels: map[string]string{"namespace": "kube-system"}})
+	if err != nil {
+		t.Fatalf("ParseMetricsStream returned error: %v", err)
+	}
+	if len(families) != 1 || families[0].GetName() != "kube_pod_info" || len(families[0].Metric) != 1 {
+		t.Fatalf("unexpected families %v", families)
+	}
+}
+
+func TestFilterApplyLeavesInputUntouched(t *testing.T) {
+	families := sampleFamilies()
+	filter := Filter{Names: []string{"kube_node_status_capacity"}, Labels: map[string]string{"resource": "cpu"}}
+
+	kept := filter.Apply(families)
+	if len(kept) != 1 || len(kept[0].Metric) != 1 {
+		t.Fatalf("unexpected families %v", kept)
+	}
+	if !reflect.DeepEqual(families, sampleFamilies()) {
+		t.Fatal("Apply modified its input")
+	}
+}
+
+func TestClusterFilterKeepsLegacyFamilies(t *testing.T) {
+	for _, fixture := range fixtureVersions {
+		t.Run(fixture.version, func(t *testing.T) {
+			resp, err := os.ReadFile(filepath.Join("testdata", "ksm-"+fixture.version+".prom"))
+			if err != nil {
+				t.Fatalf("reading fixture: %v", err)
+			}
+			filtered, _, err := ParseMetricsStream(bytes.NewReader(resp), ClusterFilter())
+			if err != nil {
+				t.Fatalf("ParseMetricsStream returned error: %v", err)
+			}
+
+			families := loadFixture(t, fixture.version)
+			if len(filtered) >= len(families) {
+				t.Fatalf("expected the filter to drop families, kept %d of %d", len(filtered), len(families))
+			}
+			if got, want := TopNodes(filtered, AllNamespaces), TopNodes(families, AllNamespaces); !reflect.DeepEqual(got, want) {
+				t.Fatalf("TopNodes = %+v, want %+v", got, want)
+			}
+			if got, want := TopPods(filtered, AllNamespaces), TopPods(families, AllNamespaces); !reflect.DeepEqual(got, want) {
+				t.Fatalf("TopPods = %+v, want %+v", got, want)
+			}
+		})
+	}
+}
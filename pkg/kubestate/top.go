@@ -0,0 +1,242 @@
+/*
+ * Copyright 2018 Paul Welch
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License"); you may not use this file except in compliance with the License. You may obtain a copy of the License at
+ *
+ * http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software distributed under the License is distributed on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the License for the specific language governing permissions and limitations under the License.
+ */
+
+package kubestate
+
+import (
+	"sort"
+
+	dto "github.com/prometheus/client_model/go"
+)
+
+// AllNamespaces selects every namespace in the rollups.
+const AllNamespaces = "*"
+
+// PodResources is the requests and limits of one pod container; cpu is in cores and memory in bytes.
+// Load is the equally weighted average of cpu and memory requested as a ratio of the node's allocatable.
+type PodResources struct {
+	Namespace     string  `json:"namespace"`
+	Pod           string  `json:"pod"`
+	Container     string  `json:"container"`
+	Node          string  `json:"node"`
+	CPURequest    float64 `json:"cpuRequest"`
+	CPULimit      float64 `json:"cpuLimit"`
+	MemoryRequest float64 `json:"memoryRequest"`
+	MemoryLimit   float64 `json:"memoryLimit"`
+	Load          float64 `json:"load"`
+}
+
+// NodeResources is the requests and limits of every container on a node, with the node's
+// capacity and allocatable; cpu is in cores and memory in bytes.
+type NodeResources struct {
+	Node              string  `json:"node"`
+	CPURequest        float64 `json:"cpuRequest"`
+	CPULimit          float64 `json:"cpuLimit"`
+	CPUCapacity       float64 `json:"cpuCapacity"`
+	CPUAllocatable    float64 `json:"cpuAllocatable"`
+	MemoryRequest     float64 `json:"memoryRequest"`
+	MemoryLimit       float64 `json:"memoryLimit"`
+	MemoryCapacity    float64 `json:"memoryCapacity"`
+	MemoryAllocatable float64 `json:"memoryAllocatable"`
+	Load              float64 `json:"load"`
+}
+
+// DeploymentReplicas is the replica counts of one deployment.
+type DeploymentReplicas struct {
+	Namespace   string  `json:"namespace"`
+	Deployment  string  `json:"deployment"`
+	Requested   float64 `json:"requested"`
+	Available   float64 `json:"available"`
+	Unavailable float64 `json:"unavailable"`
+}
+
+// load is the equally weighted average of cpu and memory requested as a ratio of allocatable.
+// It is not defined for nodes that do not report allocatable.
+func (n *Node) load(cpuRequest, memoryRequest float64) (float64, bool) {
+	if n == nil || n.MemoryAllocatable == 0 || n.CPUAllocatable == 0 {
+		return 0, false
+	}
+	return ((memoryRequest / n.MemoryAllocatable) + (cpuRequest / n.CPUAllocatable)) / 2, true
+}
+
+// Pods returns every pod container in namespace, ordered by namespace, pod and container.
+// Containers on nodes without allocatable, including unscheduled ones, have zero load.
+func Pods(metricFamilies []*dto.MetricFamily, namespace string) []*PodResources {
+	return NewCluster(metricFamilies).PodResources(namespace)
+}
+
+// TopPods returns the pod containers in namespace whose load is known, highest load first.
+func TopPods(metricFamilies []*dto.MetricFamily, namespace string) []*PodResources {
+	return NewCluster(metricFamilies).TopPods(namespace)
+}
+
+// Nodes returns every node, ordered by name, with the requests of containers in namespace.
+// Nodes that do not report allocatable have zero load.
+func Nodes(metricFamilies []*dto.MetricFamily, namespace string) []*NodeResources {
+	return NewCluster(metricFamilies).NodeResources(namespace)
+}
+
+// TopNodes returns the nodes whose load is known, highest load first, counting only
+// requests of containers in namespace.
+func TopNodes(metricFamilies []*dto.MetricFamily, namespace string) []*NodeResources {
+	return NewCluster(metricFamilies).TopNodes(namespace)
+}
+
+// TopDeployments returns the deployments in namespace, most requested replicas first.
+func TopDeployments(metricFamilies []*dto.MetricFamily, namespace string) []*DeploymentReplicas {
+	return NewCluster(metricFamilies).TopDeployments(namespace)
+}
+
+// PodResources is the package level Pods on an already indexed scrape.
+func (c *Cluster) PodResources(namespace string) []*PodResources {
+	pods, _ := c.collectPods(namespace)
+	return pods
+}
+
+// TopPods is the package level TopPods on an already indexed scrape.
+func (c *Cluster) TopPods(namespace string) []*PodResources {
+	pods, loaded := c.collectPods(namespace)
+
+	top := make([]*PodResources, 0, len(pods))
+	for _, p := range pods {
+		if loaded[p] {
+			top = append(top, p)
+		}
+	}
+	sort.SliceStable(top, func(i, j int) bool { return top[i].Load > top[j].Load })
+
+	return top
+}
+
+// NodeResources is the package level Nodes on an already indexed scrape.
+func (c *Cluster) NodeResources(namespace string) []*NodeResources {
+	nodes, _ := c.collectNodes(namespace)
+	return nodes
+}
+
+// TopNodes is the package level TopNodes on an already indexed scrape.
+func (c *Cluster) TopNodes(namespace string) []*NodeResources {
+	nodes, loaded := c.collectNodes(namespace)
+
+	top := make([]*NodeResources, 0, len(nodes))
+	for _, n := range nodes {
+		if loaded[n] {
+			top = append(top, n)
+		}
+	}
+	sort.SliceStable(top, func(i, j int) bool { return top[i].Load > top[j].Load })
+
+	return top
+}
+
+// TopDeployments is the package level TopDeployments on an already indexed scrape.
+func (c *Cluster) TopDeployments(namespace string) []*DeploymentReplicas {
+	deployments := make([]*DeploymentReplicas, 0, len(c.Workloads[KindDeployment]))
+	for _, w := range c.Workloads[KindDeployment] {
+		if inNamespace(namespace, w.Namespace) {
+			deployments = append(deployments, &DeploymentReplicas{
+				Namespace:   w.Namespace,
+				Deployment:  w.Name,
+				Requested:   w.Replicas,
+				Available:   w.Available,
+				Unavailable: w.Unavailable,
+			})
+		}
+	}
+	sort.Slice(deployments, func(i, j int) bool {
+		if deployments[i].Requested != deployments[j].Requested {
+			return deployments[i].Requested > deployments[j].Requested
+		}
+		if deployments[i].Namespace != deployments[j].Namespace {
+			return deployments[i].Namespace < deployments[j].Namespace
+		}
+		return deployments[i].Deployment < deployments[j].Deployment
+	})
+
+	return deployments
+}
+
+// collectPods returns a row per container with a request or limit and computes each load
+// from node allocatable. The set reports which containers have a known load.
+func (c *Cluster) collectPods(namespace string) ([]*PodResources, map[*PodResources]bool) {
+	list := make([]*PodResources, 0)
+	loaded := make(map[*PodResources]bool)
+	for _, p := range c.Pods {
+		if !inNamespace(namespace, p.Namespace) {
+			continue
+		}
+		for _, co := range p.Containers {
+			if !co.resourced {
+				continue
+			}
+			row := &PodResources{
+				Namespace:     p.Namespace,
+				Pod:           p.Name,
+				Container:     co.Name,
+				Node:          p.Node,
+				CPURequest:    co.CPURequest,
+				CPULimit:      co.CPULimit,
+				MemoryRequest: co.MemoryRequest,
+				MemoryLimit:   co.MemoryLimit,
+			}
+			if load, ok := c.Nodes[p.Node].load(co.CPURequest, co.MemoryRequest); ok && p.Node != "" {
+				row.Load = load
+				loaded[row] = true
+			}
+			list = append(list, row)
+		}
+	}
+	sort.Slice(list, func(i, j int) bool {
+		if list[i].Namespace != list[j].Namespace {
+			return list[i].Namespace < list[j].Namespace
+		}
+		if list[i].Pod != list[j].Pod {
+			return list[i].Pod < list[j].Pod
+		}
+		return list[i].Container < list[j].Container
+	})
+
+	return list, loaded
+}
+
+// collectNodes sums container requests and limits in namespace per node, alongside node
+// capacity and allocatable. The set reports which nodes have a known load.
+func (c *Cluster) collectNodes(namespace string) ([]*NodeResources, map[*NodeResources]bool) {
+	list := make([]*NodeResources, 0, len(c.Nodes))
+	loaded := make(map[*NodeResources]bool)
+	for _, n := range c.Nodes {
+		row := &NodeResources{
+			Node:              n.Name,
+			CPUCapacity:       n.CPUCapacity,
+			CPUAllocatable:    n.CPUAllocatable,
+			MemoryCapacity:    n.MemoryCapacity,
+			MemoryAllocatable: n.MemoryAllocatable,
+		}
+		for _, p := range n.Pods {
+			if !inNamespace(namespace, p.Namespace) {
+				continue
+			}
+			for _, co := range p.Containers {
+				row.CPURequest += co.CPURequest
+				row.CPULimit += co.CPULimit
+				row.MemoryRequest += co.MemoryRequest
+				row.MemoryLimit += co.MemoryLimit
+			}
+		}
+		if load, ok := n.load(row.CPURequest, row.MemoryRequest); ok {
+			row.Load = load
+			loaded[row] = true
+		}
+		list = append(list, row)
+	}
+	sort.Slice(list, func(i, j int) bool { return list[i].Node < list[j].Node })
+
+	return list, loaded
+}
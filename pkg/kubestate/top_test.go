@@ -0,0 +1,138 @@
+package kubestate
+
+import (
+	"testing"
+
+	dto "github.com/prometheus/client_model/go"
+)
+
+func TestTopPodsOrdersByLoadAndSkipsUnplacedContainers(t *testing.T) {
+	families := sampleFamilies()
+
+	top := TopPods(families, AllNamespaces)
+	if len(top) != 2 {
+		t.Fatalf("expected 2 placed containers, got %d", len(top))
+	}
+	if top[0].Pod != "api-1" || top[1].Pod != "dns-1" {
+		t.Fatalf("unexpected order %s, %s", top[0].Pod, top[1].Pod)
+	}
+	// 2 of 4 cpu and 4Gi of 8Gi allocatable
+	if top[0].Load != 0.5 || top[0].CPURequest != 2 || top[0].MemoryLimit != 8589934592 {
+		t.Fatalf("unexpected api-1 row %+v", top[0])
+	}
+
+	all := Pods(families, AllNamespaces)
+	if len(all) != 4 || all[0].Pod != "api-1" || all[2].Pod != "pending-1" || all[2].Load != 0 || all[3].Pod != "dns-1" {
+		t.Fatalf("unexpected pods %+v", all)
+	}
+
+	if ns := TopPods(families, "kube-system"); len(ns) != 1 || ns[0].Pod != "dns-1" {
+		t.Fatalf("unexpected kube-system pods %+v", ns)
+	}
+}
+
+func TestTopNodesRollsUpRequestsPerNode(t *testing.T) {
+	families := sampleFamilies()
+
+	top := TopNodes(families, AllNamespaces)
+	if len(top) != 1 {
+		t.Fatalf("expected 1 node with allocatable, got %d", len(top))
+	}
+	n := top[0]
+	if n.Node != "node1" || n.CPURequest != 2.5 || n.CPUCapacity != 4 || n.MemoryAllocatable != 8589934592 {
+		t.Fatalf("unexpected node1 row %+v", n)
+	}
+	if want := (2.5/4 + 4831838208.0/8589934592.0) / 2; n.Load != want {
+		t.Fatalf("load = %v, want %v", n.Load, want)
+	}
+
+	if ns := TopNodes(families, "kube-system"); ns[0].CPURequest != 0.5 || ns[0].CPUCapacity != 4 {
+		t.Fatalf("expected node capacity regardless of namespace, got %+v", ns[0])
+	}
+
+	// node2 only appears in a pod label and has no allocatable
+	if all := Nodes(families, AllNamespaces); len(all) != 2 || all[1].Node != "node2" || all[1].Load != 0 {
+		t.Fatalf("unexpected nodes %+v", all)
+	}
+}
+
+func TestTopNodesReadsLegacyNodeMetricNames(t *testing.T) {
+	families := []*dto.MetricFamily{
+		family("kube_pod_container_resource_requests",
+			gauge(1, "namespace", "default", "pod", "p", "container", "c", "node", "n1", "resource", "cpu"),
+			gauge(1073741824, "namespace", "default", "pod", "p", "container", "c", "node", "n1", "resource", "memory"),
+		),
+		family("kube_node_status_allocatable_cpu_cores", gauge(2, "node", "n1")),
+		family("kube_node_status_allocatable_memory_bytes", gauge(4294967296, "node", "n1")),
+		family("kube_node_status_capacity_cpu_cores", gauge(2, "node", "n1")),
+	}
+
+	top := TopNodes(families, AllNamespaces)
+	if len(top) != 1 || top[0].Load != (0.5+0.25)/2 || top[0].CPUCapacity != 2 {
+		t.Fatalf("unexpected legacy rollup %+v", top)
+	}
+}
+
+func TestTopDeploymentsOrdersByRequestedReplicas(t *testing.T) {
+	deployments := TopDeployments(sampleFamilies(), AllNamespaces)
+	if len(deployments) != 2 {
+		t.Fatalf("expected 2 deployments, got %d", len(deployments))
+	}
+	d := deployments[0]
+	if d.Deployment != "api" || d.Requested != 3 || d.Available != 2 || d.Unavailable != 1 {
+		t.Fatalf("unexpected first deployment %+v", d)
+	}
+	if ns := TopDeployments(sampleFamilies(), "kube-system"); len(ns) != 1 || ns[0].Deployment != "coredns" {
+		t.Fatalf("unexpected kube-system deployments %+v", ns)
+	}
+}
+
+func sampleFamilies() []*dto.MetricFamily {
+	return []*dto.MetricFamily{
+		family("kube_pod_container_resource_requests",
+			gauge(2, "namespace", "default", "pod", "api-1", "container", "api", "node", "node1", "resource", "cpu"),
+			gauge(4294967296, "namespace", "default", "pod", "api-1", "container", "api", "node", "node1", "resource", "memory"),
+			gauge(0.5, "namespace", "kube-system", "pod", "dns-1", "container", "dns", "node", "node1", "resource", "cpu"),
+			gauge(536870912, "namespace", "kube-system", "pod", "dns-1", "container", "dns", "node", "node1", "resource", "memory"),
+			gauge(1, "namespace", "default", "pod", "pending-1", "container", "app", "node", "", "resource", "cpu"),
+			gauge(1, "namespace", "default", "pod", "other-1", "container", "app", "node", "node2", "resource", "gpu"),
+		),
+		family("kube_pod_container_resource_limits",
+			gauge(8589934592, "namespace", "default", "pod", "api-1", "container", "api", "node", "node1", "resource", "memory"),
+		),
+		family("kube_node_status_capacity",
+			gauge(4, "node", "node1", "resource", "cpu"),
+			gauge(8589934592, "node", "node1", "resource", "memory"),
+		),
+		family("kube_node_status_allocatable",
+			gauge(4, "node", "node1", "resource", "cpu"),
+			gauge(8589934592, "node", "node1", "resource", "memory"),
+		),
+		family("kube_deployment_spec_replicas",
+			gauge(3, "namespace", "default", "deployment", "api"),
+			gauge(2, "namespace", "kube-system", "deployment", "coredns"),
+		),
+		family("kube_deployment_status_replicas_available",
+			gauge(2, "namespace", "default", "deployment", "api"),
+			gauge(2, "namespace", "kube-system", "deployment", "coredns"),
+		),
+		family("kube_deployment_status_replicas_unavailable",
+			gauge(1, "namespace", "default", "deployment", "api"),
+		),
+	}
+}
+
+func family(name string, metrics ...*dto.Metric) *dto.MetricFamily {
+	t := dto.MetricType_GAUGE
+	return &dto.MetricFamily{Name: &name, Type: &t, Metric: metrics}
+}
+
+// gauge builds a sample from label name, value pairs.
+func gauge(value float64, labels ...string) *dto.Metric {
+	m := &dto.Metric{Gauge: &dto.Gauge{Value: &value}}
+	for i := 0; i < len(labels); i += 2 {
+		name, v := labels[i], labels[i+1]
+		m.Label = append(m.Label, &dto.LabelPair{Name: &name, Value: &v})
+	}
+	return m
+}
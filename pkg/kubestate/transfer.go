@@ -0,0 +1,144 @@
+/*
+ * Copyright 2018 Paul Welch
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License"); you may not use this file except in compliance with the License. You may obtain a copy of the License at
+ *
+ * http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software distributed under the License is distributed on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the License for the specific language governing permissions and limitations under the License.
+ */
+
+package kubestate
+
+import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"fmt"
+	"io"
+	"time"
+
+	"github.com/klauspost/compress/zstd"
+)
+
+// acceptEncoding asks kube-state-metrics to compress its response. Scrapes set it
+// themselves rather than leaving it to the transport, so compressed bytes can be counted.
+const acceptEncoding = "zstd, gzip"
+
+// Content encodings of a scraped response.
+const (
+	EncodingIdentity = "identity"
+	EncodingGzip     = "gzip"
+	EncodingZstd     = "zstd"
+)
+
+var (
+	gzipMagic = []byte{0x1f, 0x8b}
+	zstdMagic = []byte{0x28, 0xb5, 0x2f, 0xfd}
+)
+
+// TransferStats totals the scrapes made by a Client.
+type TransferStats struct {
+	Scrapes int
+	// Cached counts the scrapes read from the on-disk cache instead of kube-state-metrics.
+	Cached int
+	// Transferred counts response bytes as received, before decompression.
+	Transferred int64
+	// Decoded counts response bytes after decompression.
+	Decoded int64
+	// Encoding is the content encoding of the latest response from kube-state-metrics.
+	Encoding string
+	// DecodeTime is the time spent decompressing and parsing, excluding time waiting on the network.
+	DecodeTime time.Duration
+	// Series counts the series kept, after any Filter.
+	Series int
+}
+
+// Stats returns the totals of every scrape made so far.
+func (c *Client) Stats() TransferStats {
+	c.statsMu.Lock()
+	defer c.statsMu.Unlock()
+	return c.stats
+}
+
+func (c *Client) record(result *scrapeResult) {
+	c.statsMu.Lock()
+	defer c.statsMu.Unlock()
+
+	c.stats.Scrapes++
+	if result.cached {
+		c.stats.Cached++
+	}
+	c.stats.Transferred += result.transferred
+	c.stats.Decoded += result.decoded
+	if result.encoding != "" {
+		c.stats.Encoding = result.encoding
+	}
+	c.stats.DecodeTime += result.decodeTime
+	c.stats.Series += result.series
+}
+
+// readBody decompresses body as needed, passes it to read and records the transfer.
+func (c *Client) readBody(body io.Reader, read scrapeReader) (*scrapeResult, error) {
+	start := time.Now()
+	wire := &countingReader{r: body}
+
+	decoded, encoding, err := decompress(wire)
+	if err != nil {
+		return nil, err
+	}
+	defer decoded.Close()
+
+	plain := &countingReader{r: decoded}
+	result, err := read(plain)
+	if err != nil {
+		return nil, err
+	}
+
+	result.transferred = wire.n
+	result.decoded = plain.n
+	result.encoding = encoding
+	result.decodeTime = time.Since(start) - wire.wait
+	c.record(result)
+
+	return result, nil
+}
+
+// decompress returns body decompressed, with its encoding. The encoding is detected from the
+// magic number of the stream, since proxied streams do not expose response headers; neither
+// exposition format nor JSON can start with either number.
+func decompress(body io.Reader) (io.ReadCloser, string, error) {
+	br := bufio.NewReader(body)
+	head, _ := br.Peek(len(zstdMagic))
+
+	switch {
+	case bytes.HasPrefix(head, gzipMagic):
+		gz, err := gzip.NewReader(br)
+		if err != nil {
+			return nil, "", fmt.Errorf("Error reading gzip response: %v", err)
+		}
+		return gz, EncodingGzip, nil
+	case bytes.HasPrefix(head, zstdMagic):
+		zr, err := zstd.NewReader(br, zstd.WithDecoderConcurrency(1))
+		if err != nil {
+			return nil, "", fmt.Errorf("Error reading zstd response: %v", err)
+		}
+		return zr.IOReadCloser(), EncodingZstd, nil
+	}
+	return io.NopCloser(br), EncodingIdentity, nil
+}
+
+// countingReader counts the bytes read through it and the time spent waiting for them.
+type countingReader struct {
+	r    io.Reader
+	n    int64
+	wait time.Duration
+}
+
+func (cr *countingReader) Read(p []byte) (int, error) {
+	start := time.Now()
+	n, err := cr.r.Read(p)
+	cr.wait += time.Since(start)
+	cr.n += int64(n)
+	return n, err
+}